@@ -0,0 +1,121 @@
+package pc_pdf_generator
+
+import (
+	"sort"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+const (
+	sortBySurname       = "surname"
+	sortByHeadFirstName = "head_first_name"
+	sortByFamilyName    = "family_name"
+	sortBySortAs        = "sort_as"
+
+	defaultLocale = "en"
+
+	// sortAsField is the Planning Center custom field read for sort_as.
+	sortAsField = "Sort As"
+)
+
+// newCollator compares names the way the locale's readers expect, ignoring
+// case and width, so "de la Cruz" files under D and accented names sit with
+// their unaccented neighbours.
+func newCollator(locale string) *collate.Collator {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		tag = language.Make(defaultLocale)
+	}
+
+	return collate.New(tag, collate.IgnoreCase, collate.IgnoreWidth)
+}
+
+// sortPerson is the person a household is filed under: the head, or the
+// first member of a household without one.
+func sortPerson(h Household) *Person {
+	if h.Head != nil {
+		return h.Head
+	}
+
+	if len(h.Members) > 0 {
+		return h.Members[0]
+	}
+
+	return &Person{}
+}
+
+// sortFields are the keys a household is ordered by, most significant
+// first. The person ID comes last so households never tie.
+func (dir *PdfDir) sortFields(h Household, displayOptions Section) []string {
+	p := dir.overridePerson(sortPerson(h))
+
+	switch displayOptions.SortBy {
+	case sortByHeadFirstName:
+		return []string{p.FirstName, p.LastName, p.Id}
+	case sortByFamilyName:
+		if override, ok := dir.personOverride(p); ok && override.FamilyName != "" {
+			return []string{override.FamilyName, p.FirstName, p.Id}
+		}
+	case sortBySortAs:
+		if p.SortAs != "" {
+			return []string{p.SortAs, p.FirstName, p.Id}
+		}
+	}
+
+	return []string{p.LastName, p.FirstName, p.Id}
+}
+
+// compareFields collates a and b field by field.
+func (dir *PdfDir) compareFields(a []string, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := dir.collator.CompareString(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+
+	return len(a) - len(b)
+}
+
+// sortHouseholds returns the households in the order the section files them.
+func (dir *PdfDir) sortHouseholds(entries map[string]Household, displayOptions Section) (households []Household) {
+	households, _ = dir.sortHouseholdsWithKeys(entries, displayOptions)
+	return households
+}
+
+// sortHouseholdsWithKeys is sortHouseholds, also returning each household's
+// sortFields so they needn't be worked out again.
+func (dir *PdfDir) sortHouseholdsWithKeys(entries map[string]Household, displayOptions Section) (households []Household, keys [][]string) {
+	type sortable struct {
+		household Household
+		fields    []string
+	}
+
+	sorted := make([]sortable, 0, len(entries))
+	for _, h := range entries {
+		sorted = append(sorted, sortable{h, dir.sortFields(h, displayOptions)})
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if c := dir.compareFields(sorted[i].fields, sorted[j].fields); c != 0 {
+			return c < 0
+		}
+		return sorted[i].household.Id < sorted[j].household.Id
+	})
+
+	for _, s := range sorted {
+		households = append(households, s.household)
+		keys = append(keys, s.fields)
+	}
+
+	return households, keys
+}
+
+// sortPeople orders people by first name, then last name. Everyone is kept,
+// however many share a name.
+func (dir *PdfDir) sortPeople(people []*Person) {
+	sort.SliceStable(people, func(i, j int) bool {
+		a, b := people[i], people[j]
+		return dir.compareFields([]string{a.FirstName, a.LastName, a.Id}, []string{b.FirstName, b.LastName, b.Id}) < 0
+	})
+}
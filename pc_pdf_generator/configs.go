@@ -0,0 +1,374 @@
+package pc_pdf_generator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	presetDir = "presets"
+
+	// firstConfigId is the default config until another is marked default.
+	firstConfigId = 1
+)
+
+var errConfigChanged = errors.New("config was saved again since it was loaded; reload it and try again")
+
+// ConfigPreset is a config to start from. Presets are JSON files in
+// presetDir, named by their ID. Unsaved configs of the organizations a
+// preset lists start out as that preset.
+type ConfigPreset struct {
+	Id            string   `json:"id"`
+	Name          string   `json:"name"`
+	Organizations []string `json:"organizations,omitempty"`
+	Config        Config   `json:"config"`
+}
+
+// ConfigVersion is a config as it was saved. Version 0 is a config as it
+// was before versions were kept.
+type ConfigVersion struct {
+	Version       int64     `json:"version"`
+	Name          string    `json:"name"`
+	Updated       time.Time `json:"updated"`
+	UpdatedBy     string    `json:"updated_by"`
+	UpdatedByName string    `json:"updated_by_name"`
+	Config        []byte    `json:"-" datastore:",noindex"`
+}
+
+// ConfigSummary is a saved config as listed, without its settings.
+type ConfigSummary struct {
+	Id            int64     `json:"id"`
+	Name          string    `json:"name"`
+	Default       bool      `json:"default"`
+	Version       int64     `json:"version"`
+	Updated       time.Time `json:"updated"`
+	UpdatedByName string    `json:"updated_by_name"`
+}
+
+// ConfigChange is one setting that differs between two versions of a
+// config. Path is the setting's JSON name, like sections[2].header.
+type ConfigChange struct {
+	Path string      `json:"path"`
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+type DefaultConfigRecord struct {
+	Id int64
+}
+
+func configKey(ctx context.Context, id int64) *datastore.Key {
+	return datastore.NewKey(ctx, "Config", "", id, nil)
+}
+
+func configVersionKey(ctx context.Context, id int64, version int64) *datastore.Key {
+	// IDs can't be 0, so version 0 is ID 1.
+	return datastore.NewKey(ctx, "ConfigVersion", "", version+1, configKey(ctx, id))
+}
+
+func defaultConfigKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, "DefaultConfig", "default", 0, nil)
+}
+
+func configName(id int64, name string) string {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Sprintf("Config %d", id)
+	}
+
+	return strings.TrimSpace(name)
+}
+
+func loadPresets() (presets []ConfigPreset, err error) {
+	files, err := filepath.Glob(filepath.Join(presetDir, "*.json"))
+	if err != nil {
+		return presets, err
+	}
+
+	for _, file := range files {
+		preset, err := readPreset(file)
+		if err != nil {
+			return presets, err
+		}
+		presets = append(presets, preset)
+	}
+
+	return presets, nil
+}
+
+func readPreset(file string) (preset ConfigPreset, err error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return preset, err
+	}
+
+	err = json.Unmarshal(contents, &preset)
+	if err != nil {
+		return preset, fmt.Errorf("preset %s: %s", filepath.Base(file), err)
+	}
+	preset.Id = strings.TrimSuffix(filepath.Base(file), ".json")
+
+	return preset, nil
+}
+
+func loadPreset(id string) (preset ConfigPreset, err error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return preset, fmt.Errorf("no preset %q", id)
+	}
+
+	return readPreset(filepath.Join(presetDir, id+".json"))
+}
+
+// organizationPreset returns the preset for the organization's unsaved
+// configs, if it has one.
+func organizationPreset(domain string) (config Config, err error) {
+	presets, err := loadPresets()
+	if err != nil {
+		return config, err
+	}
+
+	for _, preset := range presets {
+		for _, organization := range preset.Organizations {
+			if organization == domain {
+				return preset.Config, nil
+			}
+		}
+	}
+
+	return config, nil
+}
+
+func defaultConfigId(ctx context.Context) (id int64, err error) {
+	record := DefaultConfigRecord{}
+	err = datastore.Get(ctx, defaultConfigKey(ctx), &record)
+	if err == datastore.ErrNoSuchEntity || (err == nil && record.Id == 0) {
+		return firstConfigId, nil
+	}
+
+	return record.Id, err
+}
+
+func setDefaultConfig(ctx context.Context, id int64) (err error) {
+	err = datastore.Get(ctx, configKey(ctx, id), &ConfigRecord{})
+	if err != nil {
+		return err
+	}
+
+	_, err = datastore.Put(ctx, defaultConfigKey(ctx), &DefaultConfigRecord{Id: id})
+
+	return err
+}
+
+// listConfigs returns the saved configs in ID order.
+func listConfigs(ctx context.Context) (configs []ConfigSummary, err error) {
+	defaultId, err := defaultConfigId(ctx)
+	if err != nil {
+		return configs, err
+	}
+
+	var records []ConfigRecord
+	keys, err := datastore.NewQuery("Config").GetAll(ctx, &records)
+	if err != nil {
+		return configs, err
+	}
+
+	for i, record := range records {
+		id := keys[i].IntID()
+		configs = append(configs, ConfigSummary{
+			Id:            id,
+			Name:          configName(id, record.Name),
+			Default:       id == defaultId,
+			Version:       record.Version,
+			Updated:       record.Updated,
+			UpdatedByName: record.UpdatedByName,
+		})
+	}
+
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Id < configs[j].Id })
+
+	return configs, nil
+}
+
+// saveConfig stores the config as its next version. config.Version is the
+// version it was loaded at, and a config saved again since then is refused
+// with errConfigChanged. The first versioned save keeps what it replaces as
+// version 0.
+func saveConfig(ctx context.Context, id int64, config *Config, by string, byName string) (err error) {
+	now := time.Now()
+
+	return datastore.RunInTransaction(ctx, func(tc context.Context) (err error) {
+		record := ConfigRecord{}
+		err = datastore.Get(tc, configKey(tc, id), &record)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if record.Version > config.Version {
+			return errConfigChanged
+		}
+
+		if record.Version == 0 && record.Config != nil {
+			baseline := ConfigVersion{Name: configName(id, record.Name), Config: record.Config}
+			_, err = datastore.Put(tc, configVersionKey(tc, id, 0), &baseline)
+			if err != nil {
+				return err
+			}
+		}
+
+		config.Id = id
+		config.Name = configName(id, config.Name)
+		config.Version = record.Version + 1
+		config.Default = false
+		config.AvailableFonts = nil
+
+		configBytes, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+
+		version := ConfigVersion{
+			Version:       config.Version,
+			Name:          config.Name,
+			Updated:       now,
+			UpdatedBy:     by,
+			UpdatedByName: byName,
+			Config:        configBytes,
+		}
+		_, err = datastore.Put(tc, configVersionKey(tc, id, version.Version), &version)
+		if err != nil {
+			return err
+		}
+
+		_, err = datastore.Put(tc, configKey(tc, id), &ConfigRecord{
+			Config:        configBytes,
+			Name:          version.Name,
+			Version:       version.Version,
+			Updated:       now,
+			UpdatedBy:     by,
+			UpdatedByName: byName,
+		})
+
+		return err
+	}, nil)
+}
+
+// createConfig saves the config under a new ID.
+func createConfig(ctx context.Context, config *Config, by string, byName string) (id int64, err error) {
+	id, _, err = datastore.AllocateIDs(ctx, "Config", nil, 1)
+	if err != nil {
+		return id, err
+	}
+
+	config.Version = 0
+
+	return id, saveConfig(ctx, id, config, by, byName)
+}
+
+func loadConfigVersions(ctx context.Context, id int64, limit int) (versions []ConfigVersion, err error) {
+	_, err = datastore.NewQuery("ConfigVersion").Ancestor(configKey(ctx, id)).Order("-Version").Limit(limit).GetAll(ctx, &versions)
+
+	for i := range versions {
+		versions[i].Config = nil
+	}
+
+	return versions, err
+}
+
+// loadConfigVersion reads a version of a config over config.
+func loadConfigVersion(ctx context.Context, id int64, number int64, config *Config) (err error) {
+	version := ConfigVersion{}
+	err = datastore.Get(ctx, configVersionKey(ctx, id, number), &version)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(version.Config, config)
+	config.Id = id
+	config.Name = configName(id, version.Name)
+	config.Version = number
+
+	return err
+}
+
+// diffConfigs lists the settings that differ between two configs, leaving
+// out which config and version they are.
+func diffConfigs(from *Config, to *Config) (changes []ConfigChange, err error) {
+	a, err := configValues(*from)
+	if err != nil {
+		return changes, err
+	}
+	b, err := configValues(*to)
+	if err != nil {
+		return changes, err
+	}
+
+	return diffValues("", a, b, changes), nil
+}
+
+func configValues(config Config) (values interface{}, err error) {
+	config.Id, config.Version, config.Default, config.AvailableFonts = 0, 0, false, nil
+
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return values, err
+	}
+	err = json.Unmarshal(configBytes, &values)
+
+	return values, err
+}
+
+func diffValues(path string, from interface{}, to interface{}, changes []ConfigChange) []ConfigChange {
+	fromMap, fromIsMap := from.(map[string]interface{})
+	toMap, toIsMap := to.(map[string]interface{})
+	if fromIsMap && toIsMap {
+		keys := make([]string, 0, len(fromMap)+len(toMap))
+		for key := range fromMap {
+			keys = append(keys, key)
+		}
+		for key := range toMap {
+			if _, ok := fromMap[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			changes = diffValues(child, fromMap[key], toMap[key], changes)
+		}
+		return changes
+	}
+
+	fromList, fromIsList := from.([]interface{})
+	toList, toIsList := to.([]interface{})
+	if (fromIsList || from == nil) && (toIsList || to == nil) && (fromIsList || toIsList) {
+		for i := 0; i < len(fromList) || i < len(toList); i++ {
+			var a, b interface{}
+			if i < len(fromList) {
+				a = fromList[i]
+			}
+			if i < len(toList) {
+				b = toList[i]
+			}
+			changes = diffValues(fmt.Sprintf("%s[%d]", path, i), a, b, changes)
+		}
+		return changes
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		changes = append(changes, ConfigChange{Path: path, From: from, To: to})
+	}
+
+	return changes
+}
@@ -0,0 +1,183 @@
+package pc_pdf_generator
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+const (
+	dividerBand = "band"
+	dividerTab  = "tab"
+
+	dividerShade      = 0.2
+	thumbTabWidth     = 8.0
+	maxThumbTabHeight = 20.0
+)
+
+// letterRange is the first and last sort letters printed on a page.
+type letterRange struct {
+	first string
+	last  string
+}
+
+// sortLetter is the letter a household is filed under: the first letter of
+// its sort key, or # for keys that start with anything else.
+func sortLetter(sortKey string) string {
+	for _, r := range strings.TrimSpace(sortKey) {
+		if unicode.IsLetter(r) {
+			return string(unicode.ToUpper(r))
+		}
+		break
+	}
+
+	return "#"
+}
+
+func (dir *PdfDir) bandHeight() float64 {
+	return dir.lineHeight * 2.0
+}
+
+// keepWithNext moves to a fresh column before a heading, such as a letter
+// divider, when the heading and what follows it won't both fit, so a heading
+// is never left alone at the bottom of a column.
+func (dir *PdfDir) keepWithNext(headingHeight float64, nextHeight float64, lastColumn float64, indentPage bool, displayOptions Section) (column float64, firstPage bool) {
+	return dir.placeEntry(headingHeight+nextHeight, lastColumn, indentPage, displayOptions)
+}
+
+// addPageLetter widens the page's letter range to take in letter.
+func addPageLetter(pages map[int]*letterRange, page int, letter string) {
+	if r, ok := pages[page]; ok {
+		r.last = letter
+		return
+	}
+
+	pages[page] = &letterRange{first: letter, last: letter}
+}
+
+// dividerNextHeight is the space a divider keeps free below itself: the
+// household's first entry, or the whole household when households are kept
+// together and it fits in a column.
+func (dir *PdfDir) dividerNextHeight(entries []householdEntry, firstPage bool, displayOptions Section) float64 {
+	if dir.keepHouseholds {
+		height := dir.householdHeight(entries, displayOptions)
+		top, bottom := dir.columnSpace(firstPage, displayOptions)
+		if height <= bottom-top {
+			return height
+		}
+	}
+
+	return dir.householdHeight(entries[:1], displayOptions)
+}
+
+// writeDivider prints a band with the letter across the column. nextHeight
+// is the space the household after it needs, padding included.
+func (dir *PdfDir) writeDivider(letter string, nextHeight float64, lastColumn float64, indentPage bool, displayOptions Section) (column float64, firstPage bool) {
+	halfPadding := dir.padding / 2.0
+	column, firstPage = dir.keepWithNext(halfPadding+dir.bandHeight(), nextHeight-dir.padding, lastColumn, indentPage, displayOptions)
+
+	left, _ := dir.pageMargins()
+	x := left + column*(dir.colWd+dir.gutter)
+	y := dir.pdf.GetY() + halfPadding
+
+	dir.setFillColor(dir.style.divider)
+	dir.pdf.Rect(x, y, dir.colWd, dir.bandHeight(), "F")
+
+	dir.setFont(dir.headerFontFamily, "", dir.fontSize+4.0)
+	dir.pdf.SetLeftMargin(x)
+	dir.pdf.SetXY(x, y)
+	dir.cell(dir.colWd, dir.bandHeight(), letter, "", 0, "CM", false)
+	dir.setFont(dir.bodyFontFamily, "", dir.fontSize)
+
+	dir.pdf.SetY(y + dir.bandHeight())
+
+	return column, firstPage
+}
+
+// writeLetterMarks goes back over a section's pages, from firstPage on, to
+// print the letter range of each above its header line and, with thumb
+// tabs, a tab at the outside edge for the page's first letter.
+func (dir *PdfDir) writeLetterMarks(pages map[int]*letterRange, letters []string, firstPage int, displayOptions Section) {
+	if len(pages) == 0 || (!displayOptions.LetterRange && displayOptions.LetterDividers != dividerTab) {
+		return
+	}
+
+	lastPage := dir.pdf.PageNo()
+	_, _, _, bottom := dir.pdf.GetMargins()
+	dir.pdf.SetAutoPageBreak(false, bottom)
+
+	for page := firstPage; page <= lastPage; page++ {
+		r, ok := pages[page]
+		if !ok {
+			continue
+		}
+
+		dir.pdf.SetPage(page)
+		if displayOptions.LetterRange {
+			dir.writeLetterRange(*r)
+		}
+		if displayOptions.LetterDividers == dividerTab {
+			dir.writeThumbTab(r.first, letters)
+		}
+	}
+
+	dir.pdf.SetPage(lastPage)
+	left, _ := dir.pageMargins()
+	dir.pdf.SetLeftMargin(left)
+	dir.pdf.SetAutoPageBreak(true, bottom)
+}
+
+// writeLetterRange prints "A" or "A - C" centered in the top margin, like
+// the running head of a phone book.
+func (dir *PdfDir) writeLetterRange(r letterRange) {
+	text := r.first
+	if r.last != r.first {
+		text = r.first + " - " + r.last
+	}
+
+	left, right := dir.pageMargins()
+	width, _ := dir.pdf.GetPageSize()
+	box := dir.pageBox()
+
+	dir.setFont(dir.headerFontFamily, "", dir.fontSize)
+	_, lineHeight := dir.pdf.GetFontSize()
+
+	dir.pdf.SetLeftMargin(left)
+	dir.pdf.SetXY(left, box.y+math.Max(0, (dir.topMargin-box.y-lineHeight)/2.0))
+	dir.cell(width-left-right, lineHeight, text, "", 0, "CM", false)
+	dir.setFont(dir.bodyFontFamily, "", dir.fontSize)
+}
+
+// writeThumbTab prints the letter on a tab at the outside edge of the page,
+// stepped down the page in alphabetical order so the tabs of a closed
+// directory can be told apart. Tabs run on into any bleed so they still
+// reach the edge when the cut is a little off.
+func (dir *PdfDir) writeThumbTab(letter string, letters []string) {
+	index := 0
+	for i, l := range letters {
+		if l == letter {
+			index = i
+			break
+		}
+	}
+
+	_, height := dir.pdf.GetPageSize()
+	box := dir.pageBox()
+	tabHt := math.Min(maxThumbTabHeight, (height-dir.topMargin-dir.bottomMargin)/float64(len(letters)))
+
+	x, fillX := box.x+box.w-thumbTabWidth, box.x+box.w-thumbTabWidth
+	if dir.mirrorMargins && dir.pdf.PageNo()%2 == 0 {
+		x, fillX = box.x, box.x-dir.bleed
+	}
+	y := dir.topMargin + float64(index)*tabHt
+
+	dir.setFillColor(dir.style.tab)
+	dir.pdf.Rect(fillX, y, thumbTabWidth+dir.bleed, tabHt, "F")
+
+	dir.setFont(dir.headerFontFamily, "", dir.fontSize+2.0)
+	dir.setTextColor(rgbColor{255, 255, 255})
+	dir.pdf.SetXY(x, y)
+	dir.cell(thumbTabWidth, tabHt, letter, "", 0, "CM", false)
+	dir.setTextColor(dir.style.text)
+	dir.setFont(dir.bodyFontFamily, "", dir.fontSize)
+}
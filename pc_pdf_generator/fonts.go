@@ -0,0 +1,474 @@
+package pc_pdf_generator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/appengine/datastore"
+
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/net/context"
+)
+
+const (
+	fontDir      = "./fonts"
+	ttfDir       = "ttf"
+	fontManifest = "fonts.json"
+
+	fontStyleRegular = "regular"
+	fontStyleBold    = "bold"
+	fontStyleItalic  = "italic"
+)
+
+// FontFamily describes a TrueType family embedded as a UTF-8 font, so any
+// glyph the font carries can be printed. Built-in families name files under
+// fonts/ttf; organization families name objects in the bucket.
+type FontFamily struct {
+	Family  string `json:"family"`
+	Regular string `json:"regular"`
+	Bold    string `json:"bold,omitempty"`
+	Italic  string `json:"italic,omitempty"`
+}
+
+type FontsRecord struct {
+	Fonts []byte
+}
+
+// coreFonts are the families gofpdf knows without any font files, and
+// jsonFonts the ones generated for it under ./fonts.
+var (
+	coreFonts = []string{"Arial", "Helvetica", "Times", "Courier"}
+	jsonFonts = []struct {
+		family string
+		style  string
+		file   string
+	}{
+		{"Arial Narrow", "", "arial-narrow.json"},
+		{"Arial Narrow", "B", "arial-narrow-bold.json"},
+		{"Yanone Kaffeesatz", "", "YanoneKaffeesatz-Regular.json"},
+		{"Yanone Kaffeesatz", "B", "YanoneKaffeesatz-Bold.json"},
+		{"Yanone Kaffeesatz Light", "", "YanoneKaffeesatz-Light.json"},
+		{"Yanone Kaffeesatz Thin", "", "YanoneKaffeesatz-Thin.json"},
+	}
+)
+
+type textRun struct {
+	family string
+	text   string
+}
+
+func loadFontManifest() (families []FontFamily, err error) {
+	contents, err := ioutil.ReadFile(filepath.Join(fontDir, ttfDir, fontManifest))
+	if os.IsNotExist(err) {
+		return families, nil
+	}
+	if err != nil {
+		return families, err
+	}
+
+	err = json.Unmarshal(contents, &families)
+
+	return families, err
+}
+
+// loadCoreRunes returns the runes the code page map can translate for the
+// built-in fonts. Anything else has to come from a UTF-8 font.
+func loadCoreRunes(mapFile string) (runes map[rune]bool, err error) {
+	runes = make(map[rune]bool)
+
+	f, err := os.Open(mapFile)
+	if err != nil {
+		return runes, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var pos int
+		var r rune
+		var name string
+		_, err := fmt.Sscanf(scanner.Text(), "!%x U+%x %s", &pos, &r, &name)
+		if err == nil && name != ".notdef" {
+			runes[r] = true
+		}
+	}
+
+	return runes, scanner.Err()
+}
+
+func readBuiltinFont(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(fontDir, ttfDir, name))
+}
+
+func readOrgFont(ctx context.Context) func(name string) ([]byte, error) {
+	return func(name string) (contents []byte, err error) {
+		client, bucket, err := defaultBucket(ctx)
+		if err != nil {
+			return contents, err
+		}
+		defer client.Close()
+
+		rc, err := bucket.Object(name).NewReader(ctx)
+		if err != nil {
+			return contents, err
+		}
+		defer rc.Close()
+
+		return ioutil.ReadAll(rc)
+	}
+}
+
+// addUTF8Family registers every style of family with the PDF. Styles the
+// family doesn't have are filled in with the regular face so any role can
+// ask for bold or italic without failing.
+func (dir *PdfDir) addUTF8Family(family FontFamily, read func(name string) ([]byte, error)) (err error) {
+	regular, err := read(family.Regular)
+	if err != nil {
+		return err
+	}
+
+	glyphs, err := sfnt.Parse(regular)
+	if err != nil {
+		return fmt.Errorf("parsing font %s: %s", family.Family, err)
+	}
+
+	bold := regular
+	if family.Bold != "" {
+		bold, err = read(family.Bold)
+		if err != nil {
+			return err
+		}
+	}
+
+	italic := regular
+	if family.Italic != "" {
+		italic, err = read(family.Italic)
+		if err != nil {
+			return err
+		}
+	}
+
+	dir.pdf.AddUTF8FontFromBytes(family.Family, "", regular)
+	dir.pdf.AddUTF8FontFromBytes(family.Family, "B", bold)
+	dir.pdf.AddUTF8FontFromBytes(family.Family, "I", italic)
+	dir.utf8Fonts[family.Family] = glyphs
+
+	return dir.pdf.Error()
+}
+
+func loadOrgFonts(ctx context.Context) (families []FontFamily, err error) {
+	fontsRecord := FontsRecord{}
+	fontsKey := datastore.NewKey(ctx, "Fonts", "", 1, nil)
+	err = datastore.Get(ctx, fontsKey, &fontsRecord)
+	if err == datastore.ErrNoSuchEntity {
+		return families, nil
+	}
+	if err != nil {
+		return families, err
+	}
+
+	if fontsRecord.Fonts != nil {
+		err = json.Unmarshal(fontsRecord.Fonts, &families)
+	}
+
+	return families, err
+}
+
+func saveOrgFonts(ctx context.Context, families []FontFamily) (err error) {
+	fontsBytes, err := json.Marshal(families)
+	if err != nil {
+		return err
+	}
+
+	fontsKey := datastore.NewKey(ctx, "Fonts", "", 1, nil)
+	_, err = datastore.Put(ctx, fontsKey, &FontsRecord{Fonts: fontsBytes})
+
+	return err
+}
+
+// availableFonts lists every family a config can name: the core and
+// generated fonts, the built-in UTF-8 families and the organization's own
+// that have a regular style, since the others can't be printed.
+func availableFonts(ctx context.Context) (families []string, err error) {
+	families = append(families, coreFonts...)
+
+	for _, f := range jsonFonts {
+		if f.style == "" {
+			families = append(families, f.family)
+		}
+	}
+
+	builtin, err := loadFontManifest()
+	if err != nil {
+		return families, err
+	}
+	for _, f := range builtin {
+		families = append(families, f.Family)
+	}
+
+	org, err := loadOrgFonts(ctx)
+	if err != nil {
+		return families, err
+	}
+	for _, f := range org {
+		if f.Regular != "" {
+			families = append(families, f.Family)
+		}
+	}
+
+	return families, err
+}
+
+// storeOrgFont validates an uploaded font and saves it as one style of an
+// organization family, creating the family if needed.
+func storeOrgFont(ctx context.Context, domain string, familyName string, style string, contents []byte) (family FontFamily, err error) {
+	if familyName == "" || len(familyName) > 64 {
+		return family, fmt.Errorf("font family must be between 1 and 64 characters")
+	}
+
+	if style != fontStyleRegular && style != fontStyleBold && style != fontStyleItalic {
+		return family, fmt.Errorf("font style must be %s, %s or %s", fontStyleRegular, fontStyleBold, fontStyleItalic)
+	}
+
+	// OpenType fonts with CFF outlines start with "OTTO"; the PDF writer can
+	// only embed TrueType outlines.
+	if bytes.HasPrefix(contents, []byte("OTTO")) {
+		return family, fmt.Errorf("%s uses PostScript outlines; upload a TrueType (.ttf) version", familyName)
+	}
+
+	if _, err := sfnt.Parse(contents); err != nil {
+		return family, fmt.Errorf("%s is not a TrueType or OpenType font: %s", familyName, err)
+	}
+
+	known, err := availableFonts(ctx)
+	if err != nil {
+		return family, err
+	}
+
+	families, err := loadOrgFonts(ctx)
+	if err != nil {
+		return family, err
+	}
+
+	index := -1
+	for i, f := range families {
+		if strings.EqualFold(f.Family, familyName) {
+			index = i
+		}
+	}
+
+	if index < 0 {
+		for _, name := range known {
+			if strings.EqualFold(name, familyName) {
+				return family, fmt.Errorf("%s is a built-in font family", familyName)
+			}
+		}
+
+		families = append(families, FontFamily{Family: familyName})
+		index = len(families) - 1
+	}
+
+	objectName := fmt.Sprintf("%s/fonts/%s/%s.ttf", domain, url.PathEscape(families[index].Family), style)
+
+	client, bucket, err := defaultBucket(ctx)
+	if err != nil {
+		return family, err
+	}
+	defer client.Close()
+
+	wc := bucket.Object(objectName).NewWriter(ctx)
+	wc.ContentType = "font/ttf"
+	_, err = wc.Write(contents)
+	if err != nil {
+		wc.Close()
+		return family, err
+	}
+
+	err = wc.Close()
+	if err != nil {
+		return family, err
+	}
+
+	switch style {
+	case fontStyleRegular:
+		families[index].Regular = objectName
+	case fontStyleBold:
+		families[index].Bold = objectName
+	case fontStyleItalic:
+		families[index].Italic = objectName
+	}
+
+	err = saveOrgFonts(ctx, families)
+
+	return families[index], err
+}
+
+// deleteOrgFont removes an organization family, whatever its case, and its
+// files. It answers datastore.ErrNoSuchEntity when there's no such family.
+func deleteOrgFont(ctx context.Context, familyName string) (err error) {
+	families, err := loadOrgFonts(ctx)
+	if err != nil {
+		return err
+	}
+
+	client, bucket, err := defaultBucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	remaining := []FontFamily{}
+	for _, f := range families {
+		if !strings.EqualFold(f.Family, familyName) {
+			remaining = append(remaining, f)
+			continue
+		}
+
+		for _, objectName := range []string{f.Regular, f.Bold, f.Italic} {
+			if objectName != "" {
+				bucket.Object(objectName).Delete(ctx)
+			}
+		}
+	}
+
+	if len(remaining) == len(families) {
+		return datastore.ErrNoSuchEntity
+	}
+
+	return saveOrgFonts(ctx, remaining)
+}
+
+func fontOrDefault(family string, defaultFamily string) string {
+	if family == "" {
+		return defaultFamily
+	}
+
+	return family
+}
+
+func (dir *PdfDir) hasGlyph(family string, r rune) bool {
+	if glyphs, ok := dir.utf8Fonts[family]; ok {
+		index, err := glyphs.GlyphIndex(&dir.sfntBuffer, r)
+		return err == nil && index != 0
+	}
+
+	return dir.coreRunes[r]
+}
+
+// textRuns splits str into pieces that can each be printed with a single
+// font, falling back to the first fallback family that has the glyph. Runes
+// no family can print stay with the current family and are logged once.
+func (dir *PdfDir) textRuns(str string) (runs []textRun) {
+	for _, r := range str {
+		family := dir.currentFamily
+
+		if r != ' ' && !dir.hasGlyph(family, r) {
+			found := false
+			for _, fallback := range dir.fallbackFonts {
+				if dir.hasGlyph(fallback, r) {
+					family = fallback
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				dir.missingGlyphs[r] = true
+			}
+		}
+
+		if len(runs) > 0 && runs[len(runs)-1].family == family {
+			runs[len(runs)-1].text += string(r)
+		} else {
+			runs = append(runs, textRun{family: family, text: string(r)})
+		}
+	}
+
+	return runs
+}
+
+func (dir *PdfDir) encode(family string, str string) string {
+	if _, ok := dir.utf8Fonts[family]; ok {
+		return str
+	}
+
+	return dir.translate(str)
+}
+
+func (dir *PdfDir) setFont(family string, style string, size float64) {
+	dir.currentFamily = family
+	dir.currentStyle = style
+	dir.pdf.SetFont(family, style, size)
+}
+
+func (dir *PdfDir) useRunFont(family string) {
+	size, _ := dir.pdf.GetFontSize()
+	dir.pdf.SetFont(family, dir.currentStyle, size)
+}
+
+func (dir *PdfDir) stringWidth(str string) (width float64) {
+	for _, run := range dir.textRuns(str) {
+		dir.useRunFont(run.family)
+		width += dir.pdf.GetStringWidth(dir.encode(run.family, run.text))
+	}
+	dir.useRunFont(dir.currentFamily)
+
+	return width
+}
+
+// cell is CellFormat for text that may need more than one font. Alignment
+// and the ln behaviour match CellFormat.
+func (dir *PdfDir) cell(width float64, height float64, str string, border string, ln int, alignment string, fill bool) {
+	runs := dir.textRuns(str)
+	if len(runs) < 2 {
+		dir.pdf.CellFormat(width, height, dir.encode(dir.currentFamily, str), border, ln, alignment, fill, 0, "")
+		return
+	}
+
+	x, y := dir.pdf.GetXY()
+	dir.pdf.CellFormat(width, height, "", border, 0, "", fill, 0, "")
+
+	vertical := strings.Trim(alignment, "LCR")
+
+	textWidth := dir.stringWidth(str)
+	textX := x
+	if strings.Contains(alignment, "R") {
+		textX = x + width - textWidth
+	} else if strings.Contains(alignment, "C") {
+		textX = x + (width-textWidth)/2
+	}
+
+	dir.pdf.SetXY(textX, y)
+	for _, run := range runs {
+		dir.useRunFont(run.family)
+		text := dir.encode(run.family, run.text)
+		dir.pdf.CellFormat(dir.pdf.GetStringWidth(text), height, text, "", 0, "L"+vertical, false, 0, "")
+	}
+	dir.useRunFont(dir.currentFamily)
+
+	switch ln {
+	case 1:
+		left, _, _, _ := dir.pdf.GetMargins()
+		dir.pdf.SetXY(left, y+height)
+	case 2:
+		dir.pdf.SetXY(x, y+height)
+	default:
+		dir.pdf.SetXY(x+width, y)
+	}
+}
+
+// write is Write for text that may need more than one font.
+func (dir *PdfDir) write(height float64, str string) {
+	for _, run := range dir.textRuns(str) {
+		dir.useRunFont(run.family)
+		dir.pdf.Write(height, dir.encode(run.family, run.text))
+	}
+	dir.useRunFont(dir.currentFamily)
+}
@@ -0,0 +1,122 @@
+package pc_pdf_generator
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"mime/multipart"
+	"path"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+
+	"golang.org/x/net/context"
+)
+
+const maxHouseholdPhotoSize = 64 << 20
+
+var householdIdPattern = regexp.MustCompile(`^[0-9]+$`)
+
+// PhotoUploadResult reports what happened to one file of a bulk upload.
+type PhotoUploadResult struct {
+	File        string `json:"file"`
+	HouseholdId string `json:"household_id"`
+	Error       string `json:"error,omitempty"`
+}
+
+func uploadedHouseholdPhoto(domain string, householdId string) string {
+	return fmt.Sprintf("%s/jpgs/households/%s-upload", domain, householdId)
+}
+
+// householdIdFromFile takes the household ID from an upload's file name,
+// so "12345.jpg" is stored as the photo for household 12345.
+func householdIdFromFile(fileName string) (householdId string, err error) {
+	base := path.Base(strings.Replace(fileName, "\\", "/", -1))
+	householdId = strings.TrimSuffix(base, path.Ext(base))
+
+	if !householdIdPattern.MatchString(householdId) {
+		return householdId, fmt.Errorf("%s: file name must be a household ID, like 12345.jpg", fileName)
+	}
+
+	return householdId, nil
+}
+
+// storeHouseholdPhoto stores an uploaded family photo where the downloader
+// looks before falling back to Planning Center's household avatar.
+func storeHouseholdPhoto(ctx context.Context, domain string, householdId string, contents []byte) (err error) {
+	return storePhoto(ctx, domain, uploadedHouseholdPhoto(domain, householdId), contents)
+}
+
+// storePhoto re-encodes an uploaded photo as an upright JPEG and stores it
+// as objectName, dropping thumbnails made from the photo it replaces.
+func storePhoto(ctx context.Context, domain string, objectName string, contents []byte) (err error) {
+	input, _, err := image.Decode(bytes.NewReader(contents))
+	if err != nil {
+		return fmt.Errorf("not a JPEG or PNG image: %s", err)
+	}
+	input = applyOrientation(input, exifOrientation(contents))
+
+	client, bucket, err := defaultBucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	wc := bucket.Object(objectName).NewWriter(ctx)
+	wc.ContentType = "image/jpeg"
+
+	err = jpeg.Encode(wc, input, &jpeg.Options{Quality: 90})
+	if err != nil {
+		wc.Close()
+		return err
+	}
+
+	err = wc.Close()
+	if err != nil {
+		return err
+	}
+
+	return deleteThumbnails(ctx, bucket, domain, objectName)
+}
+
+func storeHouseholdPhotoUpload(ctx context.Context, domain string, header *multipart.FileHeader) (householdId string, err error) {
+	householdId, err = householdIdFromFile(header.Filename)
+	if err != nil {
+		return householdId, err
+	}
+
+	upload, err := header.Open()
+	if err != nil {
+		return householdId, err
+	}
+	defer upload.Close()
+
+	contents, err := ioutil.ReadAll(upload)
+	if err != nil {
+		return householdId, err
+	}
+
+	return householdId, storeHouseholdPhoto(ctx, domain, householdId, contents)
+}
+
+func deleteHouseholdPhoto(ctx context.Context, domain string, householdId string) (err error) {
+	return deletePhoto(ctx, domain, uploadedHouseholdPhoto(domain, householdId))
+}
+
+func deletePhoto(ctx context.Context, domain string, objectName string) (err error) {
+	client, bucket, err := defaultBucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	err = bucket.Object(objectName).Delete(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+
+	return deleteThumbnails(ctx, bucket, domain, objectName)
+}
@@ -0,0 +1,243 @@
+package pc_pdf_generator
+
+import (
+	"math"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	layoutFixed = "fixed"
+	layoutFlow  = "flow"
+)
+
+// householdEntry is one person of a household as writeSection will print
+// them, with the photo already chosen.
+type householdEntry struct {
+	person      *Person
+	image       string
+	placeholder bool
+	head        bool
+}
+
+// householdEntries picks the people of a household that the section prints
+// and their photos. With a family photo, the household's first printed entry
+// carries it and the rest print without a picture.
+func (dir *PdfDir) householdEntries(bucket *storage.BucketHandle, h Household, displayOptions Section) (entries []householdEntry) {
+	familyPhoto := ""
+	if displayOptions.HouseholdPhoto {
+		familyPhoto = dir.householdImage(bucket, dir.thumbnail, h)
+	}
+	sharedPhoto := familyPhoto != ""
+
+	people := h.Members
+	if h.Head != nil {
+		people = append([]*Person{h.Head}, h.Members...)
+	}
+
+peopleLoop:
+	for _, p := range people {
+		if !dir.getSectionOverride(p, displayOptions).Show {
+			continue peopleLoop
+		}
+
+		head := p == h.Head
+		if !head && cap(displayOptions.ExcludeDirSections) > 0 {
+			for _, exclude := range displayOptions.ExcludeDirSections {
+				if _, ok := p.DirectorySections[exclude]; ok {
+					continue peopleLoop
+				}
+			}
+		}
+
+		image := familyPhoto
+		if !sharedPhoto {
+			image = dir.entryImage(bucket, p)
+		}
+		familyPhoto = ""
+
+		entries = append(entries, householdEntry{person: p, image: image, placeholder: !sharedPhoto, head: head})
+	}
+
+	return entries
+}
+
+// householdHeight is the space the entries need in a column, padding
+// included.
+func (dir *PdfDir) householdHeight(entries []householdEntry, displayOptions Section) (height float64) {
+	for _, entry := range entries {
+		options := dir.getSectionOverride(entry.person, displayOptions)
+		lines := dir.entryLines(*entry.person, options)
+		height += dir.entryHeight(lines, entry.image != "" || entry.placeholder) + dir.padding
+	}
+
+	return height
+}
+
+// columnSpace returns the top and bottom of the usable part of a column.
+// Columns on a section's first page start below its header, and the legend
+// takes a line per row at the bottom.
+func (dir *PdfDir) columnSpace(firstPage bool, displayOptions Section) (top float64, bottom float64) {
+	_, top, _, bottom = dir.pdf.GetMargins()
+	_, height := dir.pdf.GetPageSize()
+	bottom = height - bottom
+
+	if len(dir.legend) > 0 {
+		_, lineHeight := dir.pdf.GetFontSize()
+		bottom -= float64(len(dir.legend)) * lineHeight
+	}
+
+	if firstPage {
+		top += ((dir.fontSize + 2.0) / dir.pdf.GetConversionRatio()) * 2.0
+	}
+
+	return top, bottom
+}
+
+// placeEntry moves to the top of the next column, or the next page, when
+// something entryHeight tall doesn't fit below the current position.
+func (dir *PdfDir) placeEntry(entryHeight float64, lastColumn float64, indentPage bool, displayOptions Section) (column float64, firstPage bool) {
+	column, firstPage = lastColumn, indentPage
+
+	top, bottom := dir.columnSpace(firstPage, displayOptions)
+
+	if dir.pdf.GetY()+entryHeight+dir.padding > bottom {
+		column++
+
+		dir.pdf.SetY(top)
+	}
+
+	if column >= dir.colNum {
+		column = 0
+
+		_, pageHeight := dir.pdf.GetPageSize()
+		_, _, _, bottomMargin := dir.pdf.GetMargins()
+		dir.pdf.SetY(pageHeight - bottomMargin)
+
+		dir.writeFooter(displayOptions)
+
+		_, topMargin, _, _ := dir.pdf.GetMargins()
+		dir.addPage()
+		dir.pdf.SetY(topMargin)
+		firstPage = false
+	}
+
+	return column, firstPage
+}
+
+// keepTogether moves to a fresh column before a household that would
+// otherwise be split, unless it's too tall for any column.
+func (dir *PdfDir) keepTogether(householdHeight float64, lastColumn float64, indentPage bool, displayOptions Section) (column float64, firstPage bool) {
+	top, bottom := dir.columnSpace(indentPage, displayOptions)
+	if householdHeight > bottom-top {
+		return lastColumn, indentPage
+	}
+
+	return dir.placeEntry(householdHeight-dir.padding, lastColumn, indentPage, displayOptions)
+}
+
+// entryHeight is ColumnHeight in the fixed layout. In the flow layout it's
+// the height of the wrapped lines, but never shorter than the photo.
+func (dir *PdfDir) entryHeight(lines []string, hasPhoto bool) float64 {
+	if dir.layoutMode != layoutFlow {
+		return dir.columnHeight
+	}
+
+	count := 0
+	for i, line := range lines {
+		dir.setEntryFont(i)
+		count += len(dir.wrapText(dir.textWidth, line))
+	}
+	dir.setEntryFont(1)
+
+	height := float64(count) * dir.lineHeight
+	if hasPhoto && height < dir.columnHeight {
+		height = dir.columnHeight
+	}
+
+	return height
+}
+
+// setEntryFont sets the font of an entry's line: the name, then details.
+func (dir *PdfDir) setEntryFont(line int) {
+	if line == 0 {
+		dir.setFont(dir.nameFontFamily, "B", dir.fontSize)
+	} else {
+		dir.setFont(dir.bodyFontFamily, "", dir.fontSize)
+	}
+}
+
+// writeEntryLines writes an entry's text beside its photo. Lines too long
+// for the column wrap in the flow layout and shrink in the fixed one. With
+// a theme link color, the email line prints in it and links to the address.
+func (dir *PdfDir) writeEntryLines(lines []string, email string) {
+	for i, line := range lines {
+		dir.setEntryFont(i)
+
+		link := dir.style.linkEmails && email != "" && i > 0 && line == email
+		if link {
+			dir.setTextColor(dir.style.link)
+		}
+		x, y := dir.pdf.GetXY()
+
+		if dir.layoutMode != layoutFlow {
+			dir.shrinkedCell(dir.textWidth, dir.lineHeight, line, "", "L", false)
+		} else {
+			for _, part := range dir.wrapText(dir.textWidth, line) {
+				dir.cell(dir.textWidth, dir.lineHeight, part, "", 1, "L", false)
+			}
+		}
+
+		if link {
+			dir.pdf.LinkString(x, y, math.Min(dir.stringWidth(line), dir.textWidth), dir.pdf.GetY()-y, "mailto:"+email)
+			dir.setTextColor(dir.style.text)
+		}
+	}
+
+	dir.setEntryFont(1)
+}
+
+// wrapText splits str into lines that fit width, breaking between words,
+// or inside a word too long for a line of its own.
+func (dir *PdfDir) wrapText(width float64, str string) (lines []string) {
+	width -= dir.pdf.GetCellMargin()
+	if width <= 0 {
+		return []string{str}
+	}
+
+	line := ""
+	for _, word := range strings.Fields(str) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+
+		if dir.stringWidth(candidate) <= width {
+			line = candidate
+			continue
+		}
+
+		if line != "" {
+			lines = append(lines, line)
+		}
+
+		for len([]rune(word)) > 1 && dir.stringWidth(word) > width {
+			runes := []rune(word)
+			n := len(runes) - 1
+			for n > 1 && dir.stringWidth(string(runes[:n])) > width {
+				n--
+			}
+
+			lines = append(lines, string(runes[:n]))
+			word = string(runes[n:])
+		}
+		line = word
+	}
+
+	if line != "" || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
@@ -0,0 +1,155 @@
+package pc_pdf_generator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+const localeDir = "locales"
+
+// catalog holds the printed labels and date layouts of a locale. Layouts
+// are Go time layouts; "Jan" and "January" in them print the catalog's
+// short and long month names.
+// Locales are JSON files in localeDir named by language tag, and any key a
+// file leaves out is taken from English.
+type catalog struct {
+	Messages   map[string]string `json:"messages"`
+	Dates      map[string]string `json:"dates"`
+	Months     []string          `json:"months"`
+	LongMonths []string          `json:"long_months"`
+
+	printer *message.Printer
+}
+
+func readCatalog(name string) (cat catalog, err error) {
+	contents, err := ioutil.ReadFile(filepath.Join(localeDir, name+".json"))
+	if err != nil {
+		return cat, err
+	}
+
+	err = json.Unmarshal(contents, &cat)
+
+	return cat, err
+}
+
+// loadCatalog reads the catalog for locale over the English one, trying the
+// full tag first and then its base language, so es-MX can use es.json.
+func loadCatalog(locale string) (cat *catalog, err error) {
+	english, err := readCatalog(defaultLocale)
+	if err != nil {
+		return cat, err
+	}
+	cat = &english
+
+	tag, err := language.Parse(locale)
+	if err != nil {
+		tag = language.Make(defaultLocale)
+	}
+	base, _ := tag.Base()
+
+	for _, name := range []string{tag.String(), base.String()} {
+		if name == defaultLocale {
+			break
+		}
+
+		localized, err := readCatalog(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return cat, err
+		}
+
+		for k, v := range localized.Messages {
+			cat.Messages[k] = v
+		}
+		for k, v := range localized.Dates {
+			cat.Dates[k] = v
+		}
+		if len(localized.Months) == 12 {
+			cat.Months = localized.Months
+		}
+		if len(localized.LongMonths) == 12 {
+			cat.LongMonths = localized.LongMonths
+		}
+		break
+	}
+
+	cat.printer = message.NewPrinter(tag)
+
+	return cat, nil
+}
+
+// text formats the catalog message key, with numbers grouped the way the
+// locale writes them. Unknown keys print as themselves.
+func (cat *catalog) text(key string, args ...interface{}) string {
+	format, ok := cat.Messages[key]
+	if !ok {
+		format = key
+	}
+
+	return cat.printer.Sprintf(format, args...)
+}
+
+// date formats t with the catalog's layout for key.
+func (cat *catalog) date(t time.Time, key string) string {
+	layout, ok := cat.Dates[key]
+	if !ok {
+		layout = key
+	}
+
+	// The month names are printed from the catalog and only the text
+	// between them goes through Format, so a name can't be mistaken for
+	// part of the layout.
+	formatted := ""
+	for {
+		start, end, long := monthToken(layout)
+		if start < 0 {
+			return formatted + t.Format(layout)
+		}
+
+		formatted += t.Format(layout[:start]) + cat.month(t.Month(), long)
+		layout = layout[end:]
+	}
+}
+
+// month is the catalog's name for m, or Go's when the catalog has none.
+func (cat *catalog) month(m time.Month, long bool) string {
+	if long {
+		if len(cat.LongMonths) == 12 {
+			return cat.LongMonths[m-1]
+		}
+		return m.String()
+	}
+
+	if len(cat.Months) == 12 {
+		return cat.Months[m-1]
+	}
+	return m.String()[:3]
+}
+
+// monthToken finds the first month name in a Go layout, the way Format
+// reads one: "January", or "Jan" not followed by a lower case letter.
+// start is -1 when there is none.
+func monthToken(layout string) (start int, end int, long bool) {
+	for i := 0; i+3 <= len(layout); i++ {
+		if layout[i:i+3] != "Jan" {
+			continue
+		}
+		if strings.HasPrefix(layout[i:], "January") {
+			return i, i + 7, true
+		}
+		if i+3 == len(layout) || layout[i+3] < 'a' || layout[i+3] > 'z' {
+			return i, i + 3, false
+		}
+	}
+
+	return -1, -1, false
+}
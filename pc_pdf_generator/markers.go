@@ -0,0 +1,238 @@
+package pc_pdf_generator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	conditionEmpty      = "empty"
+	conditionNotEmpty   = "not_empty"
+	conditionEquals     = "equals"
+	conditionContains   = "contains"
+	conditionWithinDays = "within_days"
+	conditionOlderThan  = "older_than_days"
+	conditionTag        = "tag"
+
+	// tagsField is the Planning Center custom field, usually checkboxes,
+	// whose options the tag condition matches.
+	tagsField = "Tags"
+
+	legendGap = 6.0
+)
+
+// MarkerRule prints Symbol after the name of everyone matching its
+// condition, and explains it with Legend in the footer. Field is one of the
+// mapped person fields below or the name of a Planning Center custom field.
+// Date conditions compare against today; tag matches an option checked in
+// the Tags custom field.
+type MarkerRule struct {
+	Field     string `json:"field"`
+	Condition string `json:"condition"`
+	Value     string `json:"value"`
+	Symbol    string `json:"symbol"`
+	Legend    string `json:"legend"`
+}
+
+// legacyMarkerRules are the new member and pending baptism footnotes the
+// directory has always printed. They're used when Config has no rules, in
+// sections with the matching footnote checked.
+func (dir *PdfDir) legacyMarkerRules(displayOptions Section) (rules []MarkerRule) {
+	if displayOptions.BaptismFootnote {
+		rules = append(rules, MarkerRule{Field: "Baptism Date", Condition: conditionEmpty, Symbol: "§", Legend: dir.catalog.text("pending_baptism")})
+	}
+
+	if displayOptions.NewMemberFootnote {
+		rules = append(rules, MarkerRule{Field: "date_joined", Condition: conditionWithinDays, Value: "91", Symbol: "*", Legend: dir.catalog.text("new_member")})
+	}
+
+	return rules
+}
+
+// markerRules are the rules the section applies.
+func (dir *PdfDir) markerRules(displayOptions Section) []MarkerRule {
+	if len(dir.rules) == 0 {
+		return dir.legacyMarkerRules(displayOptions)
+	}
+
+	if !displayOptions.Markers {
+		return nil
+	}
+
+	return dir.rules
+}
+
+// personField returns the value of a mapped field or custom field.
+func personField(p *Person, field string) string {
+	switch field {
+	case "first_name":
+		return p.FirstName
+	case "last_name":
+		return p.LastName
+	case "email":
+		return p.EmailAddress
+	case "address":
+		return strings.TrimSpace(p.Address1 + " " + p.Address2)
+	case "city":
+		return p.City
+	case "state":
+		return p.State
+	case "postal_code":
+		return p.PostalCode
+	case "occupation":
+		return p.Occupation
+	case "school":
+		return p.School
+	case "employer":
+		return p.Employer
+	case "title":
+		return p.Title
+	case "cell_phone":
+		return phoneField(p.CellPhone)
+	case "home_phone":
+		return phoneField(p.HomePhone)
+	case "work_phone":
+		return phoneField(p.WorkPhone)
+	case "married":
+		if p.Married {
+			return "true"
+		}
+		return ""
+	case "birthday":
+		return dateField(p.Birthday)
+	case "date_joined":
+		return dateField(p.DateJoined)
+	}
+
+	return p.Fields[field]
+}
+
+func phoneField(phone int64) string {
+	if phone == 0 {
+		return ""
+	}
+
+	return strconv.FormatInt(phone, 10)
+}
+
+func dateField(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(timeFormat)
+}
+
+// parseFieldDate reads dates as Planning Center writes them in people
+// records and in custom fields.
+func parseFieldDate(value string) (t time.Time, err error) {
+	t, err = time.Parse(timeFormat, value)
+	if err != nil {
+		t, err = time.Parse(timeFormat2, value)
+	}
+
+	return t, err
+}
+
+// matches reports whether the rule's condition holds for the person.
+func (rule MarkerRule) matches(p *Person, now time.Time) bool {
+	if rule.Condition == conditionTag {
+		return p.Tags[strings.ToLower(strings.TrimSpace(rule.Value))]
+	}
+
+	value := strings.TrimSpace(personField(p, rule.Field))
+
+	switch rule.Condition {
+	case conditionEmpty:
+		return value == ""
+	case conditionNotEmpty:
+		return value != ""
+	case conditionEquals:
+		return strings.EqualFold(value, rule.Value)
+	case conditionContains:
+		return strings.Contains(strings.ToLower(value), strings.ToLower(rule.Value))
+	case conditionWithinDays, conditionOlderThan:
+		t, err := parseFieldDate(value)
+		if err != nil {
+			return false
+		}
+		days, err := strconv.ParseFloat(rule.Value, 64)
+		if err != nil {
+			return false
+		}
+
+		age := now.Sub(t).Hours() / 24
+		if rule.Condition == conditionWithinDays {
+			return age < days
+		}
+		return age > days
+	}
+
+	return false
+}
+
+// markers returns the symbols of every rule the person matches, in rule
+// order.
+func (dir *PdfDir) markers(p *Person, displayOptions Section) (symbols string) {
+	now := time.Now()
+	for _, rule := range dir.markerRules(displayOptions) {
+		if rule.matches(p, now) {
+			symbols += rule.Symbol
+		}
+	}
+
+	return symbols
+}
+
+// setLegend lays out the footer legend of a section: one "symbol text" item
+// per rule that matches someone the section prints, in rows as wide as the
+// page. It must be called with the body font set.
+func (dir *PdfDir) setLegend(entries map[string]Household, displayOptions Section) {
+	dir.legend = nil
+
+	now := time.Now()
+	used := func(rule MarkerRule) bool {
+		for _, h := range entries {
+			people := h.Members
+			if h.Head != nil {
+				people = append([]*Person{h.Head}, h.Members...)
+			}
+			for _, p := range people {
+				if rule.matches(p, now) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	left, right := dir.pageMargins()
+	width, _ := dir.pdf.GetPageSize()
+	available := width - left - right
+
+	var row []string
+	rowWidth := 0.0
+	for _, rule := range dir.markerRules(displayOptions) {
+		if !used(rule) {
+			continue
+		}
+
+		item := strings.TrimSpace(fmt.Sprintf("%s %s", rule.Symbol, rule.Legend))
+		itemWidth := dir.stringWidth(item)
+		if len(row) > 0 && rowWidth+legendGap+itemWidth > available {
+			dir.legend = append(dir.legend, row)
+			row, rowWidth = nil, 0
+		}
+		if len(row) > 0 {
+			rowWidth += legendGap
+		}
+		row = append(row, item)
+		rowWidth += itemWidth
+	}
+
+	if len(row) > 0 {
+		dir.legend = append(dir.legend, row)
+	}
+}
@@ -0,0 +1,462 @@
+package pc_pdf_generator
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	textColumnSuffix = "_text"
+	deleteColumn     = "delete"
+	updatedColumn    = "updated"
+
+	// formulaStart are the characters that start a formula in a
+	// spreadsheet.
+	formulaStart = "=+-@"
+)
+
+// OverridePatch changes part of one person's override. Anything nil is left
+// alone, and a field whose mode and text both end up blank goes back to what
+// the section says. Updated is the time of the override the client last
+// saw; the patch is refused when it has changed since.
+type OverridePatch struct {
+	PersonId   string                `json:"person_id"`
+	Delete     bool                  `json:"delete"`
+	Name       *string               `json:"name"`
+	FamilyName *string               `json:"family_name"`
+	Fields     map[string]FieldPatch `json:"fields"`
+	Updated    *time.Time            `json:"updated"`
+}
+
+type FieldPatch struct {
+	Mode *string `json:"mode"`
+	Text *string `json:"text"`
+}
+
+// OverrideError is a problem with one patch: a CSV row, counting the header
+// as row 1, or the position in a JSON list, from 1.
+type OverrideError struct {
+	Row      int    `json:"row"`
+	PersonId string `json:"person_id,omitempty"`
+	Field    string `json:"field,omitempty"`
+	Message  string `json:"message"`
+}
+
+// OverrideEditResult is what an edit did, with the overrides it saved, or
+// why it did nothing.
+type OverrideEditResult struct {
+	Updated   int                 `json:"updated"`
+	Deleted   int                 `json:"deleted"`
+	Overrides map[string]Override `json:"overrides,omitempty"`
+	Errors    []OverrideError     `json:"errors,omitempty"`
+}
+
+func findOverrideField(name string) (overrideField, bool) {
+	for _, field := range overrideFields {
+		if field.name == name {
+			return field, true
+		}
+	}
+
+	return overrideField{}, false
+}
+
+// replacePatch is the patch that makes a person's override exactly
+// override, clearing every field it doesn't set.
+func replacePatch(override Override, updated *time.Time) OverridePatch {
+	patch := OverridePatch{
+		PersonId:   override.PersonId,
+		Name:       &override.Name,
+		FamilyName: &override.FamilyName,
+		Fields:     make(map[string]FieldPatch),
+		Updated:    updated,
+	}
+
+	for _, field := range overrideFields {
+		value := override.Fields[field.name]
+		patch.Fields[field.name] = FieldPatch{Mode: &value.Mode, Text: &value.Text}
+	}
+	for name, field := range override.Fields {
+		value := field
+		patch.Fields[name] = FieldPatch{Mode: &value.Mode, Text: &value.Text}
+	}
+
+	return patch
+}
+
+// validate checks the patch on its own, before anything is loaded.
+func (patch OverridePatch) validate(row int) (errs []OverrideError) {
+	if patch.PersonId == "" {
+		errs = append(errs, OverrideError{Row: row, Field: "person_id", Message: "person_id is required"})
+	}
+	for _, r := range patch.PersonId {
+		if r < '0' || r > '9' {
+			errs = append(errs, OverrideError{Row: row, PersonId: patch.PersonId, Field: "person_id", Message: "person_id must be a Planning Center person ID"})
+			break
+		}
+	}
+
+	for name, value := range patch.Fields {
+		field, ok := findOverrideField(name)
+		if !ok {
+			errs = append(errs, OverrideError{Row: row, PersonId: patch.PersonId, Field: name, Message: "unknown field"})
+			continue
+		}
+
+		mode, text := "", ""
+		if value.Mode != nil {
+			mode = *value.Mode
+		}
+		if value.Text != nil {
+			text = *value.Text
+		}
+
+		switch {
+		case mode != "" && mode != overrideShow && mode != overrideHide:
+			errs = append(errs, OverrideError{Row: row, PersonId: patch.PersonId, Field: name, Message: fmt.Sprintf("%q isn't show, hide or blank", mode)})
+		case mode != "" && field.option == nil && field.flag == nil:
+			errs = append(errs, OverrideError{Row: row, PersonId: patch.PersonId, Field: name, Message: "can't be shown or hidden"})
+		}
+		if text != "" && field.text == nil {
+			errs = append(errs, OverrideError{Row: row, PersonId: patch.PersonId, Field: name, Message: "has no replacement text"})
+		}
+	}
+
+	return errs
+}
+
+// apply returns before with the patch merged in.
+func (patch OverridePatch) apply(before Override) Override {
+	after := before
+	after.PersonId = patch.PersonId
+	after.LegacyKey = ""
+	if patch.Name != nil {
+		after.Name = *patch.Name
+	}
+	if patch.FamilyName != nil {
+		after.FamilyName = *patch.FamilyName
+	}
+
+	after.Fields = make(map[string]FieldOverride, len(before.Fields))
+	for name, field := range before.Fields {
+		after.Fields[name] = field
+	}
+	for name, value := range patch.Fields {
+		field := after.Fields[name]
+		// Whoever changes the mode owns it from then on.
+		if value.Mode != nil && *value.Mode != field.Mode {
+			field.Mode = *value.Mode
+			field.Source = ""
+		}
+		if value.Text != nil {
+			field.Text = *value.Text
+		}
+
+		if field.Mode == "" && field.Text == "" {
+			delete(after.Fields, name)
+			continue
+		}
+		after.Fields[name] = field
+	}
+
+	return after
+}
+
+// validatePatches checks each patch, and that no two are for the same
+// person.
+func validatePatches(patches []OverridePatch, rows []int) (errs []OverrideError) {
+	seen := make(map[string]int)
+	for i, patch := range patches {
+		errs = append(errs, patch.validate(rows[i])...)
+		if first, ok := seen[patch.PersonId]; ok && patch.PersonId != "" {
+			errs = append(errs, OverrideError{Row: rows[i], PersonId: patch.PersonId, Message: fmt.Sprintf("same person as row %d", first)})
+		}
+		seen[patch.PersonId] = rows[i]
+	}
+
+	return errs
+}
+
+// applyOverridePatches validates the patches and, only if every one is
+// good, applies them all in one transaction, so concurrent editors of
+// different people never overwrite each other. revision says who made the
+// edit and how, and is saved with them. When a patch is refused because its
+// override changed since it was loaded, nothing is saved and err is
+// errOverridesChanged.
+func applyOverridePatches(ctx context.Context, patches []OverridePatch, rows []int, revision OverridesRevision) (result OverrideEditResult, err error) {
+	result.Errors = validatePatches(patches, rows)
+	if len(result.Errors) > 0 {
+		return result, nil
+	}
+
+	now := time.Now()
+	by := revision.Author
+	var changes []OverrideChange
+
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) (err error) {
+		result = OverrideEditResult{Overrides: make(map[string]Override)}
+		changes = nil
+
+		overrides, err := loadOverrides(tc)
+		if err != nil {
+			return err
+		}
+
+		for i, patch := range patches {
+			before, exists := overrides.People[patch.PersonId]
+			if patch.Updated != nil && patch.Updated.IsZero() && exists {
+				result.Errors = append(result.Errors, OverrideError{Row: rows[i], PersonId: patch.PersonId, Message: "already has an override; load it again to change it"})
+				continue
+			}
+			if patch.Updated != nil && before.Updated.After(*patch.Updated) {
+				result.Errors = append(result.Errors, OverrideError{Row: rows[i], PersonId: patch.PersonId, Message: fmt.Sprintf("changed by %s at %s since it was loaded", before.UpdatedBy, before.Updated.Format(time.RFC3339))})
+				continue
+			}
+
+			if patch.Delete {
+				if exists {
+					changes = append(changes, overrideChanges(before, Override{PersonId: patch.PersonId}, by, changeByStaff, now)...)
+					delete(overrides.People, patch.PersonId)
+					result.Deleted++
+				}
+				continue
+			}
+
+			after := patch.apply(before)
+			c := overrideChanges(before, after, by, changeByStaff, now)
+			if len(c) == 0 && exists && before.Name == after.Name {
+				result.Overrides[patch.PersonId] = before
+				continue
+			}
+
+			after.Updated = now
+			after.UpdatedBy = by
+			overrides.People[patch.PersonId] = after
+			result.Overrides[patch.PersonId] = after
+			changes = append(changes, c...)
+			result.Updated++
+		}
+
+		if len(result.Errors) > 0 {
+			return errOverridesChanged
+		}
+
+		err = saveOverrides(tc, overrides, revision)
+		if err != nil {
+			return err
+		}
+
+		return saveOverrideChanges(tc, changes)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		result.Updated, result.Deleted, result.Overrides = 0, 0, nil
+	}
+
+	return result, err
+}
+
+// overrideColumns are the CSV columns: who the row is for, then a mode
+// column for each field that can be shown or hidden and a _text column for
+// each that takes replacement text.
+func overrideColumns() []string {
+	columns := []string{"person_id", "name", "family_name", updatedColumn}
+	for _, field := range overrideFields {
+		if field.option != nil || field.flag != nil {
+			columns = append(columns, field.name)
+		}
+		if field.text != nil {
+			columns = append(columns, field.name+textColumnSuffix)
+		}
+	}
+
+	return append(columns, deleteColumn)
+}
+
+// writeOverridesCSV writes the overrides kept by person ID, one row each.
+// Old overrides still waiting for a person ID are left out.
+func writeOverridesCSV(w io.Writer, overrides *OverrideSet) (err error) {
+	columns := overrideColumns()
+	out := csv.NewWriter(w)
+
+	err = out.Write(columns)
+	if err != nil {
+		return err
+	}
+
+	personIds := make([]string, 0, len(overrides.People))
+	for personId := range overrides.People {
+		personIds = append(personIds, personId)
+	}
+	sortPersonIds(personIds)
+
+	for _, personId := range personIds {
+		override := overrides.People[personId]
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			switch column {
+			case "person_id":
+				record[i] = personId
+			case "name":
+				record[i] = escapeFormula(override.Name)
+			case "family_name":
+				record[i] = escapeFormula(override.FamilyName)
+			case updatedColumn:
+				if !override.Updated.IsZero() {
+					record[i] = override.Updated.Format(time.RFC3339Nano)
+				}
+			case deleteColumn:
+			default:
+				if strings.HasSuffix(column, textColumnSuffix) {
+					record[i] = escapeFormula(override.Fields[strings.TrimSuffix(column, textColumnSuffix)].Text)
+				} else {
+					record[i] = override.Fields[column].Mode
+				}
+			}
+		}
+
+		err = out.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+
+	return out.Error()
+}
+
+// readOverridesCSV turns the rows of a CSV file into patches. Only the
+// columns in the header are changed, so a sheet with just person_id and
+// phones hides or shows phones and leaves everything else alone. With an
+// updated column, a blank one means the row is new. errs has the rows that
+// can't be read and the patches that don't validate, in row order.
+func readOverridesCSV(r io.Reader) (patches []OverridePatch, rows []int, errs []OverrideError) {
+	in := csv.NewReader(r)
+	in.TrimLeadingSpace = true
+
+	header, err := in.Read()
+	if err != nil {
+		return nil, nil, []OverrideError{{Row: 1, Message: fmt.Sprintf("can't read the header: %s", err)}}
+	}
+
+	known := make(map[string]bool)
+	for _, column := range overrideColumns() {
+		known[column] = true
+	}
+	seen := make(map[string]bool)
+	for i, column := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(column))
+		if !known[header[i]] {
+			errs = append(errs, OverrideError{Row: 1, Field: column, Message: "unknown column"})
+		} else if seen[header[i]] {
+			errs = append(errs, OverrideError{Row: 1, Field: column, Message: "column appears more than once"})
+		}
+		seen[header[i]] = true
+	}
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+
+	for row := 2; ; row++ {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, OverrideError{Row: row, Message: err.Error()})
+			continue
+		}
+
+		if strings.Join(record, "") == "" {
+			continue
+		}
+
+		patch := OverridePatch{Fields: make(map[string]FieldPatch)}
+		for i, column := range header {
+			value := strings.TrimSpace(record[i])
+
+			switch column {
+			case "person_id":
+				patch.PersonId = value
+			case "name":
+				value = unescapeFormula(value)
+				patch.Name = &value
+			case "family_name":
+				value = unescapeFormula(value)
+				patch.FamilyName = &value
+			case updatedColumn:
+				updated := time.Time{}
+				if value != "" {
+					updated, err = time.Parse(time.RFC3339Nano, value)
+					if err != nil {
+						errs = append(errs, OverrideError{Row: row, Field: column, Message: "isn't a time as exported"})
+					}
+				}
+				patch.Updated = &updated
+			case deleteColumn:
+				switch strings.ToLower(value) {
+				case "", "no", "false":
+				case "yes", "true", "x":
+					patch.Delete = true
+				default:
+					errs = append(errs, OverrideError{Row: row, Field: column, Message: fmt.Sprintf("%q isn't yes or blank", value)})
+				}
+			default:
+				name := strings.TrimSuffix(column, textColumnSuffix)
+				field := patch.Fields[name]
+				if strings.HasSuffix(column, textColumnSuffix) {
+					value = unescapeFormula(value)
+					field.Text = &value
+				} else {
+					mode := strings.ToLower(value)
+					field.Mode = &mode
+				}
+				patch.Fields[name] = field
+			}
+		}
+
+		patches = append(patches, patch)
+		rows = append(rows, row)
+	}
+
+	errs = append(errs, validatePatches(patches, rows)...)
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Row < errs[j].Row })
+
+	return patches, rows, errs
+}
+
+// escapeFormula quotes text a spreadsheet would take for a formula, so
+// opening an export can't run what someone typed as their name.
+func escapeFormula(text string) string {
+	if text != "" && strings.ContainsRune(formulaStart, rune(text[0])) {
+		return "'" + text
+	}
+
+	return text
+}
+
+// unescapeFormula takes off the quote escapeFormula added.
+func unescapeFormula(text string) string {
+	if len(text) > 1 && text[0] == '\'' && strings.ContainsRune(formulaStart, rune(text[1])) {
+		return text[1:]
+	}
+
+	return text
+}
+
+// sortPersonIds orders person IDs numerically.
+func sortPersonIds(personIds []string) {
+	sort.Slice(personIds, func(i, j int) bool {
+		if len(personIds[i]) != len(personIds[j]) {
+			return len(personIds[i]) < len(personIds[j])
+		}
+		return personIds[i] < personIds[j]
+	})
+}
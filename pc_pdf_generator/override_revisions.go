@@ -0,0 +1,278 @@
+package pc_pdf_generator
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	// revisionBaseline is the source of revision 0: the overrides as they
+	// were before the first revision was saved.
+	revisionBaseline  = "baseline"
+	revisionImport    = "import"
+	revisionMigration = "migration"
+	revisionRestore   = "restore"
+
+	diffAdded   = "added"
+	diffRemoved = "removed"
+	diffChanged = "changed"
+
+	// maxRevisions is how many revisions are kept. Each holds a copy of
+	// every override, so older ones are deleted as new ones are saved.
+	maxRevisions = 100
+)
+
+// OverridesRevision is one saved version of every override. Each save of
+// the overrides stores one, numbered from 1, with who saved it, a copy of
+// the whole set and what changed from the revision before. Author is a
+// Planning Center person ID, and Source says how the save was made: by
+// staff in the editor, by a CSV import, by a member in the portal, by a
+// directory matching old overrides to people, or by a restore.
+type OverridesRevision struct {
+	Number       int64     `json:"number"`
+	Author       string    `json:"author"`
+	AuthorName   string    `json:"author_name"`
+	Source       string    `json:"source"`
+	RestoredFrom int64     `json:"restored_from,omitempty"`
+	Time         time.Time `json:"time"`
+
+	Added   int `json:"added"`
+	Changed int `json:"changed"`
+	Removed int `json:"removed"`
+
+	Overrides []byte `json:"-" datastore:",noindex"`
+	Diff      []byte `json:"-" datastore:",noindex"`
+}
+
+// OverrideDiff is how one person's override differs between two revisions.
+// Pending overrides are told apart by LegacyKey.
+type OverrideDiff struct {
+	PersonId  string           `json:"person_id"`
+	LegacyKey string           `json:"legacy_key,omitempty"`
+	Name      string           `json:"name"`
+	Status    string           `json:"status"`
+	Changes   []OverrideChange `json:"changes"`
+}
+
+// RevisionDetail is a revision with its overrides and how they differ from
+// the revision Against.
+type RevisionDetail struct {
+	OverridesRevision
+	Against   int64          `json:"against"`
+	Overrides *OverrideSet   `json:"overrides"`
+	Diff      []OverrideDiff `json:"diff"`
+}
+
+func (dl *PCDownloader) revision(source string) OverridesRevision {
+	return OverridesRevision{Author: dl.personId, AuthorName: dl.personName, Source: source}
+}
+
+func revisionKey(ctx context.Context, number int64) *datastore.Key {
+	// Revisions share the overrides' entity group, so they're written in the
+	// same transaction and listed consistently. IDs can't be 0, so revision 0
+	// is ID 1.
+	return datastore.NewKey(ctx, "OverridesRevision", "", number+1, overridesKey(ctx))
+}
+
+// putRevision stores the revision with a copy of the overrides and the diff
+// from the ones they replace, and deletes the revision that leaves more than
+// maxRevisions.
+func putRevision(ctx context.Context, revision OverridesRevision, previous *OverrideSet, overrides *OverrideSet) (err error) {
+	revision.Overrides, err = json.Marshal(overrides)
+	if err != nil {
+		return err
+	}
+
+	diff := diffOverrides(previous, overrides)
+	for _, d := range diff {
+		switch d.Status {
+		case diffAdded:
+			revision.Added++
+		case diffRemoved:
+			revision.Removed++
+		default:
+			revision.Changed++
+		}
+	}
+	revision.Diff, err = json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+
+	_, err = datastore.Put(ctx, revisionKey(ctx, revision.Number), &revision)
+	if err != nil {
+		return err
+	}
+
+	if revision.Number < maxRevisions {
+		return nil
+	}
+
+	return datastore.Delete(ctx, revisionKey(ctx, revision.Number-maxRevisions))
+}
+
+func loadRevision(ctx context.Context, number int64) (revision OverridesRevision, overrides *OverrideSet, err error) {
+	err = datastore.Get(ctx, revisionKey(ctx, number), &revision)
+	if err != nil {
+		return revision, nil, err
+	}
+
+	overrides = &OverrideSet{}
+	err = json.Unmarshal(revision.Overrides, overrides)
+	if overrides.People == nil {
+		overrides.People = make(map[string]Override)
+	}
+	if overrides.Pending == nil {
+		overrides.Pending = make(map[string]Override)
+	}
+
+	return revision, overrides, err
+}
+
+// loadRevisions returns the latest revisions, newest first, without their
+// overrides.
+func loadRevisions(ctx context.Context, limit int) (revisions []OverridesRevision, err error) {
+	_, err = datastore.NewQuery("OverridesRevision").Ancestor(overridesKey(ctx)).Order("-Number").Limit(limit).GetAll(ctx, &revisions)
+
+	for i := range revisions {
+		revisions[i].Overrides = nil
+		revisions[i].Diff = nil
+	}
+
+	return revisions, err
+}
+
+// loadRevisionDetail returns a revision with its diff from against, or from
+// the revision before it when against is negative.
+func loadRevisionDetail(ctx context.Context, number int64, against int64) (detail RevisionDetail, err error) {
+	revision, overrides, err := loadRevision(ctx, number)
+	if err != nil {
+		return detail, err
+	}
+
+	detail = RevisionDetail{OverridesRevision: revision, Against: number - 1, Overrides: overrides}
+	if against < 0 {
+		if revision.Diff != nil {
+			err = json.Unmarshal(revision.Diff, &detail.Diff)
+		}
+		return detail, err
+	}
+
+	_, from, err := loadRevision(ctx, against)
+	if err != nil {
+		return detail, err
+	}
+	detail.Against = against
+	detail.Diff = diffOverrides(from, overrides)
+
+	return detail, nil
+}
+
+// diffOverrides lists the overrides added, removed or changed going from
+// one set to another, in person ID then legacy key order.
+func diffOverrides(from *OverrideSet, to *OverrideSet) (diff []OverrideDiff) {
+	diff = diffOverrideMaps(from.People, to.People, false)
+
+	return append(diff, diffOverrideMaps(from.Pending, to.Pending, true)...)
+}
+
+func diffOverrideMaps(from map[string]Override, to map[string]Override, pending bool) (diff []OverrideDiff) {
+	keys := make([]string, 0, len(from)+len(to))
+	for key := range from {
+		keys = append(keys, key)
+	}
+	for key := range to {
+		if _, ok := from[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	if pending {
+		sort.Strings(keys)
+	} else {
+		sortPersonIds(keys)
+	}
+
+	for _, key := range keys {
+		before, hadBefore := from[key]
+		after, hasAfter := to[key]
+
+		d := OverrideDiff{Name: after.Name, Status: diffChanged}
+		if !hasAfter {
+			d.Name = before.Name
+			d.Status = diffRemoved
+		} else if !hadBefore {
+			d.Status = diffAdded
+		}
+		if pending {
+			d.LegacyKey = key
+		} else {
+			d.PersonId = key
+		}
+
+		d.Changes = overrideChanges(before, after, "", "", time.Time{})
+		sort.Slice(d.Changes, func(i, j int) bool { return d.Changes[i].Field < d.Changes[j].Field })
+		if d.Status == diffChanged && len(d.Changes) == 0 {
+			continue
+		}
+
+		diff = append(diff, d)
+	}
+
+	return diff
+}
+
+// restoreRevision saves the overrides of an earlier revision as a new one.
+// Overrides the restore changes are stamped with the restorer, so editors
+// holding the newer ones have to reload before saving over them.
+func restoreRevision(ctx context.Context, number int64, revision OverridesRevision) (restored *OverrideSet, err error) {
+	now := time.Now()
+
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) (err error) {
+		var changes []OverrideChange
+
+		current, err := loadOverrides(tc)
+		if err != nil {
+			return err
+		}
+
+		_, restored, err = loadRevision(tc, number)
+		if err != nil {
+			return err
+		}
+
+		for personId, after := range restored.People {
+			before, ok := current.People[personId]
+			c := overrideChanges(before, after, revision.Author, revisionRestore, now)
+			if len(c) > 0 || !ok {
+				after.Updated = now
+				after.UpdatedBy = revision.Author
+			} else {
+				after.Updated = before.Updated
+				after.UpdatedBy = before.UpdatedBy
+			}
+			restored.People[personId] = after
+			changes = append(changes, c...)
+		}
+		for personId, before := range current.People {
+			if _, ok := restored.People[personId]; !ok {
+				changes = append(changes, overrideChanges(before, Override{PersonId: personId}, revision.Author, revisionRestore, now)...)
+			}
+		}
+
+		revision.Source = revisionRestore
+		revision.RestoredFrom = number
+
+		err = saveOverrides(tc, restored, revision)
+		if err != nil {
+			return err
+		}
+
+		return saveOverrideChanges(tc, changes)
+	}, &datastore.TransactionOptions{XG: true})
+
+	return restored, err
+}
@@ -0,0 +1,493 @@
+package pc_pdf_generator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	overrideShow = "show"
+	overrideHide = "hide"
+
+	changeByStaff  = "staff"
+	changeByMember = "member"
+
+	// overridesName is the datastore name of the overrides keyed by person
+	// ID. The old first-last-birthday overrides stay under ID 1 until they
+	// have all been matched to people.
+	overridesName    = "people"
+	legacyOverrideId = 1
+
+	// maxPutEntities is the most entities the datastore takes in one Put.
+	maxPutEntities = 500
+)
+
+var errOverridesChanged = errors.New("overrides were changed since they were loaded; reload them and try again")
+
+// FieldOverride changes how one field prints for a person. Mode "show" or
+// "hide" prints or leaves out the field whatever the section says, and Text,
+// when set, prints in place of the Planning Center value. Source is "member"
+// for choices members made themselves in the portal.
+type FieldOverride struct {
+	Mode   string `json:"mode,omitempty"`
+	Text   string `json:"text,omitempty"`
+	Source string `json:"source,omitempty"`
+}
+
+// Override is everything changed for one person, keyed by Planning Center
+// person ID. LegacyKey is set instead on old overrides that haven't been
+// matched to a person yet. Updated and UpdatedBy, a person ID, are from the
+// last change.
+type Override struct {
+	PersonId   string                   `json:"person_id"`
+	LegacyKey  string                   `json:"legacy_key,omitempty"`
+	Name       string                   `json:"name"`
+	FamilyName string                   `json:"family_name"`
+	Fields     map[string]FieldOverride `json:"fields"`
+	Updated    time.Time                `json:"updated"`
+	UpdatedBy  string                   `json:"updated_by"`
+}
+
+// OverrideChange is one entry in the audit trail of overrides: a field of
+// someone's override changed by staff in the editor or by the member in the
+// portal.
+type OverrideChange struct {
+	PersonId string
+	Field    string
+	FromMode string
+	FromText string
+	ToMode   string
+	ToText   string
+	By       string
+	Source   string
+	Time     time.Time
+}
+
+// OverrideSet is what's stored: overrides by person ID, and the old
+// overrides still waiting for a person by their first-last-birthday key.
+// Revision is the number of the last revision saved.
+type OverrideSet struct {
+	People   map[string]Override `json:"people"`
+	Pending  map[string]Override `json:"pending"`
+	Revision int64               `json:"revision"`
+}
+
+// overrideField is how an override field maps onto the section options and
+// the person. Any may be nil: names have no option, and dates and phones
+// have no replacement text. flag is a person field that hiding clears, for
+// things sections always print, like photos.
+type overrideField struct {
+	name   string
+	option func(*Section) *bool
+	text   func(*Person) *string
+	flag   func(*Person) *bool
+}
+
+// overrideFields are in the order the editor and CSV files list them.
+var overrideFields = []overrideField{
+	{name: "show", option: func(s *Section) *bool { return &s.Show }},
+	{name: "show_household", option: func(s *Section) *bool { return &s.ShowHousehold }},
+	{name: "show_children", option: func(s *Section) *bool { return &s.ShowChildren }},
+	{name: "first_name", text: func(p *Person) *string { return &p.FirstName }},
+	{name: "last_name", text: func(p *Person) *string { return &p.LastName }},
+	{name: "phones", option: func(s *Section) *bool { return &s.Phones }},
+	{name: "email", option: func(s *Section) *bool { return &s.Email }, text: func(p *Person) *string { return &p.EmailAddress }},
+	{name: "address", option: func(s *Section) *bool { return &s.Address }, text: func(p *Person) *string { return &p.Address1 }},
+	{name: "address2", text: func(p *Person) *string { return &p.Address2 }},
+	{name: "city", option: func(s *Section) *bool { return &s.City }, text: func(p *Person) *string { return &p.City }},
+	{name: "state", option: func(s *Section) *bool { return &s.State }, text: func(p *Person) *string { return &p.State }},
+	{name: "postal_code", option: func(s *Section) *bool { return &s.PostalCode }, text: func(p *Person) *string { return &p.PostalCode }},
+	{name: "country", option: func(s *Section) *bool { return &s.Country }, text: func(p *Person) *string { return &p.Country }},
+	{name: "job_title", option: func(s *Section) *bool { return &s.JobTitle }, text: func(p *Person) *string { return &p.Title }},
+	{name: "employer", option: func(s *Section) *bool { return &s.Employer }, text: func(p *Person) *string { return &p.Employer }},
+	{name: "occupation", option: func(s *Section) *bool { return &s.Occupation }, text: func(p *Person) *string { return &p.Occupation }},
+	{name: "school", option: func(s *Section) *bool { return &s.School }, text: func(p *Person) *string { return &p.School }},
+	{name: "children", option: func(s *Section) *bool { return &s.Children }, text: func(p *Person) *string { return &p.Children1 }},
+	{name: "age", option: func(s *Section) *bool { return &s.Age }},
+	{name: "birthday", option: func(s *Section) *bool { return &s.Birthday }},
+	{name: "date_joined", option: func(s *Section) *bool { return &s.DateJoined }},
+	{name: "photo", flag: func(p *Person) *bool { return &p.Thumbnail }},
+}
+
+func legacyOverrideKey(firstName string, lastName string, birthday string) string {
+	return strings.ToLower(fmt.Sprintf("%s-%s-%s", firstName, lastName, birthday))
+}
+
+func overridesKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, "Overrides", overridesName, 0, nil)
+}
+
+// legacyOverride converts an old override, which could only turn fields
+// off, to the per-field form.
+func legacyOverride(key string, old Section) Override {
+	override := Override{
+		LegacyKey: key,
+		Name:      strings.TrimSpace(old.KeyFirstName + " " + old.KeyLastName),
+		Fields:    make(map[string]FieldOverride),
+	}
+
+	shown := map[string]bool{
+		"show":           old.Show,
+		"show_household": old.ShowHousehold,
+		"show_children":  old.ShowChildren,
+		"phones":         old.Phones,
+		"email":          old.Email,
+		"address":        old.Address,
+		"date_joined":    old.DateJoined,
+		"birthday":       old.Birthday,
+		"city":           old.City,
+		"state":          old.State,
+		"postal_code":    old.PostalCode,
+		"country":        old.Country,
+	}
+	for name, show := range shown {
+		if !show {
+			override.Fields[name] = FieldOverride{Mode: overrideHide}
+		}
+	}
+
+	return override
+}
+
+// loadOverrides reads the saved overrides. Before anything has been saved
+// by person ID, every old override comes back pending.
+func loadOverrides(ctx context.Context) (overrides *OverrideSet, err error) {
+	overrides = &OverrideSet{People: make(map[string]Override), Pending: make(map[string]Override)}
+
+	record := OverridesRecord{}
+	err = datastore.Get(ctx, overridesKey(ctx), &record)
+	if err == datastore.ErrNoSuchEntity {
+		return loadLegacyOverrides(ctx, overrides)
+	}
+	if err != nil {
+		return overrides, err
+	}
+
+	if record.Overrides != nil {
+		err = json.Unmarshal(record.Overrides, overrides)
+		if err != nil {
+			return overrides, err
+		}
+	}
+
+	if overrides.People == nil {
+		overrides.People = make(map[string]Override)
+	}
+	if overrides.Pending == nil {
+		overrides.Pending = make(map[string]Override)
+	}
+
+	return overrides, nil
+}
+
+func loadLegacyOverrides(ctx context.Context, overrides *OverrideSet) (*OverrideSet, error) {
+	record := OverridesRecord{}
+	err := datastore.Get(ctx, datastore.NewKey(ctx, "Overrides", "", legacyOverrideId, nil), &record)
+	if err == datastore.ErrNoSuchEntity || record.Overrides == nil {
+		return overrides, nil
+	}
+	if err != nil {
+		return overrides, err
+	}
+
+	var legacy map[string]Section
+	err = json.Unmarshal(record.Overrides, &legacy)
+	if err != nil {
+		return overrides, err
+	}
+
+	for key, old := range legacy {
+		overrides.Pending[key] = legacyOverride(key, old)
+	}
+
+	return overrides, nil
+}
+
+// saveOverrides stores the overrides as the next revision. The first save
+// also keeps what it replaces as revision 0, so even that can be restored.
+// It's called in a transaction, after the overrides were loaded in it.
+func saveOverrides(ctx context.Context, overrides *OverrideSet, revision OverridesRevision) (err error) {
+	previous, err := loadOverrides(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if previous.Revision == 0 {
+		err = putRevision(ctx, OverridesRevision{Source: revisionBaseline, Time: now}, &OverrideSet{}, previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	overrides.Revision = previous.Revision + 1
+	overrideBytes, err := json.Marshal(overrides)
+	if err != nil {
+		return err
+	}
+
+	_, err = datastore.Put(ctx, overridesKey(ctx), &OverridesRecord{Overrides: overrideBytes})
+	if err != nil {
+		return err
+	}
+
+	revision.Number = overrides.Revision
+	revision.Time = now
+
+	return putRevision(ctx, revision, previous, overrides)
+}
+
+// personOverride returns the override saved for the person, loading the
+// overrides the first time. A pending old override that matches the
+// person's name and birthday is moved to their ID; saveMigratedOverrides
+// stores the moves once the directory is done.
+func (dir *PdfDir) personOverride(p *Person) (override Override, ok bool) {
+	if dir.overrides == nil {
+		overrides, err := loadOverrides(dir.ctx)
+		if err != nil {
+			log.Warningf(dir.ctx, "Error pulling overrides: %s\n", err)
+			return override, false
+		}
+		dir.overrides = overrides
+	}
+
+	if override, ok = dir.overrides.People[p.Id]; ok {
+		return override, true
+	}
+
+	key := legacyOverrideKey(p.FirstName, p.LastName, p.Birthday.Format(timeFormat))
+	if override, ok = dir.overrides.Pending[key]; ok && p.Id != "" {
+		override.PersonId = p.Id
+		override.LegacyKey = ""
+		dir.overrides.People[p.Id] = override
+		// Everyone sharing the key gets the override, as they always have,
+		// so it's only dropped from pending when the directory is saved.
+		if dir.migrated == nil {
+			dir.migrated = make(map[string][]string)
+		}
+		dir.migrated[key] = append(dir.migrated[key], p.Id)
+	}
+
+	return override, ok
+}
+
+// saveMigratedOverrides stores the old overrides matched to people while
+// the directory was built. They're moved in the overrides as saved now, so
+// edits made while the directory was building aren't lost.
+func (dir *PdfDir) saveMigratedOverrides() {
+	if len(dir.migrated) == 0 {
+		return
+	}
+
+	var pending int
+	err := datastore.RunInTransaction(dir.ctx, func(ctx context.Context) (err error) {
+		overrides, err := loadOverrides(ctx)
+		if err != nil {
+			return err
+		}
+
+		for key, personIds := range dir.migrated {
+			override, ok := overrides.Pending[key]
+			if !ok {
+				continue
+			}
+
+			for _, personId := range personIds {
+				if _, ok := overrides.People[personId]; ok {
+					continue
+				}
+				override.PersonId = personId
+				override.LegacyKey = ""
+				overrides.People[personId] = override
+			}
+			delete(overrides.Pending, key)
+		}
+		pending = len(overrides.Pending)
+
+		return saveOverrides(ctx, overrides, OverridesRevision{Source: revisionMigration})
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		log.Warningf(dir.ctx, "Error saving migrated overrides: %s\n", err)
+		return
+	}
+
+	log.Infof(dir.ctx, "Moved %d overrides to person IDs, %d still pending\n", len(dir.migrated), pending)
+	dir.migrated = nil
+}
+
+// getSectionOverride returns the section options for one person: off for
+// sections they're excluded from, then with any field their override forces
+// shown or hidden.
+func (dir *PdfDir) getSectionOverride(directoryEntry *Person, oldDisplayOptions Section) (displayOptions Section) {
+	displayOptions = oldDisplayOptions
+	displayOptions.ShowHousehold = true
+	displayOptions.ShowChildren = true
+
+	override, ok := dir.personOverride(directoryEntry)
+	if ok {
+		for _, field := range overrideFields {
+			if field.option == nil {
+				continue
+			}
+
+			switch override.Fields[field.name].Mode {
+			case overrideShow:
+				*field.option(&displayOptions) = true
+			case overrideHide:
+				*field.option(&displayOptions) = false
+			}
+		}
+	}
+
+	// An excluded directory section hides the person whatever their
+	// override shows.
+	for _, exclude := range displayOptions.ExcludeDirSections {
+		if _, ok := directoryEntry.DirectorySections[exclude]; ok {
+			displayOptions.Show = false
+		}
+	}
+
+	return displayOptions
+}
+
+// overridePerson returns the person with their override's replacement text
+// filled in, or the person unchanged when there's nothing to replace.
+func (dir *PdfDir) overridePerson(p *Person) *Person {
+	override, ok := dir.personOverride(p)
+	if !ok {
+		return p
+	}
+
+	resolved := *p
+	for _, field := range overrideFields {
+		if field.flag != nil && override.Fields[field.name].Mode == overrideHide {
+			*field.flag(&resolved) = false
+		}
+
+		if field.text == nil {
+			continue
+		}
+
+		if text := override.Fields[field.name].Text; text != "" {
+			*field.text(&resolved) = text
+		}
+	}
+
+	return &resolved
+}
+
+// resolveHousehold returns the household with everyone in it passed through
+// overridePerson, so every layout prints the same replacement text.
+func (dir *PdfDir) resolveHousehold(h Household) Household {
+	if h.Head != nil {
+		h.Head = dir.overridePerson(h.Head)
+	}
+
+	members := make([]*Person, len(h.Members))
+	for i, p := range h.Members {
+		members[i] = dir.overridePerson(p)
+	}
+	h.Members = members
+
+	if h.Children != nil {
+		children := make(map[string]*Person, len(h.Children))
+		for key, p := range h.Children {
+			children[key] = dir.overridePerson(p)
+		}
+		h.Children = children
+	}
+
+	return h
+}
+
+// photoHidden reports whether the person's override hides their photo.
+func (dir *PdfDir) photoHidden(p *Person) bool {
+	override, ok := dir.personOverride(p)
+
+	return ok && override.Fields["photo"].Mode == overrideHide
+}
+
+// overrideChanges lists the fields that differ between two versions of a
+// person's override, for the audit trail.
+func overrideChanges(before Override, after Override, by string, source string, now time.Time) (changes []OverrideChange) {
+	personId := after.PersonId
+	if personId == "" {
+		personId = before.PersonId
+	}
+
+	names := make(map[string]bool)
+	for name := range before.Fields {
+		names[name] = true
+	}
+	for name := range after.Fields {
+		names[name] = true
+	}
+
+	for name := range names {
+		from, to := before.Fields[name], after.Fields[name]
+		if from.Mode == to.Mode && from.Text == to.Text {
+			continue
+		}
+
+		changes = append(changes, OverrideChange{PersonId: personId, Field: name, FromMode: from.Mode, FromText: from.Text, ToMode: to.Mode, ToText: to.Text, By: by, Source: source, Time: now})
+	}
+
+	if before.FamilyName != after.FamilyName {
+		changes = append(changes, OverrideChange{PersonId: personId, Field: "family_name", FromText: before.FamilyName, ToText: after.FamilyName, By: by, Source: source, Time: now})
+	}
+
+	return changes
+}
+
+// saveOverrideChanges adds changes to the audit trail. They're kept under
+// the overrides' key so the transaction saving the overrides saves them
+// too, and put at most maxPutEntities at a time.
+func saveOverrideChanges(ctx context.Context, changes []OverrideChange) (err error) {
+	for len(changes) > 0 {
+		n := len(changes)
+		if n > maxPutEntities {
+			n = maxPutEntities
+		}
+
+		keys := make([]*datastore.Key, n)
+		for i := range keys {
+			keys[i] = datastore.NewIncompleteKey(ctx, "OverrideChange", overridesKey(ctx))
+		}
+
+		_, err = datastore.PutMulti(ctx, keys, changes[:n])
+		if err != nil {
+			return err
+		}
+		changes = changes[n:]
+	}
+
+	return nil
+}
+
+// loadOverrideChanges returns the latest changes to a person's override,
+// newest first.
+func loadOverrideChanges(ctx context.Context, personId string, limit int) (changes []OverrideChange, err error) {
+	_, err = datastore.NewQuery("OverrideChange").Filter("PersonId =", personId).Order("-Time").Limit(limit).GetAll(ctx, &changes)
+
+	return changes, err
+}
+
+// keepSources carries over who set each field, so a member's choice the
+// editor saves back unchanged is still theirs.
+func keepSources(before Override, after Override) Override {
+	for name, field := range after.Fields {
+		if prev, ok := before.Fields[name]; ok && field.Source == "" && field.Mode == prev.Mode {
+			field.Source = prev.Source
+			after.Fields[name] = field
+		}
+	}
+
+	return after
+}
@@ -0,0 +1,132 @@
+package pc_pdf_generator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+const (
+	orientationPortrait  = "portrait"
+	orientationLandscape = "landscape"
+)
+
+// bookPageSizes are trim sizes gofpdf doesn't name, in mm and portrait.
+var bookPageSizes = map[string]gofpdf.SizeType{
+	"halfletter": {Wd: 139.7, Ht: 215.9},
+	"6x9":        {Wd: 152.4, Ht: 228.6},
+}
+
+// trimSize returns the size, in mm and before orientation, the config's
+// pages are cut to: page_width by page_height when both are set, or the
+// named page size, A4 when blank.
+func trimSize(config *Config) (size gofpdf.SizeType, err error) {
+	if config.PageWidth > 0 && config.PageHeight > 0 {
+		return gofpdf.SizeType{Wd: config.PageWidth, Ht: config.PageHeight}, nil
+	}
+
+	if size, ok := bookPageSizes[strings.ToLower(config.PageSize)]; ok {
+		return size, nil
+	}
+
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	if config.PageSize == "" {
+		size.Wd, size.Ht = pdf.GetPageSize()
+		return size, nil
+	}
+
+	size = pdf.GetPageSizeStr(config.PageSize)
+	if size.Wd == 0 || size.Ht == 0 {
+		return size, fmt.Errorf("no page size %q", config.PageSize)
+	}
+
+	return size, nil
+}
+
+// pageSizeName describes the config's page size for messages.
+func pageSizeName(config *Config) string {
+	name := config.PageSize
+	switch {
+	case config.PageWidth > 0 && config.PageHeight > 0:
+		name = fmt.Sprintf("%gx%gmm", config.PageWidth, config.PageHeight)
+	case name == "":
+		name = "A4"
+	}
+
+	if config.Orientation == orientationLandscape {
+		name += " landscape"
+	}
+
+	return name
+}
+
+// orientedSize turns a portrait size to the orientation.
+func orientedSize(size gofpdf.SizeType, orientation string) gofpdf.SizeType {
+	if orientation == orientationLandscape {
+		return gofpdf.SizeType{Wd: size.Ht, Ht: size.Wd}
+	}
+
+	return size
+}
+
+// sectionOrientation is the orientation of a section's pages: its own, or
+// the config's.
+func (dir *PdfDir) sectionOrientation(displayOptions Section) string {
+	if displayOptions.Orientation != "" {
+		return displayOptions.Orientation
+	}
+
+	return dir.orientation
+}
+
+// sectionPageSize returns the size of a section's pages, bleed and slug
+// included.
+func (dir *PdfDir) sectionPageSize(displayOptions Section) (width float64, height float64) {
+	size := orientedSize(dir.trimSize, dir.sectionOrientation(displayOptions))
+
+	return size.Wd + dir.trimOffset()*2, size.Ht + dir.trimOffset()*2
+}
+
+// beginSection starts a section on a new page in its orientation, and
+// sets the width of its columns from that page.
+func (dir *PdfDir) beginSection(displayOptions Section) {
+	dir.pageOrientation = dir.sectionOrientation(displayOptions)
+
+	dir.pdf.SetTopMargin(dir.topMargin)
+	dir.addPage()
+
+	left, right := dir.pageMargins()
+	box := dir.pageBox()
+	dir.colWd = (box.w - (left - box.x) - (right - box.x) - ((dir.colNum - 1) * dir.gutter)) / dir.colNum
+}
+
+// addPage adds a page in the current section's orientation. gofpdf's own
+// AddPage would go back to the orientation the PDF was started in.
+func (dir *PdfDir) addPage() {
+	width, height := dir.sectionPageSize(Section{Orientation: dir.pageOrientation})
+	dir.pdf.AddPageFormat("P", gofpdf.SizeType{Wd: width, Ht: height})
+}
+
+type pageRect struct {
+	x, y, w, h float64
+}
+
+// trimOffset is how far the trim box is from the page edge: the bleed, and
+// the slug outside it that printer's marks go in.
+func (dir *PdfDir) trimOffset() float64 {
+	return dir.bleed + dir.slug
+}
+
+// pageBox returns the trim box of the current page: where it's cut, inside
+// the bleed. Margins are measured from its edges.
+func (dir *PdfDir) pageBox() pageRect {
+	return dir.trimBox(dir.pdf.GetPageSize())
+}
+
+// trimBox returns the trim box of a page width by height.
+func (dir *PdfDir) trimBox(width float64, height float64) pageRect {
+	offset := dir.trimOffset()
+
+	return pageRect{offset, offset, width - offset*2, height - offset*2}
+}
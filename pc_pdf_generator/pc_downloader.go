@@ -11,6 +11,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -18,7 +19,6 @@ import (
 	"time"
 
 	"cloud.google.com/go/storage"
-	"google.golang.org/appengine/file"
 	"google.golang.org/appengine/memcache"
 	"google.golang.org/appengine/urlfetch"
 
@@ -38,6 +38,12 @@ type PCDownloader struct {
 	clientSecret  string
 	tokenSecret   string
 	token         string
+	personId      string
+	personName    string
+	staff         bool
+	member        bool
+	fixture       string
+	thumbnail     thumbnailSpec
 	ctx           context.Context
 
 	throttle       <-chan time.Time
@@ -68,9 +74,6 @@ type Person struct {
 
 	Thumbnail bool
 
-	NewMember90    bool
-	PendingBaptism bool
-
 	Occupation string
 
 	Children1 string
@@ -82,7 +85,17 @@ type Person struct {
 	Employer string
 	School   string
 
+	SortAs string
+
+	// Fields holds the Planning Center custom fields by name, and Tags the
+	// options checked in the tagsField custom field, lowercased, for marker
+	// rules.
+	Fields map[string]string
+	Tags   map[string]bool
+
 	DirectorySections map[string]bool
+
+	DataIssues []DataIssue
 }
 
 type Household struct {
@@ -91,6 +104,16 @@ type Household struct {
 	Members  []*Person
 	Children map[string]*Person
 	Head     *Person
+	Photo    *HouseholdPhoto
+}
+
+// HouseholdPhoto is shared by every copy of a Household, so the download
+// started for one member is seen by the rest. Object is the bucket object
+// of the family photo, or "" for none.
+type HouseholdPhoto struct {
+	Object string
+
+	once sync.Once
 }
 
 type PCTokenResponse struct {
@@ -102,7 +125,17 @@ type PCTokenResponse struct {
 	CreatedAt    int64  `json:"created_at"`
 }
 
+// PCOrganizationResponse is the logged in person's profile: who they are
+// and, in the meta, their organization.
 type PCOrganizationResponse struct {
+	Data struct {
+		Id         string `json:"id"`
+		Attributes struct {
+			Name              string `json:"name"`
+			SiteAdministrator bool   `json:"site_administrator"`
+			PeoplePermissions string `json:"people_permissions"`
+		} `json:"attributes"`
+	} `json:"data"`
 	Meta struct {
 		Parent struct {
 			Id string `json:"id"`
@@ -279,6 +312,9 @@ func (dl *PCDownloader) CheckSession(token string, refreshToken string, expirati
 	json.Unmarshal(contents, &orgData)
 
 	domain = orgData.Meta.Parent.Id
+	dl.personId = orgData.Data.Id
+	dl.personName = orgData.Data.Attributes.Name
+	dl.staff = orgData.Data.Attributes.SiteAdministrator || staffPermissions[orgData.Data.Attributes.PeoplePermissions]
 
 	return err, newToken, newRefreshToken, newExpiration, domain
 }
@@ -328,68 +364,109 @@ func (dl *PCDownloader) GetTokens(code string) (err error, token string, refresh
 	return err, tokenData.AccessToken, tokenData.RefreshToken, (tokenData.CreatedAt + tokenData.ExpiresIn)
 }
 
-func (dl *PCDownloader) downloadImage(remoteUrl string, person *Person, retryCount int) (err error) {
+func (dl *PCDownloader) downloadImage(remoteUrl string, person *Person) (err error) {
 	defer dl.wg.Done()
 
-	if strings.Contains(remoteUrl, "svg") {
-		return err
-	}
+	person.Thumbnail, err = dl.cacheImage(remoteUrl, dl.domain+"/jpgs/"+person.Id)
 
-	bucketName, err := file.DefaultBucketName(dl.ctx)
-	if err != nil {
-		return err
+	return err
+}
+
+// cacheImage stores the image at remoteUrl in the bucket as a JPEG unless it
+// is already there, and reports whether objectName holds a usable image.
+func (dl *PCDownloader) cacheImage(remoteUrl string, objectName string) (cached bool, err error) {
+	if strings.Contains(remoteUrl, "svg") {
+		return false, err
 	}
 
-	client, err := storage.NewClient(dl.ctx)
+	client, bucket, err := defaultBucket(dl.ctx)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer client.Close()
 
-	bucket := client.Bucket(bucketName)
-
-	_, err = bucket.Object(dl.domain + "/jpgs/" + person.Id).Attrs(dl.ctx)
+	_, err = bucket.Object(objectName).Attrs(dl.ctx)
 	//change this to err == nil when we want to turn on caching again
 	if err == nil {
-		person.Thumbnail = true
-		return err
-	}
-
-	contents, err := dl.downloadContent(remoteUrl)
-	if err != nil {
-		return err
+		return true, err
 	}
 
-	if len(contents) < 1 && retryCount < 6 {
-		dl.wg.Add(1)
-		go dl.downloadImage(remoteUrl, person, retryCount+1)
-		return err
+	var contents []byte
+	for retryCount := 0; len(contents) < 1 && retryCount < 6; retryCount++ {
+		contents, err = dl.downloadContent(remoteUrl)
+		if err != nil {
+			return false, err
+		}
 	}
 
-	inputBytes := bytes.NewReader(contents)
-	input, _, err := image.Decode(inputBytes)
+	input, _, err := image.Decode(bytes.NewReader(contents))
 	if err != nil {
 		log.Printf("%s\n", err)
-		return err
+		return false, err
 	}
+	input = applyOrientation(input, exifOrientation(contents))
 
-	wc := bucket.Object(dl.domain + "/jpgs/" + person.Id).NewWriter(dl.ctx)
+	wc := bucket.Object(objectName).NewWriter(dl.ctx)
 	wc.ContentType = "image/jpeg"
 
-	defer wc.Close()
-
 	err = jpeg.Encode(wc, input, nil)
 	if err != nil {
 		log.Printf("%s\n", err)
-		return err
+		wc.Close()
+		return false, err
 	}
 
-	person.Thumbnail = true
+	err = wc.Close()
+	if err != nil {
+		return false, err
+	}
 
-	input = nil
-	inputBytes = nil
+	// Thumbnails left from a photo cached before are of the old photo.
+	err = deleteThumbnails(dl.ctx, bucket, dl.domain, objectName)
+	if err != nil {
+		log.Printf("Thumbnails %s: %s\n", objectName, err)
+	}
 
-	return err
+	if dl.thumbnail.dpi > 0 {
+		_, err = dl.thumbnail.create(dl.ctx, bucket, dl.domain, objectName)
+		if err != nil {
+			log.Printf("Thumbnail %s: %s\n", objectName, err)
+		}
+	}
+
+	return true, nil
+}
+
+// householdPhoto finds the family photo for a household: an uploaded one
+// wins over the household avatar from Planning Center. It returns the
+// object name, or "" if the household has neither.
+func (dl *PCDownloader) householdPhoto(householdId string, avatarUrl string) (objectName string, err error) {
+	client, bucket, err := defaultBucket(dl.ctx)
+	if err != nil {
+		return objectName, err
+	}
+	defer client.Close()
+
+	uploaded := uploadedHouseholdPhoto(dl.domain, householdId)
+	_, err = bucket.Object(uploaded).Attrs(dl.ctx)
+	if err == nil {
+		return uploaded, err
+	}
+	if err != storage.ErrObjectNotExist {
+		return objectName, err
+	}
+
+	if avatarUrl == "" {
+		return objectName, nil
+	}
+
+	objectName = fmt.Sprintf("%s/jpgs/households/%s", dl.domain, householdId)
+	cached, err := dl.cacheImage(avatarUrl, objectName)
+	if !cached {
+		return "", err
+	}
+
+	return objectName, err
 }
 
 func (dl *PCDownloader) downloadHousehold(remoteUrl string, household *Household) (err error) {
@@ -402,6 +479,16 @@ func (dl *PCDownloader) downloadHousehold(remoteUrl string, household *Household
 	res := PCPeopleResponse{}
 	json.Unmarshal(contents, &res)
 
+	// Every adult in the household triggers this download, but the photo
+	// only needs fetching once.
+	household.Photo.once.Do(func() {
+		object, photoErr := dl.householdPhoto(household.Id, res.Data.Attributes.Avatar)
+		if photoErr != nil {
+			log.Printf("Household photo %s: %s\n", household.Id, photoErr)
+		}
+		household.Photo.Object = object
+	})
+
 	householdMap := household.Children
 
 	for _, v := range res.Included {
@@ -426,6 +513,10 @@ func (dl *PCDownloader) downloadHousehold(remoteUrl string, household *Household
 }
 
 func (dl *PCDownloader) downloadList(listName string) (households map[string]Household, err error) {
+	if dl.fixture != "" {
+		return loadFixtureHouseholds(dl.fixture)
+	}
+
 	households = make(map[string]Household)
 	offset := 0
 	dataRemaining := true
@@ -439,6 +530,19 @@ func (dl *PCDownloader) downloadList(listName string) (households map[string]Hou
 	return households, err
 }
 
+// loadFixtureHouseholds reads households from fixtures/<name>.json in place of
+// a Planning Center list, so layouts can be checked against known data.
+func loadFixtureHouseholds(name string) (households map[string]Household, err error) {
+	contents, err := ioutil.ReadFile(filepath.Join("fixtures", filepath.Base(name)+".json"))
+	if err != nil {
+		return households, err
+	}
+
+	err = json.Unmarshal(contents, &households)
+
+	return households, err
+}
+
 func (dl *PCDownloader) downloadListPage(listName string, prevHouseholds map[string]Household, oldOffset int) (households map[string]Household, offset int, dataRemaining bool, err error) {
 	dataRemaining = false
 	remoteUrl := fmt.Sprintf("%s?include=people&per_page=100&offset=%d&where[name]=%s", dl.listUrl, offset, url.QueryEscape(listName))
@@ -478,8 +582,69 @@ func (dl *PCDownloader) downloadPeople(peopleIds []int, prevHouseholds map[strin
 	return households, err
 }
 
+// downloadHouseholdOf downloads the households the person is in, with every
+// adult in them, as a list download would.
+func (dl *PCDownloader) downloadHouseholdOf(personId int) (households map[string]Household, err error) {
+	res := PCPeopleResponse{}
+	err = dl.downloadJSON(fmt.Sprintf("%s/%d?include=households", dl.peopleUrl, personId), &res)
+	if err != nil {
+		return households, err
+	}
+
+	peopleIds := []int{personId}
+	for _, v := range res.Included {
+		if v.Type != "Household" {
+			continue
+		}
+
+		household := PCPeopleResponse{}
+		err = dl.downloadJSON(v.Links.Self+"?include=people", &household)
+		if err != nil {
+			return households, err
+		}
+
+		for _, p := range household.Included {
+			id, err := strconv.Atoi(p.Id)
+			if err != nil || p.Attributes.IsChild || id == personId {
+				continue
+			}
+			peopleIds = append(peopleIds, id)
+		}
+	}
+
+	return dl.downloadPeople(peopleIds, make(map[string]Household))
+}
+
+// downloadJSON decodes what remoteUrl returns into v, or returns an error
+// if Planning Center refused the request.
+func (dl *PCDownloader) downloadJSON(remoteUrl string, v interface{}) (err error) {
+	contents, status, err := dl.fetchContent(remoteUrl)
+	if err != nil {
+		return err
+	}
+	if status < 200 || status > 299 {
+		return fmt.Errorf("%s returned %d", remoteUrl, status)
+	}
+
+	return json.Unmarshal(contents, v)
+}
+
 func (dl *PCDownloader) downloadContent(remoteUrl string) (contents []byte, err error) {
-	item, err := memcache.Get(dl.ctx, remoteUrl)
+	contents, _, err = dl.fetchContent(remoteUrl)
+
+	return contents, err
+}
+
+// fetchContent returns what remoteUrl returns and its status. Only
+// successful responses are cached, and a member's separately from staff's,
+// since their token can see less.
+func (dl *PCDownloader) fetchContent(remoteUrl string) (contents []byte, status int, err error) {
+	cacheKey := remoteUrl
+	if dl.member {
+		cacheKey = fmt.Sprintf("member/%s/%s", dl.personId, remoteUrl)
+	}
+
+	item, err := memcache.Get(dl.ctx, cacheKey)
 
 	dl.throttle = time.Tick(time.Second / 4)
 	dl.throttleActive = true
@@ -498,7 +663,7 @@ func (dl *PCDownloader) downloadContent(remoteUrl string) (contents []byte, err
 
 		req, err := http.NewRequest("GET", remoteUrl, nil)
 		if err != nil {
-			return contents, err
+			return contents, status, err
 		}
 
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", dl.token))
@@ -511,21 +676,25 @@ func (dl *PCDownloader) downloadContent(remoteUrl string) (contents []byte, err
 			return
 		})
 		if err != nil {
-			return contents, err
+			return contents, status, err
 		}
 		defer resp.Body.Close()
 
+		status = resp.StatusCode
 		contents, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return contents, err
+			return contents, status, err
 		}
 
-		memcache.Set(dl.ctx, &memcache.Item{Key: remoteUrl, Value: contents, Expiration: cacheTTL})
+		if status >= 200 && status <= 299 {
+			memcache.Set(dl.ctx, &memcache.Item{Key: cacheKey, Value: contents, Expiration: cacheTTL})
+		}
 	} else {
 		contents = item.Value
+		status = http.StatusOK
 	}
 
-	return contents, err
+	return contents, status, err
 }
 
 func (dl *PCDownloader) getFieldDefinitions() (fieldDefinitions map[string]string, err error) {
@@ -580,6 +749,7 @@ func (dl *PCDownloader) downloadPerson(peopleId int, prevHouseholds map[string]H
 	}
 
 	fieldData := make(map[string]string)
+	tags := make(map[string]bool)
 
 	for _, v := range res.Included {
 		peopleId := v.Relationships.Person.Data.Id
@@ -614,7 +784,15 @@ func (dl *PCDownloader) downloadPerson(peopleId int, prevHouseholds map[string]H
 		}
 
 		if v.Type == "FieldDatum" {
-			fieldData[fieldDefinitions[v.Relationships.FieldDefinition.Data.Id]] = v.Attributes.Value
+			name := fieldDefinitions[v.Relationships.FieldDefinition.Data.Id]
+			fieldData[name] = v.Attributes.Value
+
+			// A checkboxes field has a datum for each option checked.
+			if name == tagsField {
+				if tag := strings.ToLower(strings.TrimSpace(v.Attributes.Value)); tag != "" {
+					tags[tag] = true
+				}
+			}
 		}
 
 		if v.Type == "PhoneNumber" {
@@ -652,6 +830,7 @@ func (dl *PCDownloader) downloadPerson(peopleId int, prevHouseholds map[string]H
 			Id:       householdId,
 			Members:  make([]*Person, 0),
 			Children: make(map[string]*Person),
+			Photo:    &HouseholdPhoto{},
 		}
 	}
 
@@ -669,11 +848,20 @@ func (dl *PCDownloader) downloadPerson(peopleId int, prevHouseholds map[string]H
 		School:     fieldData["School"],
 		Employer:   fieldData["Employer"],
 		Title:      fieldData["Title"],
+		SortAs:     fieldData[sortAsField],
+		Fields:     fieldData,
+		Tags:       tags,
+	}
+
+	if v.Attributes.Avatar == "" {
+		person.DataIssues = append(person.DataIssues, DataIssue{"photo", "no avatar"})
+	} else if strings.Contains(v.Attributes.Avatar, "svg") {
+		person.DataIssues = append(person.DataIssues, DataIssue{"photo", "default avatar"})
 	}
 
 	if v.Attributes.Avatar != "" {
 		dl.wg.Add(1)
-		go dl.downloadImage(v.Attributes.Avatar, &person, 0)
+		go dl.downloadImage(v.Attributes.Avatar, &person)
 	}
 
 	if householdLink != "" {
@@ -700,16 +888,17 @@ func (dl *PCDownloader) downloadPerson(peopleId int, prevHouseholds map[string]H
 
 	person.Married = married
 
-	t2, _ := time.Parse(timeFormat, v.Attributes.Birthdate)
+	t2, birthdateErr := time.Parse(timeFormat, v.Attributes.Birthdate)
+	if birthdateErr != nil && v.Attributes.Birthdate != "" {
+		person.DataIssues = append(person.DataIssues, DataIssue{"birthdate", fmt.Sprintf("can't read %q", v.Attributes.Birthdate)})
+	}
 	person.Birthday = t2
 
-	t, _ := time.Parse(timeFormat2, fieldData["Date Joined"])
-	person.DateJoined = t
-	person.NewMember90 = t.Sub(time.Now()).Hours()/24 > -91
-
-	if fieldData["Baptism Date"] == "" {
-		person.PendingBaptism = true
+	t, joinedErr := time.Parse(timeFormat2, fieldData["Date Joined"])
+	if joinedErr != nil && fieldData["Date Joined"] != "" {
+		person.DataIssues = append(person.DataIssues, DataIssue{"date_joined", fmt.Sprintf("can't read %q", fieldData["Date Joined"])})
 	}
+	person.DateJoined = t
 
 	if householdHead == person.Id {
 		household.Head = &person
@@ -1,15 +1,22 @@
 package pc_pdf_generator
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"image/png"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
@@ -30,8 +37,9 @@ const (
 	peopleUrl     = "https://api.planningcenteronline.com/people/v2/people"
 	credentialUrl = "https://api.planningcenteronline.com/oauth/token"
 	profileUrl    = "https://api.planningcenteronline.com/people/v2/me"
-	hostPattern   = "https://api.planningcenteronline.com/oauth/authorize?client_id=%s&redirect_uri=%s&response_type=code&scope=people"
+	hostPattern   = "https://api.planningcenteronline.com/oauth/authorize?client_id=%s&redirect_uri=%s&response_type=code&scope=people&state=%s"
 	cacheTTL      = time.Duration(5) * time.Minute
+	maxFontSize   = 20 << 20
 	hostName      = "hinson-dot-directory-export-pdf.appspot.com"
 )
 
@@ -41,21 +49,84 @@ type Config struct {
 	LeftMargin       float64   `json:"left_margin,string"`
 	BottomMargin     float64   `json:"bottom_margin,string"`
 	RightMargin      float64   `json:"right_margin,string"`
+	MirrorMargins    bool      `json:"mirror_margins"`
+	InsideMargin     float64   `json:"inside_margin,string"`
+	OutsideMargin    float64   `json:"outside_margin,string"`
+	BindingGutter    float64   `json:"binding_gutter,string"`
 	PageSize         string    `json:"page_size"`
 	NumberOfColumns  float64   `json:"number_of_columns,string"`
 	Padding          float64   `json:"padding,string"`
 	Gutter           float64   `json:"gutter,string"`
 	ImagePadding     float64   `json:"image_padding,string"`
 	ColumnHeight     float64   `json:"column_height,string"`
+	PhotoDPI         float64   `json:"photo_dpi,string"`
+	PhotoCrop        string    `json:"photo_crop"`
+	PlaceholderStyle string    `json:"placeholder_style"`
+	PlaceholderTints string    `json:"placeholder_colors"`
+	PlaceholderFont  string    `json:"placeholder_font_family"`
+	MinFontSize      float64   `json:"preflight_min_font_size,string"`
+	PreflightFail    bool      `json:"preflight_fail"`
+	LayoutMode       string    `json:"layout_mode"`
+	KeepHouseholds   bool      `json:"keep_households_together"`
+	Locale           string    `json:"locale"`
 	FontSize         float64   `json:"font_size,string"`
 	FontFamily       string    `json:"font_family"`
+	FallbackFonts    string    `json:"fallback_fonts"`
+	HeaderFontFamily string    `json:"header_font_family"`
+	NameFontFamily   string    `json:"name_font_family"`
+	BodyFontFamily   string    `json:"body_font_family"`
+	AvailableFonts   []string  `json:"available_fonts,omitempty"`
 	LineHeight       float64   `json:"line_height,string"`
 	HighlightOpacity float64   `json:"highlight_opacity,string"`
 	Sections         []Section `json:"sections"`
+
+	// PageWidth and PageHeight, in mm, replace PageSize when both are set.
+	// Bleed is added around every page, outside the margins.
+	PageWidth   float64 `json:"page_width,string"`
+	PageHeight  float64 `json:"page_height,string"`
+	Orientation string  `json:"orientation"`
+	Bleed       float64 `json:"bleed,string"`
+
+	// OutputProfile "offset" readies the PDF for a print shop: a bleed, 3mm
+	// unless set, printer's marks, embedded fonts only, everything but
+	// photos in process black and photos of at least MinImageDPI, 300
+	// unless set.
+	OutputProfile string  `json:"output_profile"`
+	MinImageDPI   float64 `json:"min_image_dpi,string"`
+
+	// Theme is the ID of the built-in or organization theme that styles
+	// the directory. Blank is the classic look.
+	Theme string `json:"theme"`
+
+	// MarkerRules replace the new member and pending baptism footnotes.
+	MarkerRules []MarkerRule `json:"marker_rules"`
+
+	// Name and Version are the saved config's. Saving is refused when the
+	// config was saved again after Version was loaded.
+	Name    string `json:"name"`
+	Version int64  `json:"version,string"`
+	Default bool   `json:"default"`
 }
 
+// Overrides is what the editor saves: every override, and when it loaded
+// them.
 type Overrides struct {
-	Overrides []Section `json:"overrides"`
+	Overrides []Override `json:"overrides"`
+	Loaded    time.Time  `json:"loaded"`
+}
+
+// NewConfig names a config to create, from a preset or, cloning, from the
+// config being cloned.
+type NewConfig struct {
+	Name   string `json:"name"`
+	Preset string `json:"preset"`
+}
+
+// LoadedOverrides is an OverrideSet as sent to the editor, stamped with when
+// it was loaded.
+type LoadedOverrides struct {
+	*OverrideSet
+	Loaded time.Time `json:"loaded"`
 }
 
 type Section struct {
@@ -88,10 +159,29 @@ type Section struct {
 	BaptismFootnote    bool     `json:"baptism_footnote"`
 	LineSpacing        float64  `json:"line_spacing,string"`
 	Columns            float64  `json:"columns,string"`
+	Type               string   `json:"type"`
+	GridColumns        int      `json:"grid_columns,string"`
+	GridRows           int      `json:"grid_rows,string"`
+	CaptionFields      string   `json:"caption_fields"`
+	HouseholdPhoto     bool     `json:"household_photo"`
+	LetterDividers     string   `json:"letter_dividers"`
+	LetterRange        bool     `json:"letter_range"`
+	SortBy             string   `json:"sort_by"`
+	Markers            bool     `json:"markers"`
+
+	// Orientation turns the section's pages, like a landscape children
+	// table. Blank uses the config's.
+	Orientation string `json:"orientation"`
 }
 
 type ConfigRecord struct {
 	Config []byte
+
+	Name          string
+	Version       int64
+	Updated       time.Time
+	UpdatedBy     string
+	UpdatedByName string
 }
 
 type StatusRecord struct {
@@ -107,23 +197,60 @@ var (
 	authKey      = []byte(sessionStoreAuth)
 	cryptKey     = []byte(sessionStoreCrypt)
 	sessionStore = cascadestore.NewCascadeStore(cascadestore.DistributedBackends, authKey, cryptKey)
+
+	// staffPermissions are the Planning Center People permissions that can
+	// use the staff app. Site administrators always can.
+	staffPermissions = map[string]bool{"Editor": true, "Manager": true}
 )
 
-func getSession(w http.ResponseWriter, r *http.Request) (pcDownloader PCDownloader) {
+// getSession is the session of a staff user, someone with one of the
+// staffPermissions.
+func getSession(w http.ResponseWriter, r *http.Request) (pcDownloader *PCDownloader) {
+	return getSessionFor(w, r, loginStaff)
+}
+
+// getMemberSession is getSession for the member portal, which members log in
+// to straight from a link, so Authorize sends them back there.
+func getMemberSession(w http.ResponseWriter, r *http.Request) (pcDownloader *PCDownloader) {
+	return getSessionFor(w, r, loginMember)
+}
+
+// getSessionFor returns the logged in user's downloader. Its token is blank
+// when the response has already been written, with a redirect to log in or
+// an error.
+func getSessionFor(w http.ResponseWriter, r *http.Request, target string) (pcDownloader *PCDownloader) {
+	pcDownloader = &PCDownloader{}
 	ctx := appengine.NewContext(r)
 	session, err := sessionStore.Get(r, sessionName)
 
 	token, _ := session.Values["token"].(string)
 	refreshToken, _ := session.Values["refreshToken"].(string)
 	expiration, _ := session.Values["expiration"].(int64)
+	member, _ := session.Values["member"].(bool)
+
+	// A member login can't be used in the staff app, so staff who used the
+	// portal first log in again.
+	if token == "" || member && target == loginStaff {
+		state, err := newLoginState()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return pcDownloader
+		}
+
+		session.Values["state"] = state
+		session.Values["target"] = target
+		err = session.Save(r, w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return pcDownloader
+		}
 
-	if token == "" {
 		redirectUrl := authUrl
 		if appengine.IsDevAppServer() {
 			redirectUrl = devAuthUrl
 		}
 
-		http.Redirect(w, r, fmt.Sprintf(hostPattern, clientId, fmt.Sprintf(redirectUrl, hostName)), http.StatusSeeOther)
+		http.Redirect(w, r, fmt.Sprintf(hostPattern, clientId, fmt.Sprintf(redirectUrl, hostName), state), http.StatusSeeOther)
 		return pcDownloader
 	}
 
@@ -132,7 +259,7 @@ func getSession(w http.ResponseWriter, r *http.Request) (pcDownloader PCDownload
 		redirectUrl = devAuthUrl
 	}
 
-	pcDownloader = PCDownloader{
+	*pcDownloader = PCDownloader{
 		clientId:      clientId,
 		clientSecret:  clientSecret,
 		credentialUrl: credentialUrl,
@@ -141,6 +268,7 @@ func getSession(w http.ResponseWriter, r *http.Request) (pcDownloader PCDownload
 		peopleUrl:     peopleUrl,
 		fieldUrl:      fieldUrl,
 		authUrl:       fmt.Sprintf(redirectUrl, hostName),
+		member:        member,
 		ctx:           ctx,
 	}
 
@@ -160,6 +288,11 @@ func getSession(w http.ResponseWriter, r *http.Request) (pcDownloader PCDownload
 		return pcDownloader
 	}
 
+	if target == loginStaff && !pcDownloader.staff {
+		http.Error(w, "your Planning Center login doesn't have permission to manage the directory", http.StatusForbidden)
+		return pcDownloader
+	}
+
 	ctx, err = appengine.Namespace(ctx, domain)
 	if err != nil || domain == "" || token == "" {
 		log.Criticalf(ctx, "Failed to set namespace: %s\n", err)
@@ -176,8 +309,22 @@ func getSession(w http.ResponseWriter, r *http.Request) (pcDownloader PCDownload
 	return pcDownloader
 }
 
+// newLoginState is a random OAuth state for one login.
+func newLoginState() (state string, err error) {
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return state, err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
 func Index(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	getSession(w, r)
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
 
 	t, _ := template.ParseFiles("js_app/index.html")
 	err := t.Execute(w, nil)
@@ -191,6 +338,15 @@ func Authorize(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	ctx := appengine.NewContext(r)
 	code := r.URL.Query().Get("code")
 
+	// Only the callback for the login this session started is taken.
+	session, err := sessionStore.Get(r, sessionName)
+	state, _ := session.Values["state"].(string)
+	target, _ := session.Values["target"].(string)
+	if state == "" || r.URL.Query().Get("state") != state {
+		http.Error(w, "this login wasn't started here; log in again", http.StatusBadRequest)
+		return
+	}
+
 	redirectUrl := authUrl
 	if appengine.IsDevAppServer() {
 		redirectUrl = devAuthUrl
@@ -210,11 +366,12 @@ func Authorize(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		return
 	}
 
-	session, err := sessionStore.Get(r, sessionName)
-
 	session.Values["token"] = token
 	session.Values["refreshToken"] = refreshToken
 	session.Values["expiration"] = expiration
+	session.Values["member"] = target == loginMember
+	delete(session.Values, "state")
+	delete(session.Values, "target")
 
 	err = session.Save(r, w)
 	if err != nil {
@@ -222,12 +379,20 @@ func Authorize(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		return
 	}
 
+	if target == loginMember {
+		http.Redirect(w, r, memberPath, 303)
+		return
+	}
+
 	http.Redirect(w, r, "/", 303)
 	return
 }
 
 func SaveConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
 
 	id, _ := strconv.ParseInt(params.ByName("id"), 10, 64)
 
@@ -237,19 +402,18 @@ func SaveConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params
 	var config Config
 	err := decoder.Decode(&config)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeConfigErrors(w, decodeErrors(err))
 		return
 	}
-	config.Id = id
-
-	configKey := datastore.NewKey(pcDownloader.ctx, "Config", "", id, nil)
-	configBytes, err := json.Marshal(config)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !checkConfig(w, pcDownloader.ctx, &config) {
 		return
 	}
-	_, err = datastore.Put(pcDownloader.ctx, configKey, &ConfigRecord{Config: configBytes})
 
+	err = saveConfig(pcDownloader.ctx, id, &config, pcDownloader.personId, pcDownloader.personName)
+	if err == errConfigChanged {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -261,6 +425,9 @@ func SaveConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params
 
 func SaveOverrides(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
 
 	defer r.Body.Close()
 
@@ -272,357 +439,1322 @@ func SaveOverrides(w http.ResponseWriter, r *http.Request, params httprouter.Par
 		return
 	}
 
-	overridesMap := make(map[string]Section)
+	now := time.Now()
+	var overrideSet *OverrideSet
+	var changes []OverrideChange
 
-	for _, override := range overrides.Overrides {
-		key := strings.ToLower(fmt.Sprintf("%s-%s-%s", override.KeyFirstName, override.KeyLastName, override.KeyBirthday))
-		overridesMap[key] = override
-	}
+	err = datastore.RunInTransaction(pcDownloader.ctx, func(ctx context.Context) (err error) {
+		stored, err := loadOverrides(ctx)
+		if err != nil {
+			return err
+		}
+
+		overrideSet = &OverrideSet{People: make(map[string]Override), Pending: make(map[string]Override)}
+		changes = nil
+
+		// Old overrides the editor hasn't given a person ID stay pending
+		// under their old key; anything with neither is dropped.
+		for _, override := range overrides.Overrides {
+			override.PersonId = strings.TrimSpace(override.PersonId)
+
+			before, ok := stored.People[override.PersonId]
+			if !ok {
+				before = stored.Pending[override.LegacyKey]
+			}
+
+			// A member may have changed their choices since the editor
+			// loaded; saving over them would lose that.
+			if before.Updated.After(override.Updated) {
+				return errOverridesChanged
+			}
+			override = keepSources(before, override)
+
+			if override.PersonId != "" {
+				override.LegacyKey = ""
+				if c := overrideChanges(before, override, pcDownloader.personId, changeByStaff, now); len(c) > 0 {
+					override.Updated = now
+					override.UpdatedBy = pcDownloader.personId
+					changes = append(changes, c...)
+				}
+				overrideSet.People[override.PersonId] = override
+			} else if override.LegacyKey != "" {
+				overrideSet.Pending[override.LegacyKey] = override
+			}
+		}
+
+		for personId, before := range stored.People {
+			if _, ok := overrideSet.People[personId]; !ok {
+				// Added or changed by someone else after the editor loaded,
+				// so it isn't missing because this editor deleted it.
+				if before.Updated.After(overrides.Loaded) {
+					return errOverridesChanged
+				}
+				changes = append(changes, overrideChanges(before, Override{PersonId: personId}, pcDownloader.personId, changeByStaff, now)...)
+			}
+		}
+
+		err = saveOverrides(ctx, overrideSet, pcDownloader.revision(changeByStaff))
+		if err != nil {
+			return err
+		}
 
-	overrideBytes, err := json.Marshal(overridesMap)
+		return saveOverrideChanges(ctx, changes)
+	}, &datastore.TransactionOptions{XG: true})
+	if err == errOverridesChanged {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	overridesKey := datastore.NewKey(pcDownloader.ctx, "Overrides", "", 1, nil)
-	_, err = datastore.Put(pcDownloader.ctx, overridesKey, &OverridesRecord{Overrides: overrideBytes})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoadedOverrides{overrideSet, now})
+}
+
+func GetOverrides(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
 
+	loaded := time.Now()
+	overrideSet, err := loadOverrides(pcDownloader.ctx)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if r.FormValue("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=overrides.csv")
+		err = writeOverridesCSV(w, overrideSet)
+		if err != nil {
+			log.Errorf(pcDownloader.ctx, "error writing overrides CSV: %s\n", err)
+		}
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(overridesMap)
+	json.NewEncoder(w).Encode(LoadedOverrides{overrideSet, loaded})
 }
 
-func GetOverrides(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	pcDownloader := getSession(w, r)
+// writeEditResult answers an override edit: 422 when the edit was invalid,
+// 409 when it was refused because an override changed since it was loaded.
+func writeEditResult(w http.ResponseWriter, result OverrideEditResult, err error) {
+	code := http.StatusOK
+	if err == errOverridesChanged {
+		code = http.StatusConflict
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if len(result.Errors) > 0 {
+		code = http.StatusUnprocessableEntity
+	}
 
-	var overrides map[string]Section
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(result)
+}
 
-	overrideRecord := OverridesRecord{}
-	overrideKey := datastore.NewKey(pcDownloader.ctx, "Overrides", "", 1, nil)
-	err := datastore.Get(pcDownloader.ctx, overrideKey, &overrideRecord)
-	if err != nil {
-		log.Warningf(pcDownloader.ctx, "error pulling overrides: %s\n", err)
+// PatchOverrides adds, changes and deletes many overrides at once, from a
+// JSON list of patches or, with Content-Type text/csv, a spreadsheet.
+func PatchOverrides(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
 	}
-	if overrideRecord.Overrides != nil {
-		err := json.Unmarshal(overrideRecord.Overrides, &overrides)
+
+	defer r.Body.Close()
+
+	var patches []OverridePatch
+	var rows []int
+	revision := pcDownloader.revision(changeByStaff)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		revision.Source = revisionImport
+		var errs []OverrideError
+		patches, rows, errs = readOverridesCSV(r.Body)
+		if len(errs) > 0 {
+			writeEditResult(w, OverrideEditResult{Errors: errs}, nil)
+			return
+		}
+	} else {
+		err := json.NewDecoder(r.Body).Decode(&patches)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		for i := range patches {
+			rows = append(rows, i+1)
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(overrides)
+	result, err := applyOverridePatches(pcDownloader.ctx, patches, rows, revision)
+	writeEditResult(w, result, err)
 }
 
-func CreatePDF(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+// PutOverride replaces one person's override.
+func PutOverride(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
 
 	defer r.Body.Close()
 
-	decoder := json.NewDecoder(r.Body)
-	var config Config
-	err := decoder.Decode(&config)
+	var override Override
+	err := json.NewDecoder(r.Body).Decode(&override)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	override.PersonId = params.ByName("id")
 
-	w.Header().Set("Content-Type", "application/json")
-	postValues := url.Values{}
-	configJson, err := json.Marshal(config)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	result, err := applyOverridePatches(pcDownloader.ctx, []OverridePatch{replacePatch(override, &override.Updated)}, []int{1}, pcDownloader.revision(changeByStaff))
+	writeEditResult(w, result, err)
+}
+
+// PatchOverride changes only the parts of one person's override given.
+func PatchOverride(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
 	}
 
-	id := time.Now().Unix()
+	defer r.Body.Close()
 
-	postValues.Set("config", string(configJson))
-	postValues.Set("token", pcDownloader.token)
-	postValues.Set("domain", pcDownloader.domain)
-	postValues.Set("fileId", fmt.Sprintf("%d", id))
+	var patch OverridePatch
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	patch.PersonId = params.ByName("id")
+	patch.Delete = false
 
-	t := taskqueue.NewPOSTTask("/api/v1/workers/pdf", postValues)
-	if _, err := taskqueue.Add(pcDownloader.ctx, t, ""); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	result, err := applyOverridePatches(pcDownloader.ctx, []OverridePatch{patch}, []int{1}, pcDownloader.revision(changeByStaff))
+	writeEditResult(w, result, err)
+}
+
+// DeleteOverride removes one person's override. ?updated= refuses the delete
+// when it changed after that time.
+func DeleteOverride(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
 		return
 	}
 
-	statusKey := datastore.NewKey(pcDownloader.ctx, "Status", "", id, nil)
-	_, err = datastore.Put(pcDownloader.ctx, statusKey, &StatusRecord{})
-	if err != nil {
-		log.Errorf(pcDownloader.ctx, "error saving status: %s\n", err)
+	patch := OverridePatch{PersonId: params.ByName("id"), Delete: true}
+	if updated := r.FormValue("updated"); updated != "" {
+		t, err := time.Parse(time.RFC3339Nano, updated)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		patch.Updated = &t
 	}
 
-	fmt.Fprintf(w, "{\"id\":\"%d\"}", id)
-	return
+	result, err := applyOverridePatches(pcDownloader.ctx, []OverridePatch{patch}, []int{1}, pcDownloader.revision(changeByStaff))
+	writeEditResult(w, result, err)
 }
 
-func PDFWorker(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	ctx := appengine.NewContext(r)
-	domain := r.FormValue("domain")
-	token := r.FormValue("token")
-	fileId := r.FormValue("fileId")
+func GetOverrideChanges(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
 
-	ctx, err := appengine.Namespace(ctx, domain)
+	changes, err := loadOverrideChanges(pcDownloader.ctx, params.ByName("id"), 100)
 	if err != nil {
-		log.Criticalf(ctx, "Failed to set namespace: %s\n", err)
-		http.Error(w, "", http.StatusForbidden)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	decoder := json.NewDecoder(strings.NewReader(r.FormValue("config")))
-	var config Config
-	err = decoder.Decode(&config)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+func GetOverrideRevisions(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	revisions, err := loadRevisions(pcDownloader.ctx, 50)
 	if err != nil {
-		log.Criticalf(ctx, "Failed to decode json: %s\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	pcDownloader := PCDownloader{
-		token:         token,
-		domain:        domain,
-		credentialUrl: credentialUrl,
-		profileUrl:    profileUrl,
-		listUrl:       listUrl,
-		peopleUrl:     peopleUrl,
-		fieldUrl:      fieldUrl,
-		ctx:           ctx,
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// GetOverrideRevision returns a revision with what changed in it, or with
+// ?against= what changed since another revision.
+func GetOverrideRevision(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
 	}
 
-	err = generatePDF(&config, pcDownloader, fileId)
-	errStr := ""
+	number, err := strconv.ParseInt(params.ByName("rev"), 10, 64)
 	if err != nil {
-		errStr = err.Error()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	id, _ := strconv.ParseInt(fileId, 10, 64)
+	against := int64(-1)
+	if r.FormValue("against") != "" {
+		against, err = strconv.ParseInt(r.FormValue("against"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	statusKey := datastore.NewKey(ctx, "Status", "", id, nil)
-	_, keyErr := datastore.Put(ctx, statusKey, &StatusRecord{Done: true, Error: errStr})
-	if keyErr != nil {
-		log.Errorf(ctx, "error saving status: %s\n", keyErr)
-		http.Error(w, keyErr.Error(), http.StatusInternalServerError)
+	detail, err := loadRevisionDetail(pcDownloader.ctx, number, against)
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "no such revision", http.StatusNotFound)
 		return
 	}
-
 	if err != nil {
-		log.Errorf(ctx, "error generating PDF: %s\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	return
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
 }
 
-func CheckPDF(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+// RestoreOverrideRevision saves an earlier revision's overrides as a new
+// revision, so the restore can itself be undone.
+func RestoreOverrideRevision(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
 
-	id, _ := strconv.ParseInt(params.ByName("id"), 10, 64)
+	number, err := strconv.ParseInt(params.ByName("rev"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	statusRecord := StatusRecord{}
-	statusKey := datastore.NewKey(pcDownloader.ctx, "Status", "", id, nil)
-	err := datastore.Get(pcDownloader.ctx, statusKey, &statusRecord)
+	restored, err := restoreRevision(pcDownloader.ctx, number, pcDownloader.revision(revisionRestore))
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "no such revision", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Criticalf(pcDownloader.ctx, "error pulling status %s: %s\n", params.ByName("id"), err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if statusRecord.Error != "" {
-		http.Error(w, statusRecord.Error, http.StatusInternalServerError)
-		return
-	} else if !statusRecord.Done {
-		w.WriteHeader(http.StatusNoContent)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoadedOverrides{restored, time.Now()})
+}
+
+func MemberPortal(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	pcDownloader := getMemberSession(w, r)
+	if pcDownloader.token == "" {
 		return
-	} else {
-		err := datastore.Delete(pcDownloader.ctx, statusKey)
-		if err != nil {
-			log.Criticalf(pcDownloader.ctx, "error deleting status %s: %s\n", params.ByName("id"), err)
-		}
-		w.WriteHeader(http.StatusOK)
+	}
+
+	t, _ := template.ParseFiles("js_app/me.html")
+	err := t.Execute(w, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func GetPDF(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	pcDownloader := getSession(w, r)
-
-	id, _ := strconv.ParseInt(params.ByName("id"), 10, 64)
+func GetMemberPreferences(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getMemberSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	//w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=directory-%d.pdf", id))
-	//streamPDF(pcDownloader.ctx, fmt.Sprintf("%s/pdfs/directory-%d.pdf", pcDownloader.domain, id), w)
+	prefs, err := loadMemberPreferences(pcDownloader.ctx, pcDownloader.personId, pcDownloader.personName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	url := generateSignedURL(pcDownloader.ctx, fmt.Sprintf("%s/pdfs/directory-%d.pdf", pcDownloader.domain, id))
-	fmt.Fprint(w, url)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
 }
 
-func GetConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	pcDownloader := getSession(w, r)
-
-	id, _ := strconv.ParseInt(params.ByName("id"), 10, 64)
+func SaveMemberPreferences(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getMemberSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
 
-	config := Config{}
+	defer r.Body.Close()
 
-	if pcDownloader.domain == "458648" {
-		sections := make([]Section, 9)
-		sections[0].Show = true
-		sections[0].Phones = true
-		sections[0].PhoneCount = 1
-		sections[0].Email = true
-		sections[0].Address = true
-		sections[0].DateJoined = false
-		sections[0].Birthday = false
-		sections[0].City = true
-		sections[0].State = true
-		sections[0].PostalCode = true
-		sections[0].Country = true
-		sections[0].NewMemberFootnote = false
-		sections[0].BaptismFootnote = false
-		sections[0].Header = "Hinson Memorial Baptist Church"
-		sections[0].ListName = "Directory Test"
-
-		sections[1].Show = false
-		sections[1].Phones = true
-		sections[1].PhoneCount = 2
-		sections[1].Email = true
-		sections[1].Address = true
-		sections[1].DateJoined = true
-		sections[1].Birthday = true
-		sections[1].City = true
-		sections[1].State = true
-		sections[1].PostalCode = true
-		sections[1].Country = true
-		sections[1].NewMemberFootnote = true
-		sections[1].BaptismFootnote = true
-		sections[1].Header = "Members In-Area and Unable to Attend"
-		sections[1].ListName = "Members In-Area and Unable to Attend"
-		sections[1].Children = true
-
-		sections[2].Show = false
-		sections[2].Phones = true
-		sections[2].PhoneCount = 2
-		sections[2].Email = true
-		sections[2].Address = true
-		sections[2].DateJoined = true
-		sections[2].Birthday = true
-		sections[2].City = true
-		sections[2].State = true
-		sections[2].PostalCode = true
-		sections[2].Country = true
-		sections[2].NewMemberFootnote = true
-		sections[2].BaptismFootnote = true
-		sections[2].Header = "Members Out of Area"
-		sections[2].ListName = "Members Out of Area"
-
-		sections[3].Show = true
-		sections[3].Age = true
-		sections[3].Birthday = true
-		sections[3].Header = "Hinson Children"
-
-		sections[4].Show = false
-		sections[4].Phones = true
-		sections[4].PhoneCount = 1
-		sections[4].Email = true
-		sections[4].Address = true
-		sections[4].City = true
-		sections[4].State = true
-		sections[4].PostalCode = true
-		sections[4].Country = true
-		sections[4].Occupation = true
-		sections[4].Header = "Supported Workers--Overseas"
-		sections[4].ListName = "Supported Workers--Overseas"
-
-		sections[5].Show = false
-		sections[5].Phones = true
-		sections[5].PhoneCount = 1
-		sections[5].Email = true
-		sections[5].Address = true
-		sections[5].City = true
-		sections[5].State = true
-		sections[5].PostalCode = true
-		sections[5].Country = true
-		sections[5].Occupation = true
-		sections[5].Header = "Supported Workers--Domestic"
-		sections[5].ListName = "Supported Workers--Domestic"
-
-		sections[6].Show = false
-		sections[6].Phones = true
-		sections[6].PhoneCount = 1
-		sections[6].Email = true
-		sections[6].Address = true
-		sections[6].City = true
-		sections[6].State = true
-		sections[6].PostalCode = true
-		sections[6].Country = true
-		sections[6].JobTitle = true
-		sections[6].Employer = true
-		sections[6].Header = "Pastors Sent Out from CBC"
-		sections[6].ListName = "Pastors Sent Out from CBC"
-
-		sections[7].Show = false
-		sections[7].Phones = true
-		sections[7].PhoneCount = 1
-		sections[7].Email = true
-		sections[7].Address = true
-		sections[7].City = true
-		sections[7].State = true
-		sections[7].PostalCode = true
-		sections[7].Country = true
-		sections[7].School = true
-		sections[7].Header = "CBC Seminary Report"
-		sections[7].ListName = "CBC Seminary Report"
-
-		sections[8].Show = true
-		sections[8].Header = "Membership by First Name"
-		sections[8].Columns = 3
-
-		config = Config{
-			Id:               id,
-			PageSize:         "Letter",
-			FontFamily:       "Arial",
-			TopMargin:        6,
-			BottomMargin:     6,
-			LeftMargin:       4,
-			RightMargin:      4,
-			Padding:          8,
-			ImagePadding:     4,
-			NumberOfColumns:  3,
-			ColumnHeight:     22,
-			LineHeight:       3.0,
-			FontSize:         7.0,
-			HighlightOpacity: 0.06,
-			Gutter:           4,
-			Sections:         sections,
-		}
+	decoder := json.NewDecoder(r.Body)
+	var shown map[string]bool
+	err := decoder.Decode(&shown)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	configRecord := ConfigRecord{}
-	configKey := datastore.NewKey(pcDownloader.ctx, "Config", "", id, nil)
-	err := datastore.Get(pcDownloader.ctx, configKey, &configRecord)
+	prefs, err := saveMemberChoices(pcDownloader.ctx, pcDownloader.personId, pcDownloader.personName, shown)
+	if err == errNoPersonId {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		log.Warningf(pcDownloader.ctx, "error pulling config %s: %s\n", params.ByName("id"), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	if configRecord.Config != nil {
-		err := json.Unmarshal(configRecord.Config, &config)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+func GetMemberPreview(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getMemberSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	id, err := defaultConfigId(pcDownloader.ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	config := Config{}
+	err = loadConfig(pcDownloader.ctx, id, &config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// What's wrong with the config is for staff to fix, so members are only
+	// told there's a problem.
+	if errs := configErrors(pcDownloader.ctx, &config); len(errs) > 0 {
+		log.Errorf(pcDownloader.ctx, "Default config %d has errors: %v\n", id, errs)
+		http.Error(w, "the directory's settings need fixing before a preview can be shown; please let the church office know", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// The PDF is built in memory so an error can still be reported.
+	var preview bytes.Buffer
+	err = writeMemberPreview(&config, pcDownloader, &preview)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	preview.WriteTo(w)
+}
+
+func CreatePDF(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	defer r.Body.Close()
+
+	decoder := json.NewDecoder(r.Body)
+	var config Config
+	err := decoder.Decode(&config)
+	if err != nil {
+		writeConfigErrors(w, decodeErrors(err))
+		return
+	}
+	if !checkConfig(w, pcDownloader.ctx, &config) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	postValues := url.Values{}
+	configJson, err := json.Marshal(config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
+	id := time.Now().Unix()
+
+	postValues.Set("config", string(configJson))
+	postValues.Set("token", pcDownloader.token)
+	postValues.Set("domain", pcDownloader.domain)
+	postValues.Set("fileId", fmt.Sprintf("%d", id))
+	postValues.Set("preflight", r.URL.Query().Get("preflight"))
+	if appengine.IsDevAppServer() {
+		postValues.Set("fixture", r.URL.Query().Get("fixture"))
+	}
+
+	t := taskqueue.NewPOSTTask("/api/v1/workers/pdf", postValues)
+	if _, err := taskqueue.Add(pcDownloader.ctx, t, ""); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	statusKey := datastore.NewKey(pcDownloader.ctx, "Status", "", id, nil)
+	_, err = datastore.Put(pcDownloader.ctx, statusKey, &StatusRecord{})
+	if err != nil {
+		log.Errorf(pcDownloader.ctx, "error saving status: %s\n", err)
+	}
+
+	fmt.Fprintf(w, "{\"id\":\"%d\"}", id)
+	return
+}
+
+// PreviewPDF renders the first page or two of one section of the posted
+// config as a PNG, from cached list data or a fixture, without starting a
+// PDF job.
+func PreviewPDF(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	defer r.Body.Close()
+
+	var config Config
+	err := json.NewDecoder(r.Body).Decode(&config)
+	if err != nil {
+		writeConfigErrors(w, decodeErrors(err))
+		return
+	}
+	if !checkConfig(w, pcDownloader.ctx, &config) {
+		return
+	}
+
+	section := 0
+	if r.FormValue("section") != "" {
+		section, err = strconv.Atoi(r.FormValue("section"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	pages := 1
+	if r.FormValue("pages") != "" {
+		pages, err = strconv.Atoi(r.FormValue("pages"))
+		if err != nil || pages < 1 || pages > maxPreviewPages {
+			http.Error(w, fmt.Sprintf("pages must be 1 to %d", maxPreviewPages), http.StatusBadRequest)
+			return
 		}
 	}
 
+	pcDownloader.fixture = r.FormValue("fixture")
+
+	pdf, err := writePreview(&config, pcDownloader, section, pages)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	images, err := rasterizePDF(pdf, pages, previewDPI)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The image is encoded in memory so an error can still be reported.
+	var preview bytes.Buffer
+	err = png.Encode(&preview, stackPages(images))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	preview.WriteTo(w)
+}
+
+func PDFWorker(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(r)
+	domain := r.FormValue("domain")
+	token := r.FormValue("token")
+	fileId := r.FormValue("fileId")
+
+	ctx, err := appengine.Namespace(ctx, domain)
+	if err != nil {
+		log.Criticalf(ctx, "Failed to set namespace: %s\n", err)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(r.FormValue("config")))
+	var config Config
+	err = decoder.Decode(&config)
+	if err != nil {
+		log.Criticalf(ctx, "Failed to decode json: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pcDownloader := &PCDownloader{
+		token:         token,
+		domain:        domain,
+		credentialUrl: credentialUrl,
+		profileUrl:    profileUrl,
+		listUrl:       listUrl,
+		peopleUrl:     peopleUrl,
+		fieldUrl:      fieldUrl,
+		fixture:       r.FormValue("fixture"),
+		ctx:           ctx,
+	}
+
+	err = generatePDF(&config, pcDownloader, fileId, r.FormValue("preflight") == "true")
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	id, _ := strconv.ParseInt(fileId, 10, 64)
+
+	statusKey := datastore.NewKey(ctx, "Status", "", id, nil)
+	_, keyErr := datastore.Put(ctx, statusKey, &StatusRecord{Done: true, Error: errStr})
+	if keyErr != nil {
+		log.Errorf(ctx, "error saving status: %s\n", keyErr)
+		http.Error(w, keyErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err != nil {
+		log.Errorf(ctx, "error generating PDF: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+func CheckPDF(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	id, _ := strconv.ParseInt(params.ByName("id"), 10, 64)
+
+	statusRecord := StatusRecord{}
+	statusKey := datastore.NewKey(pcDownloader.ctx, "Status", "", id, nil)
+	err := datastore.Get(pcDownloader.ctx, statusKey, &statusRecord)
+	if err != nil {
+		log.Criticalf(pcDownloader.ctx, "error pulling status %s: %s\n", params.ByName("id"), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if statusRecord.Error != "" {
+		http.Error(w, statusRecord.Error, http.StatusInternalServerError)
+		return
+	} else if !statusRecord.Done {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else {
+		err := datastore.Delete(pcDownloader.ctx, statusKey)
+		if err != nil {
+			log.Criticalf(pcDownloader.ctx, "error deleting status %s: %s\n", params.ByName("id"), err)
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+}
+
+func GetPDF(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	id, _ := strconv.ParseInt(params.ByName("id"), 10, 64)
+
+	w.Header().Set("Content-Type", "text/plain")
+	//w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=directory-%d.pdf", id))
+	//streamPDF(pcDownloader.ctx, fmt.Sprintf("%s/pdfs/directory-%d.pdf", pcDownloader.domain, id), w)
+
+	url := generateSignedURL(pcDownloader.ctx, fmt.Sprintf("%s/pdfs/directory-%d.pdf", pcDownloader.domain, id))
+	fmt.Fprint(w, url)
+}
+
+func GetReport(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	id, _ := strconv.ParseInt(params.ByName("id"), 10, 64)
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = reportFormatHTML
+	}
+	if _, ok := reportFormats[format]; !ok {
+		http.Error(w, fmt.Sprintf("unknown report format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	url := generateSignedURL(pcDownloader.ctx, reportFileName(pcDownloader.domain, strconv.FormatInt(id, 10), format))
+	fmt.Fprint(w, url)
+}
+
+func GetConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	id, _ := strconv.ParseInt(params.ByName("id"), 10, 64)
+
+	config, err := organizationPreset(pcDownloader.domain)
+	if err != nil {
+		log.Warningf(pcDownloader.ctx, "error loading presets: %s\n", err)
+	}
+	config.Id = id
+
+	if version := r.FormValue("version"); version != "" {
+		number, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = loadConfigVersion(pcDownloader.ctx, id, number, &config)
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(w, "no such version", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		err = loadConfig(pcDownloader.ctx, id, &config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	defaultId, err := defaultConfigId(pcDownloader.ctx)
+	if err != nil {
+		log.Warningf(pcDownloader.ctx, "error pulling default config: %s\n", err)
+	}
+	config.Default = id == defaultId
+
+	config.AvailableFonts, err = availableFonts(pcDownloader.ctx)
+	if err != nil {
+		log.Warningf(pcDownloader.ctx, "error listing fonts: %s\n", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+// loadConfig reads a saved config over config. A config that was never
+// saved leaves it as it is.
+func loadConfig(ctx context.Context, id int64, config *Config) (err error) {
+	configRecord := ConfigRecord{}
+	err = datastore.Get(ctx, configKey(ctx, id), &configRecord)
+	if err != nil {
+		log.Warningf(ctx, "error pulling config %d: %s\n", id, err)
+	}
+	if configRecord.Config != nil {
+		err = json.Unmarshal(configRecord.Config, config)
+	} else {
+		err = nil
+	}
+	config.Id = id
+	config.Name = configName(id, configRecord.Name)
+	config.Version = configRecord.Version
+
+	return err
+}
+
+// checkConfig answers 422 with everything wrong with the config, and
+// reports whether it passed.
+func checkConfig(w http.ResponseWriter, ctx context.Context, config *Config) bool {
+	errs := configErrors(ctx, config)
+	if len(errs) > 0 {
+		writeConfigErrors(w, errs)
+		return false
+	}
+
+	return true
+}
+
+// configErrors validates the config against the organization's fonts and
+// themes.
+func configErrors(ctx context.Context, config *Config) []ConfigError {
+	fonts, err := availableFonts(ctx)
+	if err != nil {
+		log.Warningf(ctx, "error listing fonts: %s\n", err)
+		fonts = nil
+	}
+
+	themes, err := listThemes(ctx)
+	if err != nil {
+		log.Warningf(ctx, "error listing themes: %s\n", err)
+		themes = nil
+	}
+
+	return validateConfig(config, fonts, themes)
+}
+
+func writeConfigErrors(w http.ResponseWriter, errs []ConfigError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(ConfigErrors{errs})
+}
+
+// decodeErrors explains a config that isn't even the right shape, naming
+// the field when the decoder does.
+func decodeErrors(err error) []ConfigError {
+	typeErr, ok := err.(*json.UnmarshalTypeError)
+	if !ok {
+		return []ConfigError{{Message: err.Error()}}
+	}
+
+	message := "must be " + typeName(typeErr.Type)
+	if typeErr.Value == "number" && typeName(typeErr.Type) == "a number" {
+		message = `must be a number in quotes, like "3"`
+	}
+
+	return []ConfigError{{Field: typeErr.Field, Message: message}}
+}
+
+// GetConfigSchema publishes the JSON Schema configs are checked against.
+func GetConfigSchema(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	json.NewEncoder(w).Encode(configSchema())
+}
+
+func GetConfigs(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	configs, err := listConfigs(pcDownloader.ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(configs)
+}
+
+func GetConfigPresets(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	presets, err := loadPresets()
+	if err != nil {
+		log.Errorf(pcDownloader.ctx, "error loading presets: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presets)
+}
+
+// CreateConfig saves a new config from a preset, or a blank one when no
+// preset is given.
+func CreateConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	defer r.Body.Close()
+
+	var newConfig NewConfig
+	err := json.NewDecoder(r.Body).Decode(&newConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config := Config{}
+	if newConfig.Preset != "" {
+		preset, err := loadPreset(newConfig.Preset)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		config = preset.Config
+		if newConfig.Name == "" {
+			newConfig.Name = preset.Name
+		}
+	}
+	config.Name = newConfig.Name
+	if !checkConfig(w, pcDownloader.ctx, &config) {
+		return
+	}
+
+	_, err = createConfig(pcDownloader.ctx, &config, pcDownloader.personId, pcDownloader.personName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+// CloneConfig saves a copy of a config, or of one of its versions with
+// ?version=, under a new ID.
+func CloneConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	id, _ := strconv.ParseInt(params.ByName("id"), 10, 64)
+
+	defer r.Body.Close()
+
+	var newConfig NewConfig
+	err := json.NewDecoder(r.Body).Decode(&newConfig)
+	if err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config := Config{}
+	if version := r.FormValue("version"); version != "" {
+		number, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = loadConfigVersion(pcDownloader.ctx, id, number, &config)
+	} else {
+		err = datastore.Get(pcDownloader.ctx, configKey(pcDownloader.ctx, id), &ConfigRecord{})
+		if err == nil {
+			err = loadConfig(pcDownloader.ctx, id, &config)
+		}
+	}
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "no such config", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if newConfig.Name == "" {
+		newConfig.Name = "Copy of " + config.Name
+	}
+	config.Name = newConfig.Name
+	if !checkConfig(w, pcDownloader.ctx, &config) {
+		return
+	}
+
+	_, err = createConfig(pcDownloader.ctx, &config, pcDownloader.personId, pcDownloader.personName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(config)
 }
 
+// SetDefaultConfig marks the config everyone starts with, which also lays
+// out the member portal preview.
+func SetDefaultConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	id, _ := strconv.ParseInt(params.ByName("id"), 10, 64)
+
+	err := setDefaultConfig(pcDownloader.ctx, id)
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "save the config before making it the default", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	configs, err := listConfigs(pcDownloader.ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(configs)
+}
+
+func GetConfigVersions(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	id, _ := strconv.ParseInt(params.ByName("id"), 10, 64)
+
+	versions, err := loadConfigVersions(pcDownloader.ctx, id, 50)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// GetConfigDiff lists the settings changed from version ?from= to version
+// ?to=. to defaults to the saved config and from to the version before to.
+func GetConfigDiff(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	id, _ := strconv.ParseInt(params.ByName("id"), 10, 64)
+
+	to := Config{}
+	err := loadConfig(pcDownloader.ctx, id, &to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	toVersion, fromVersion := to.Version, to.Version-1
+	if r.FormValue("to") != "" {
+		toVersion, err = strconv.ParseInt(r.FormValue("to"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fromVersion = toVersion - 1
+	}
+	if r.FormValue("from") != "" {
+		fromVersion, err = strconv.ParseInt(r.FormValue("from"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if fromVersion < 0 {
+		http.Error(w, "no earlier version", http.StatusNotFound)
+		return
+	}
+
+	from := Config{}
+	err = loadConfigVersion(pcDownloader.ctx, id, fromVersion, &from)
+	if err == nil && toVersion != to.Version {
+		to = Config{}
+		err = loadConfigVersion(pcDownloader.ctx, id, toVersion, &to)
+	}
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "no such version", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	changes, err := diffConfigs(&from, &to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+func GetThemes(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	themes, err := listThemes(pcDownloader.ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(themes)
+}
+
+func GetTheme(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	theme, err := loadTheme(pcDownloader.ctx, params.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(theme)
+}
+
+// SaveTheme saves one of the organization's themes under the ID in the
+// path, checking it like a config.
+func SaveTheme(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	defer r.Body.Close()
+
+	var theme Theme
+	err := json.NewDecoder(r.Body).Decode(&theme)
+	if err != nil {
+		writeConfigErrors(w, decodeErrors(err))
+		return
+	}
+	theme.Id = params.ByName("id")
+
+	if isBuiltinTheme(theme.Id) {
+		http.Error(w, fmt.Sprintf("%q is a built-in theme; save it under another ID", theme.Id), http.StatusConflict)
+		return
+	}
+
+	fonts, err := availableFonts(pcDownloader.ctx)
+	if err != nil {
+		log.Warningf(pcDownloader.ctx, "error listing fonts: %s\n", err)
+		fonts = nil
+	}
+	if errs := validateTheme(&theme, fonts); len(errs) > 0 {
+		writeConfigErrors(w, errs)
+		return
+	}
+
+	err = saveTheme(pcDownloader.ctx, &theme, pcDownloader.personName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(theme)
+}
+
+func DeleteTheme(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	if isBuiltinTheme(params.ByName("id")) {
+		http.Error(w, fmt.Sprintf("%q is a built-in theme", params.ByName("id")), http.StatusConflict)
+		return
+	}
+
+	err := deleteTheme(pcDownloader.ctx, params.ByName("id"))
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func GetFonts(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	families, err := loadOrgFonts(pcDownloader.ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	available, err := availableFonts(pcDownloader.ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Available    []string     `json:"available"`
+		Organization []FontFamily `json:"organization"`
+	}{available, families})
+}
+
+func UploadFont(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	err := r.ParseMultipartForm(maxFontSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer upload.Close()
+
+	contents, err := ioutil.ReadAll(upload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	family, err := storeOrgFont(pcDownloader.ctx, pcDownloader.domain, strings.TrimSpace(r.FormValue("family")), r.FormValue("style"), contents)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(family)
+}
+
+func DeleteFont(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	err := deleteOrgFont(pcDownloader.ctx, params.ByName("family"))
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "no such font family", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func UploadHouseholdPhotos(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	err := r.ParseMultipartForm(maxHouseholdPhotoSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]PhotoUploadResult, 0)
+
+	for _, header := range r.MultipartForm.File["photos"] {
+		result := PhotoUploadResult{File: header.Filename}
+
+		result.HouseholdId, err = storeHouseholdPhotoUpload(pcDownloader.ctx, pcDownloader.domain, header)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func DeleteHouseholdPhoto(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	householdId, err := householdIdFromFile(params.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = deleteHouseholdPhoto(pcDownloader.ctx, pcDownloader.domain, householdId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func UploadPlaceholder(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	err := r.ParseMultipartForm(maxHouseholdPhotoSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer upload.Close()
+
+	contents, err := ioutil.ReadAll(upload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = storePhoto(pcDownloader.ctx, pcDownloader.domain, placeholderObject(pcDownloader.domain), contents)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func DeletePlaceholder(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pcDownloader := getSession(w, r)
+	if pcDownloader.token == "" {
+		return
+	}
+
+	err := deletePhoto(pcDownloader.ctx, pcDownloader.domain, placeholderObject(pcDownloader.domain))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func init() {
 	sessionStore.SetMaxAge(30 * 24 * 3600)
 	router := httprouter.New()
@@ -632,15 +1764,53 @@ func init() {
 
 	router.GET("/api/v1/authorize", Authorize)
 
+	router.GET("/api/v1/configs", GetConfigs)
+	router.POST("/api/v1/configs", CreateConfig)
 	router.GET("/api/v1/configs/:id", GetConfig)
 	router.POST("/api/v1/configs/:id", SaveConfig)
+	router.POST("/api/v1/configs/:id/clone", CloneConfig)
+	router.POST("/api/v1/configs/:id/default", SetDefaultConfig)
+	router.GET("/api/v1/configs/:id/versions", GetConfigVersions)
+	router.GET("/api/v1/configs/:id/diff", GetConfigDiff)
+	router.GET("/api/v1/config-presets", GetConfigPresets)
+	router.GET("/api/v1/config-schema", GetConfigSchema)
 
 	router.POST("/api/v1/pdf", CreatePDF)
+	router.POST("/api/v1/preview", PreviewPDF)
 	router.GET("/api/v1/status/:id", CheckPDF)
 	router.GET("/api/v1/pdf/:id", GetPDF)
+	router.GET("/api/v1/reports/:id", GetReport)
 
 	router.POST("/api/v1/overrides", SaveOverrides)
 	router.GET("/api/v1/overrides", GetOverrides)
+	router.PATCH("/api/v1/overrides", PatchOverrides)
+	router.PUT("/api/v1/overrides/:id", PutOverride)
+	router.PATCH("/api/v1/overrides/:id", PatchOverride)
+	router.DELETE("/api/v1/overrides/:id", DeleteOverride)
+	router.GET("/api/v1/overrides/:id/changes", GetOverrideChanges)
+	router.GET("/api/v1/override-revisions", GetOverrideRevisions)
+	router.GET("/api/v1/override-revisions/:rev", GetOverrideRevision)
+	router.POST("/api/v1/override-revisions/:rev/restore", RestoreOverrideRevision)
+
+	router.GET(memberPath, MemberPortal)
+	router.GET("/api/v1/me", GetMemberPreferences)
+	router.POST("/api/v1/me", SaveMemberPreferences)
+	router.GET("/api/v1/me/preview", GetMemberPreview)
+
+	router.GET("/api/v1/themes", GetThemes)
+	router.GET("/api/v1/themes/:id", GetTheme)
+	router.POST("/api/v1/themes/:id", SaveTheme)
+	router.DELETE("/api/v1/themes/:id", DeleteTheme)
+
+	router.GET("/api/v1/fonts", GetFonts)
+	router.POST("/api/v1/fonts", UploadFont)
+	router.DELETE("/api/v1/fonts/:family", DeleteFont)
+
+	router.POST("/api/v1/household-photos", UploadHouseholdPhotos)
+	router.DELETE("/api/v1/household-photos/:id", DeleteHouseholdPhoto)
+
+	router.POST("/api/v1/placeholder", UploadPlaceholder)
+	router.DELETE("/api/v1/placeholder", DeletePlaceholder)
 
 	router.POST("/api/v1/workers/pdf", PDFWorker)
 
@@ -2,27 +2,29 @@ package pc_pdf_generator
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
-	"image"
-	"image/jpeg"
 	"io"
-	"math"
 	"sort"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
-	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/file"
 	"google.golang.org/appengine/log"
 
 	"github.com/jung-kurt/gofpdf"
-	"github.com/nfnt/resize"
 	"github.com/pariz/gountries"
+	"golang.org/x/image/font/sfnt"
 	"golang.org/x/net/context"
+	"golang.org/x/text/collate"
 )
 
+// childrenRuleInset is how far left of a children column's edge the rule
+// before it runs: midway between the previous column's household rules,
+// which stop 7mm short of the edge, and this column's, which start 1mm
+// before it.
+const childrenRuleInset = (7.0 + 1.0) / 2
+
 func streamPDF(ctx context.Context, fileName string, w io.Writer) (err error) {
 	bucketName, err := file.DefaultBucketName(ctx)
 	if err != nil {
@@ -77,6 +79,20 @@ func streamPDF(ctx context.Context, fileName string, w io.Writer) (err error) {
 	return err
 }
 
+func defaultBucket(ctx context.Context) (client *storage.Client, bucket *storage.BucketHandle, err error) {
+	bucketName, err := file.DefaultBucketName(ctx)
+	if err != nil {
+		return client, bucket, err
+	}
+
+	client, err = storage.NewClient(ctx)
+	if err != nil {
+		return client, bucket, err
+	}
+
+	return client, client.Bucket(bucketName), err
+}
+
 func generateSignedURL(ctx context.Context, fileName string) (url string) {
 	bucketName, err := file.DefaultBucketName(ctx)
 	if err != nil {
@@ -100,122 +116,263 @@ func generateSignedURL(ctx context.Context, fileName string) (url string) {
 	return url
 }
 
-func generatePDF(config *Config, pcDl PCDownloader, fileId string) (err error) {
+// newPdfDir sets up a PdfDir, with an empty PDF, for the config.
+func newPdfDir(config *Config, pcDl *PCDownloader, fileName string) (pdfDir *PdfDir, err error) {
 	translate, err := gofpdf.UnicodeTranslatorFromFile("iso-8859-1.map")
 	if err != nil {
-		return err
+		return pdfDir, err
 	}
 
-	fileName := fmt.Sprintf("%s/pdfs/directory-%s.pdf", pcDl.domain, fileId)
+	coreRunes, err := loadCoreRunes("iso-8859-1.map")
+	if err != nil {
+		return pdfDir, err
+	}
 
-	pdfDir := PdfDir{
-		topMargin:        config.TopMargin,
+	fallbackFonts := []string{}
+	for _, family := range strings.Split(config.FallbackFonts, ",") {
+		if strings.TrimSpace(family) != "" {
+			fallbackFonts = append(fallbackFonts, strings.TrimSpace(family))
+		}
+	}
+
+	cat, err := loadCatalog(config.Locale)
+	if err != nil {
+		return pdfDir, err
+	}
+
+	theme, err := loadTheme(pcDl.ctx, config.Theme)
+	if err != nil {
+		return pdfDir, err
+	}
+	config = theme.applyTo(config)
+
+	size, err := trimSize(config)
+	if err != nil {
+		return pdfDir, err
+	}
+
+	bleed, slug := printGeometry(config)
+
+	pdfDir = &PdfDir{
+		topMargin:        config.TopMargin + bleed + slug,
 		leftMargin:       config.LeftMargin,
-		bottomMargin:     config.BottomMargin,
+		bottomMargin:     config.BottomMargin + bleed + slug,
 		rightMargin:      config.RightMargin,
-		pageSize:         config.PageSize,
+		mirrorMargins:    config.MirrorMargins,
+		insideMargin:     config.InsideMargin,
+		outsideMargin:    config.OutsideMargin,
+		bindingGutter:    config.BindingGutter,
+		trimSize:         size,
+		orientation:      config.Orientation,
+		bleed:            bleed,
+		slug:             slug,
+		outputProfile:    config.OutputProfile,
+		minImageDPI:      minImageDPI(config),
 		colNum:           config.NumberOfColumns,
 		padding:          config.Padding,
 		gutter:           config.Gutter,
 		imagePadding:     config.ImagePadding,
 		columnHeight:     config.ColumnHeight,
-		fontFamily:       config.FontFamily,
+		headerFontFamily: fontOrDefault(config.HeaderFontFamily, config.FontFamily),
+		nameFontFamily:   fontOrDefault(config.NameFontFamily, config.FontFamily),
+		bodyFontFamily:   fontOrDefault(config.BodyFontFamily, config.FontFamily),
 		fontSize:         config.FontSize,
 		lineHeight:       config.LineHeight,
-		highlightOpacity: config.HighlightOpacity,
+		style:            theme.style(config.HighlightOpacity),
 		translate:        translate,
+		coreRunes:        coreRunes,
+		fallbackFonts:    fallbackFonts,
 		fileName:         fileName,
 		ctx:              pcDl.ctx,
 		domain:           pcDl.domain,
 		firstNameColumns: 6.0,
+		thumbnail:        thumbnailSpecFor(config),
+		placeholderStyle: config.PlaceholderStyle,
+		placeholderTints: parsePlaceholderTints(config.PlaceholderTints),
+		placeholderFont:  fontOrDefault(config.PlaceholderFont, fontOrDefault(config.NameFontFamily, config.FontFamily)),
+		minFontSize:      preflightMinFontSize(config),
+		layoutMode:       config.LayoutMode,
+		keepHouseholds:   config.KeepHouseholds,
+		collator:         newCollator(config.Locale),
+		catalog:          cat,
+		rules:            config.MarkerRules,
 	}
 
 	err = pdfDir.setupPDF()
+
+	return pdfDir, err
+}
+
+// generatePDF lays out the directory and uploads it. A preflight run only
+// lays it out, for the layout problems in its report.
+func generatePDF(config *Config, pcDl *PCDownloader, fileId string, preflight bool) (err error) {
+	fileName := fmt.Sprintf("%s/pdfs/directory-%s.pdf", pcDl.domain, fileId)
+
+	pdfDir, report, err := layoutDirectory(config, pcDl, fileName, fileId)
+	if err != nil {
+		return err
+	}
+
+	pdfDir.saveMigratedOverrides()
+
+	// The report is a by-product of the PDF, so failing to save it doesn't
+	// fail the job.
+	reportErr := report.save(pcDl.ctx, pcDl.domain)
+	if reportErr != nil {
+		log.Errorf(pcDl.ctx, "Error saving data report: %s\n", reportErr)
+	}
+
+	if config.PreflightFail && len(pdfDir.layoutIssues) > 0 {
+		return fmt.Errorf("preflight found %d layout problems; see the data report", len(pdfDir.layoutIssues))
+	}
+
+	if preflight {
+		return nil
+	}
+
+	err = pdfDir.closePDF(pcDl.ctx, fileName)
 	if err != nil {
 		return err
 	}
 
+	return err
+}
+
+// layoutDirectory lays out every section the config shows into a new PDF,
+// and reports on the data it printed. Nothing is saved.
+func layoutDirectory(config *Config, pcDl *PCDownloader, fileName string, fileId string) (pdfDir *PdfDir, report QualityReport, err error) {
+	pdfDir, err = newPdfDir(config, pcDl, fileName)
+	if err != nil {
+		return pdfDir, report, err
+	}
+	pcDl.thumbnail = pdfDir.thumbnail
+
+	report = QualityReport{FileId: fileId, Generated: time.Now()}
+
 	var members map[string]Household
 	if config.Sections[0].Show || len(config.Sections) > 3 && config.Sections[3].Show || len(config.Sections) > 8 && config.Sections[8].Show {
 		members, err = pcDl.downloadList(config.Sections[0].ListName)
 		if err != nil {
-			return err
+			return pdfDir, report, err
 		}
 	}
 
 	if config.Sections[0].Show {
 		//DisplayOptions{PhoneCount: 2, ExcludeDirSections: []string{"463631", "463630"}}
 		pdfDir.writeSection(members, config.Sections[0].Header, config.Sections[0])
+		report.addSection(pdfDir.sortHouseholds(members, config.Sections[0]), config.Sections[0])
 	}
 
 	if len(config.Sections) > 1 && config.Sections[1].Show {
 		membersInAreaUnable, err := pcDl.downloadList(config.Sections[1].ListName)
 		if err != nil {
-			return err
+			return pdfDir, report, err
 		}
 
 		pdfDir.writeSection(membersInAreaUnable, config.Sections[1].Header, config.Sections[1])
+		report.addSection(pdfDir.sortHouseholds(membersInAreaUnable, config.Sections[1]), config.Sections[1])
 	}
 
 	if len(config.Sections) > 2 && config.Sections[2].Show {
 		membersOutArea, err := pcDl.downloadList(config.Sections[2].ListName)
 		if err != nil {
-			return err
+			return pdfDir, report, err
 		}
 
 		pdfDir.writeSection(membersOutArea, config.Sections[2].Header, config.Sections[2])
+		report.addSection(pdfDir.sortHouseholds(membersOutArea, config.Sections[2]), config.Sections[2])
 	}
 
 	if len(config.Sections) > 3 && config.Sections[3].Show {
 		pdfDir.writeChildren(members, config.Sections[3].Header, config.Sections[3])
+		report.addSection(pdfDir.sortHouseholds(members, config.Sections[3]), config.Sections[3])
 	}
 
 	if len(config.Sections) > 4 && config.Sections[4].Show {
 		supportedO, err := pcDl.downloadList(config.Sections[4].ListName)
 		if err != nil {
-			return err
+			return pdfDir, report, err
 		}
 
 		pdfDir.writeSection(supportedO, config.Sections[4].Header, config.Sections[4])
+		report.addSection(pdfDir.sortHouseholds(supportedO, config.Sections[4]), config.Sections[4])
 	}
 
 	if len(config.Sections) > 5 && config.Sections[5].Show {
 		supportedD, err := pcDl.downloadList(config.Sections[5].ListName)
 		if err != nil {
-			return err
+			return pdfDir, report, err
 		}
 
 		pdfDir.writeSection(supportedD, config.Sections[5].Header, config.Sections[5])
+		report.addSection(pdfDir.sortHouseholds(supportedD, config.Sections[5]), config.Sections[5])
 	}
 
 	if len(config.Sections) > 6 && config.Sections[6].Show {
 		pastorsSent, err := pcDl.downloadList(config.Sections[6].ListName)
 		if err != nil {
-			return err
+			return pdfDir, report, err
 		}
 
 		pdfDir.writeSection(pastorsSent, config.Sections[6].Header, config.Sections[6])
+		report.addSection(pdfDir.sortHouseholds(pastorsSent, config.Sections[6]), config.Sections[6])
 	}
 
 	if len(config.Sections) > 7 && config.Sections[7].Show {
 		seminary, err := pcDl.downloadList(config.Sections[7].ListName)
 		if err != nil {
-			return err
+			return pdfDir, report, err
 		}
 
 		pdfDir.writeSection(seminary, config.Sections[7].Header, config.Sections[7])
+		report.addSection(pdfDir.sortHouseholds(seminary, config.Sections[7]), config.Sections[7])
 	}
 
 	if len(config.Sections) > 8 && config.Sections[8].Show {
-		pdfDir.writeFirstNames(members, config.Sections[8].Header)
+		pdfDir.writeFirstNames(members, config.Sections[8].Header, config.Sections[8])
+		report.addSection(pdfDir.sortHouseholds(members, config.Sections[8]), config.Sections[8])
 	}
 
-	err = pdfDir.closePDF(pcDl.ctx, fileName)
-	if err != nil {
-		return err
+	// Sections past the fixed nine are rendered by type.
+	for i := 9; i < len(config.Sections); i++ {
+		section := config.Sections[i]
+		if !section.Show {
+			continue
+		}
+
+		listName := section.ListName
+		if listName == "" {
+			listName = config.Sections[0].ListName
+		}
+
+		switch section.Type {
+		case sectionTypePhotoGrid:
+			households, err := pcDl.downloadList(listName)
+			if err != nil {
+				return pdfDir, report, err
+			}
+
+			err = pdfDir.writePhotoGrid(households, section.Header, section)
+			if err != nil {
+				return pdfDir, report, err
+			}
+			report.addSection(pdfDir.sortHouseholds(households, section), section)
+		default:
+			log.Warningf(pcDl.ctx, "Skipping section %d with unknown type %q\n", i, section.Type)
+		}
 	}
 
-	return err
+	if len(pdfDir.missingGlyphs) > 0 {
+		missing := ""
+		for r := range pdfDir.missingGlyphs {
+			missing += string(r)
+		}
+		log.Warningf(pcDl.ctx, "No font has glyphs for: %s\n", missing)
+	}
+
+	report.Layout = pdfDir.layoutIssues
+
+	return pdfDir, report, nil
 }
 
 type PdfDir struct {
@@ -223,7 +380,17 @@ type PdfDir struct {
 	topMargin        float64
 	rightMargin      float64
 	bottomMargin     float64
-	pageSize         string
+	mirrorMargins    bool
+	insideMargin     float64
+	outsideMargin    float64
+	bindingGutter    float64
+	trimSize         gofpdf.SizeType
+	orientation      string
+	pageOrientation  string
+	bleed            float64
+	slug             float64
+	outputProfile    string
+	minImageDPI      float64
 	colWd            float64
 	colNum           float64
 	firstNameColumns float64
@@ -232,12 +399,31 @@ type PdfDir struct {
 	imagePadding     float64
 	imageWidth       float64
 	columnHeight     float64
-	fontFamily       string
+	thumbnail        thumbnailSpec
+	placeholderStyle string
+	placeholderTints []rgbColor
+	placeholderFont  string
+	layoutMode       string
+	keepHouseholds   bool
+	collator         *collate.Collator
+	catalog          *catalog
+	rules            []MarkerRule
+	legend           [][]string
+	minFontSize      float64
+	layoutIssues     []LayoutIssue
+	lowResImages     int
+	currentSection   string
+	currentName      string
+	noSilhouette     bool
+	headerFontFamily string
+	nameFontFamily   string
+	bodyFontFamily   string
 	fontSize         float64
 	lineHeight       float64
 	textWidth        float64
-	highlightOpacity float64
-	overrides        map[string]Section
+	style            pdfStyle
+	overrides        *OverrideSet
+	migrated         map[string][]string
 	ctx              context.Context
 
 	fileName string
@@ -247,6 +433,14 @@ type PdfDir struct {
 
 	translate func(string) string
 
+	coreRunes     map[rune]bool
+	utf8Fonts     map[string]*sfnt.Font
+	sfntBuffer    sfnt.Buffer
+	fallbackFonts []string
+	missingGlyphs map[rune]bool
+	currentFamily string
+	currentStyle  string
+
 	gountries *gountries.Query
 }
 
@@ -300,24 +494,148 @@ func dateDiff(a, b time.Time) (year, month, day, hour, min, sec int) {
 }
 
 func (dir *PdfDir) setupPDF() (err error) {
-	dir.pdf = gofpdf.New("P", "mm", dir.pageSize, "./fonts")
-	dir.pdf.AddFont("Arial Narrow", "", "arial-narrow.json")
-	dir.pdf.AddFont("Arial Narrow", "B", "arial-narrow-bold.json")
-	dir.pdf.AddFont("Yanone Kaffeesatz", "", "YanoneKaffeesatz-Regular.json")
-	dir.pdf.AddFont("Yanone Kaffeesatz", "B", "YanoneKaffeesatz-Bold.json")
-	dir.pdf.AddFont("Yanone Kaffeesatz Light", "", "YanoneKaffeesatz-Light.json")
-	dir.pdf.AddFont("Yanone Kaffeesatz Thin", "", "YanoneKaffeesatz-Thin.json")
+	dir.pageOrientation = dir.orientation
+	width, height := dir.sectionPageSize(Section{})
+	dir.pdf = gofpdf.NewCustom(&gofpdf.InitType{UnitStr: "mm", Size: gofpdf.SizeType{Wd: width, Ht: height}, FontDirStr: fontDir})
+	if dir.outputProfile == outputProfileOffset {
+		dir.pdf.AddSpotColor(processBlack, 0, 0, 0, 100)
+		dir.setFillColor(rgbColor{0, 0, 0})
+	}
+	dir.setTextColor(dir.style.text)
+	dir.setDrawColor(dir.style.rule)
+	for _, f := range jsonFonts {
+		dir.pdf.AddFont(f.family, f.style, f.file)
+	}
 
-	width, _ := dir.pdf.GetPageSize()
+	families, err := loadFontManifest()
+	if err != nil {
+		return err
+	}
+
+	dir.utf8Fonts = make(map[string]*sfnt.Font)
+	dir.missingGlyphs = make(map[rune]bool)
+	for _, family := range families {
+		err = dir.addUTF8Family(family, readBuiltinFont)
+		if err != nil {
+			return err
+		}
+	}
+
+	orgFamilies, err := loadOrgFonts(dir.ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, family := range orgFamilies {
+		if family.Regular == "" {
+			log.Warningf(dir.ctx, "Skipping font %s without a regular style\n", family.Family)
+			continue
+		}
+
+		err = dir.addUTF8Family(family, readOrgFont(dir.ctx))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Without explicit fallbacks, every UTF-8 family is tried in turn so
+	// names outside the code page still print with the built-in fonts.
+	if len(dir.fallbackFonts) == 0 {
+		for _, family := range families {
+			dir.fallbackFonts = append(dir.fallbackFonts, family.Family)
+		}
+	}
+
+	dir.currentFamily = dir.bodyFontFamily
+
+	// Every page, whether added by us or by an automatic page break, picks up
+	// the margins for its side of the spread.
+	dir.pdf.SetHeaderFunc(func() {
+		left, right := dir.pageMargins()
+		dir.pdf.SetLeftMargin(left)
+		dir.pdf.SetRightMargin(right)
+		dir.pdf.SetX(left)
+	})
+
+	left, right := dir.pageMargins()
 
 	dir.pdf.SetCellMargin(0)
 
-	dir.colWd = (width - dir.leftMargin - dir.rightMargin - ((dir.colNum - 1) * dir.gutter)) / dir.colNum
+	dir.colWd = (width - left - right - ((dir.colNum - 1) * dir.gutter)) / dir.colNum
 
 	return err
 }
 
+// pageMargins returns the left and right margins of the current page,
+// from the page edge, so any bleed and slug is included. With mirrored
+// margins, odd pages bind on the left and even pages on the right, so the
+// inside margin and binding gutter swap sides on every page.
+func (dir *PdfDir) pageMargins() (left float64, right float64) {
+	offset := dir.trimOffset()
+	if !dir.mirrorMargins {
+		return offset + dir.leftMargin + dir.bindingGutter, offset + dir.rightMargin
+	}
+
+	inside := offset + dir.insideMargin + dir.bindingGutter
+	if dir.pdf.PageNo()%2 == 0 {
+		return offset + dir.outsideMargin, inside
+	}
+
+	return inside, offset + dir.outsideMargin
+}
+
+func (dir *PdfDir) writeHeader(header string) {
+	dir.currentSection = header
+
+	left, right := dir.pageMargins()
+	width, _ := dir.pdf.GetPageSize()
+
+	dir.setFont(dir.headerFontFamily, "", dir.fontSize+2.0)
+	_, boldLineHeight := dir.pdf.GetFontSize()
+
+	// A band is inset a little so the text doesn't touch its edges.
+	inset := 0.0
+	y := dir.pdf.GetY()
+	switch dir.style.headerStyle {
+	case headerStyleBand:
+		inset = boldLineHeight * 0.4
+		dir.setFillColor(dir.style.headerBand)
+		dir.pdf.Rect(left, y-inset, width-left-right, boldLineHeight+inset*2, "F")
+	case headerStyleRule:
+		lineWidth := dir.pdf.GetLineWidth()
+		ruleY := y + boldLineHeight*1.4
+		dir.pdf.SetLineWidth(headerRuleWidth)
+		dir.setDrawColor(dir.style.header)
+		dir.pdf.Line(left, ruleY, width-right, ruleY)
+		dir.pdf.SetLineWidth(lineWidth)
+		dir.setDrawColor(dir.style.rule)
+	}
+
+	dir.pdf.SetX(left + inset)
+	dir.pdf.SetLeftMargin(left + inset)
+	textWidth := dir.stringWidth(header)
+	dir.setTextColor(dir.style.header)
+	dir.cell(textWidth, boldLineHeight, header, "", 0, "LC", false)
+	dir.setFont(dir.bodyFontFamily, "", dir.fontSize)
+
+	asOf := dir.catalog.text("as_of", dir.catalog.date(time.Now(), "as_of"))
+	textWidth = dir.stringWidth(asOf)
+	_, lineHeight := dir.pdf.GetFontSize()
+	dir.pdf.SetLeftMargin(width - textWidth - right - inset)
+	dir.cell(textWidth, lineHeight, asOf, "", 0, "RC", false)
+	dir.setTextColor(dir.style.text)
+	dir.pdf.SetLeftMargin(left)
+	dir.pdf.SetY(dir.pdf.GetY() + boldLineHeight*2.0)
+}
+
 func (dir *PdfDir) closePDF(ctx context.Context, fileName string) (err error) {
+	if dir.outputProfile == outputProfileOffset {
+		err = dir.finishOffsetPDF()
+		if err != nil {
+			return err
+		}
+	}
+
 	bucketName, err := file.DefaultBucketName(ctx)
 	if err != nil {
 		return err
@@ -345,32 +663,13 @@ func (dir *PdfDir) closePDF(ctx context.Context, fileName string) (err error) {
 }
 
 func (dir *PdfDir) writeSection(entries map[string]Household, header string, displayOptions Section) (err error) {
-	dir.pdf.SetLeftMargin(dir.leftMargin)
-	dir.pdf.SetTopMargin(dir.topMargin)
-	dir.pdf.SetRightMargin(dir.rightMargin)
 	dir.pdf.SetAutoPageBreak(true, dir.bottomMargin)
-
-	dir.pdf.AddPage()
+	dir.beginSection(displayOptions)
 	column := 0.0
 	firstPage := true
 
-	dir.pdf.SetFont(dir.fontFamily, "", dir.fontSize+2.0)
-
-	dir.pdf.SetX(dir.leftMargin)
-	dir.pdf.SetLeftMargin(dir.leftMargin)
-	_, boldLineHeight := dir.pdf.GetFontSize()
-	textWidth := dir.pdf.GetStringWidth(dir.translate(header))
-	dir.pdf.CellFormat(textWidth, boldLineHeight, dir.translate(header), "", 0, "LC", false, 0, "")
-	dir.pdf.SetFont(dir.fontFamily, "", dir.fontSize)
-
-	textWidth = dir.pdf.GetStringWidth(dir.translate(time.Now().Format("As of: 01/02/2006")))
-	leftMargin, _, _, _ := dir.pdf.GetMargins()
-	_, lineHeight := dir.pdf.GetFontSize()
-	width, _ := dir.pdf.GetPageSize()
-	dir.pdf.SetLeftMargin(width - textWidth - dir.rightMargin)
-	dir.pdf.CellFormat(textWidth, lineHeight, dir.translate(time.Now().Format("As of: 01/02/2006")), "", 0, "RC", false, 0, "")
-	dir.pdf.SetLeftMargin(leftMargin)
-	dir.pdf.SetY(dir.pdf.GetY() + boldLineHeight*2.0)
+	dir.writeHeader(header)
+	dir.setLegend(entries, displayOptions)
 
 	bucketName, err := file.DefaultBucketName(dir.ctx)
 	if err != nil {
@@ -384,20 +683,16 @@ func (dir *PdfDir) writeSection(entries map[string]Household, header string, dis
 	defer client.Close()
 	bucket := client.Bucket(bucketName)
 
-	keys := make([]string, len(entries))
-	keyToId := make(map[string]string)
+	sectionPage := dir.pdf.PageNo()
+	pages := make(map[int]*letterRange)
+	var letters []string
+	letter := ""
 
-	i := 0
-	for k := range entries {
-		keys[i] = entries[k].SortKey
-		keyToId[entries[k].SortKey] = k
-		i++
-	}
-	sort.Strings(keys)
+	households, keys := dir.sortHouseholdsWithKeys(entries, displayOptions)
 
 householdLoop:
-	for _, k := range keys {
-		h := entries[keyToId[k]]
+	for i, h := range households {
+		h = dir.resolveHousehold(h)
 
 		if h.Head != nil {
 			overrideOptions := dir.getSectionOverride(h.Head, displayOptions)
@@ -406,83 +701,104 @@ householdLoop:
 			}
 		}
 
-		high := h.Head != nil && len(h.Members) > 0
-		if h.Head != nil {
-			if h.Head.Thumbnail {
-				rc, err := bucket.Object(dir.domain + "/jpgs/" + h.Head.Id).NewReader(dir.ctx)
-				if err != nil {
-					log.Errorf(dir.ctx, "Error loading: %s\n", err)
-				}
-				defer rc.Close()
-
-				input, _, err := image.Decode(rc)
-				if err != nil {
-					log.Errorf(dir.ctx, "Head thumbnail decode: %s\n", err)
-				}
+		householdEntries := dir.householdEntries(bucket, h, displayOptions)
+		if len(householdEntries) == 0 {
+			continue householdLoop
+		}
 
-				ratio := float64(input.Bounds().Max.Y) / dir.columnHeight
-				width = float64(input.Bounds().Max.X) / ratio
+		if sortLetter(keys[i][0]) != letter {
+			letter = sortLetter(keys[i][0])
+			letters = append(letters, letter)
 
-				resize.Thumbnail(uint(dir.columnHeight), uint(width), input, resize.Lanczos3)
-				if err != nil {
-					log.Errorf(dir.ctx, "Head thumbnail resize: %s\n", err)
-				}
+			if displayOptions.LetterDividers == dividerBand {
+				column, firstPage = dir.writeDivider(letter, dir.dividerNextHeight(householdEntries, firstPage, displayOptions), column, firstPage, displayOptions)
+			}
+		}
 
-				buf := new(bytes.Buffer)
-				err = jpeg.Encode(buf, input, &jpeg.Options{Quality: 75})
-				if err != nil {
-					log.Errorf(dir.ctx, "Head thumbnail encode: %s\n", err)
-				}
+		if dir.keepHouseholds {
+			column, firstPage = dir.keepTogether(dir.householdHeight(householdEntries, displayOptions), column, firstPage, displayOptions)
+		}
 
-				dir.pdf.RegisterImageOptionsReader(h.Head.Id, gofpdf.ImageOptions{ImageType: "JPG"}, buf)
-			}
-			column, firstPage, _ = dir.writeEntry(*h.Head, column, high, false, firstPage, displayOptions)
+		// Shade households that print a head and at least one member.
+		high := len(householdEntries) > 1 && householdEntries[0].head
+		for _, entry := range householdEntries {
+			column, firstPage, _ = dir.writeEntry(*entry.person, entry.image, entry.placeholder, column, high && entry.head, high && !entry.head, firstPage, displayOptions)
+			addPageLetter(pages, dir.pdf.PageNo(), letter)
 		}
+	}
 
-	memberLoop:
-		for _, m := range h.Members {
-			if m.Thumbnail {
-				rc, err := bucket.Object(dir.domain + "/jpgs/" + m.Id).NewReader(dir.ctx)
-				if err != nil {
-					log.Errorf(dir.ctx, "Error loading: %s\n", err)
-				}
-				defer rc.Close()
+	dir.writeFooter(displayOptions)
+	dir.writeLetterMarks(pages, letters, sectionPage, displayOptions)
 
-				input, _, err := image.Decode(rc)
-				if err != nil {
-					log.Errorf(dir.ctx, "Member thumbnail decode: %s\n", err)
-				}
+	return nil
+}
 
-				ratio := float64(input.Bounds().Max.Y) / dir.columnHeight
-				width = float64(input.Bounds().Max.X) / ratio
+// personImage registers a person's avatar at the spec's size and returns its
+// image name, or "" if they have none.
+func (dir *PdfDir) personImage(bucket *storage.BucketHandle, spec thumbnailSpec, person *Person) string {
+	if !person.Thumbnail {
+		return ""
+	}
 
-				resize.Thumbnail(uint(dir.columnHeight), uint(width), input, resize.Lanczos3)
-				if err != nil {
-					log.Errorf(dir.ctx, "Member thumbnail resize: %s\n", err)
-				}
+	image := dir.registerThumbnail(bucket, spec, person.Id, dir.domain+"/jpgs/"+person.Id)
+	person.Thumbnail = image != ""
 
-				buf := new(bytes.Buffer)
-				err = jpeg.Encode(buf, input, &jpeg.Options{Quality: 75})
-				if err != nil {
-					log.Errorf(dir.ctx, "Member thumbnail encode: %s\n", err)
-				}
+	return image
+}
 
-				dir.pdf.RegisterImageOptionsReader(m.Id, gofpdf.ImageOptions{ImageType: "JPG"}, buf)
-			}
-			if cap(displayOptions.ExcludeDirSections) > 0 {
-				for _, exclude := range displayOptions.ExcludeDirSections {
-					if _, ok := m.DirectorySections[exclude]; ok {
-						continue memberLoop
-					}
-				}
-			}
-			column, firstPage, _ = dir.writeEntry(*m, column, false, high, firstPage, displayOptions)
+// entryImage is personImage falling back to the organization's silhouette,
+// at the size of the photos beside entries.
+func (dir *PdfDir) entryImage(bucket *storage.BucketHandle, person *Person) string {
+	if image := dir.personImage(bucket, dir.thumbnail, person); image != "" {
+		return image
+	}
+
+	return dir.placeholderImage(bucket, dir.thumbnail)
+}
+
+// householdImage registers a household's family photo at the spec's size
+// and returns its image name, or "" if the household has none. Anyone in
+// the household hiding their photo hides the family photo too.
+func (dir *PdfDir) householdImage(bucket *storage.BucketHandle, spec thumbnailSpec, h Household) string {
+	if h.Photo == nil || h.Photo.Object == "" {
+		return ""
+	}
+
+	people := h.Members
+	if h.Head != nil {
+		people = append([]*Person{h.Head}, h.Members...)
+	}
+	for _, p := range people {
+		if dir.photoHidden(p) {
+			return ""
 		}
 	}
 
-	dir.writeFooter(displayOptions)
+	return dir.registerThumbnail(bucket, spec, "household-"+h.Id, h.Photo.Object)
+}
 
-	return nil
+// registerThumbnail loads the spec's thumbnail of a cached photo and
+// registers it with the PDF, returning its image name, or "" if the photo
+// can't be used. The name is the photo's with the spec's key, since one
+// photo may print at more than one size.
+func (dir *PdfDir) registerThumbnail(bucket *storage.BucketHandle, spec thumbnailSpec, name string, objectName string) string {
+	image := name + "@" + spec.key()
+	if dir.pdf.GetImageInfo(image) != nil {
+		return image
+	}
+
+	contents, err := spec.load(dir.ctx, bucket, dir.domain, objectName)
+	if err != nil {
+		log.Errorf(dir.ctx, "Thumbnail %s: %s\n", objectName, err)
+		return ""
+	}
+
+	dir.pdf.RegisterImageOptionsReader(image, gofpdf.ImageOptions{ImageType: "JPG"}, bytes.NewReader(contents))
+	if dir.pdf.GetImageInfo(image) == nil {
+		return ""
+	}
+
+	return image
 }
 
 func phoneNumber(phone int64) string {
@@ -501,8 +817,12 @@ func phoneNumber(phone int64) string {
 	return phoneNo
 }
 
+// writeFooter prints the section's legend at the bottom of the page. Items
+// in a row are spread across it, the first at the left margin and the last
+// at the right.
 func (dir *PdfDir) writeFooter(displayOptions Section) {
 	_, _, _, bottom := dir.pdf.GetMargins()
+	left, right := dir.pageMargins()
 
 	width, height := dir.pdf.GetPageSize()
 
@@ -510,255 +830,151 @@ func (dir *PdfDir) writeFooter(displayOptions Section) {
 
 	dir.pdf.SetAutoPageBreak(false, bottom)
 
-	dir.pdf.SetY(height - lineHeight - bottom)
-	dir.pdf.SetX(dir.leftMargin)
-	dir.pdf.SetLeftMargin(dir.leftMargin)
+	for i, row := range dir.legend {
+		y := height - bottom - float64(len(dir.legend)-i)*lineHeight
 
-	if displayOptions.BaptismFootnote {
-		textWidth := dir.pdf.GetStringWidth(dir.translate("§ Member pending baptism"))
-		dir.pdf.CellFormat(textWidth, lineHeight, dir.translate("§ Member pending baptism"), "", 0, "LB", false, 0, "")
-	}
+		used := 0.0
+		for _, item := range row {
+			used += dir.stringWidth(item)
+		}
+		gap := 0.0
+		if len(row) > 1 {
+			gap = (width - left - right - used) / float64(len(row)-1)
+		}
 
-	if displayOptions.NewMemberFootnote {
-		textWidth := dir.pdf.GetStringWidth(dir.translate("* New member in the last 90 days"))
-		leftMargin, _, _, _ := dir.pdf.GetMargins()
-		dir.pdf.SetLeftMargin(width - textWidth - dir.rightMargin)
-		dir.pdf.CellFormat(textWidth, lineHeight, dir.translate("* New member in the last 90 days"), "", 0, "RB", false, 0, "")
-		dir.pdf.SetLeftMargin(leftMargin)
+		x := left
+		for _, item := range row {
+			textWidth := dir.stringWidth(item)
+			dir.pdf.SetXY(x, y)
+			dir.cell(textWidth, lineHeight, item, "", 0, "LB", false)
+			x += textWidth + gap
+		}
 	}
 
+	dir.pdf.SetLeftMargin(left)
 	dir.pdf.SetAutoPageBreak(true, bottom)
 }
 
 func (dir *PdfDir) shrinkedCell(width float64, height float64, str string, border string, alignment string, fill bool) {
 	originalFontSize, _ := dir.pdf.GetFontSize()
-	for dir.pdf.GetStringWidth(str)+dir.pdf.GetCellMargin() > width {
+	for dir.stringWidth(str)+dir.pdf.GetCellMargin() > width {
 		currentFontSize, _ := dir.pdf.GetFontSize()
 		dir.pdf.SetFontSize(currentFontSize - 0.1)
 	}
-	dir.pdf.CellFormat(width, height, str, border, 1, alignment, fill, 0, "")
+	fontSize, _ := dir.pdf.GetFontSize()
+	dir.checkShrink(str, fontSize)
+	dir.cell(width, height, str, border, 1, alignment, fill)
 	dir.pdf.SetFontSize(originalFontSize)
 }
 
-func (dir *PdfDir) getSectionOverride(directoryEntry *Person, oldDisplayOptions Section) (displayOptions Section) {
-	displayOptions = oldDisplayOptions
-	displayOptions.ShowHousehold = true
-	displayOptions.ShowChildren = true
-
-	if cap(displayOptions.ExcludeDirSections) > 0 {
-		for _, exclude := range displayOptions.ExcludeDirSections {
-			if _, ok := directoryEntry.DirectorySections[exclude]; ok {
-				displayOptions.Show = false
-				return displayOptions
-			}
-		}
-	}
-
-	key := strings.ToLower(fmt.Sprintf("%s-%s-%s", directoryEntry.FirstName, directoryEntry.LastName, directoryEntry.Birthday.Format("2006-01-02")))
-
-	if dir.overrides == nil {
-		overrideRecord := OverridesRecord{}
-		overrideKey := datastore.NewKey(dir.ctx, "Overrides", "", 1, nil)
-		err := datastore.Get(dir.ctx, overrideKey, &overrideRecord)
-		if err != nil {
-			log.Warningf(dir.ctx, "Error pulling overrides: %s\n", err)
-			return displayOptions
-		}
-		if overrideRecord.Overrides != nil {
-			err := json.Unmarshal(overrideRecord.Overrides, &dir.overrides)
-			if err != nil {
-				log.Warningf(dir.ctx, "Error parsing overrides: %s\n", err)
-				return displayOptions
-			}
-		}
-	}
-
-	overrideOptions := dir.overrides[key]
-
-	if overrideOptions.KeyFirstName != "" {
-
-		if displayOptions.Show && !overrideOptions.Show {
-			displayOptions.Show = false
-		}
-
-		if displayOptions.Phones && !overrideOptions.Phones {
-			displayOptions.Phones = false
-		}
-
-		if displayOptions.Email && !overrideOptions.Email {
-			displayOptions.Email = false
-		}
-
-		if displayOptions.Address && !overrideOptions.Address {
-			displayOptions.Address = false
-		}
-
-		if displayOptions.DateJoined && !overrideOptions.DateJoined {
-			displayOptions.DateJoined = false
-		}
-
-		if displayOptions.Birthday && !overrideOptions.Birthday {
-			displayOptions.Birthday = false
-		}
-
-		if displayOptions.City && !overrideOptions.City {
-			displayOptions.City = false
-		}
-
-		if displayOptions.State && !overrideOptions.State {
-			displayOptions.State = false
-		}
-
-		if displayOptions.PostalCode && !overrideOptions.PostalCode {
-			displayOptions.PostalCode = false
-		}
-
-		if displayOptions.Country && !overrideOptions.Country {
-			displayOptions.Country = false
-		}
-
-		if displayOptions.ShowHousehold && !overrideOptions.ShowHousehold {
-			displayOptions.ShowHousehold = false
-		}
-
-		if displayOptions.ShowChildren && !overrideOptions.ShowChildren {
-			displayOptions.ShowChildren = false
-		}
-	}
-	return displayOptions
-}
-
-func (dir *PdfDir) writeEntry(directoryEntry Person, lastColumn float64, highlightTop bool, highlightBottom bool, indentPage bool, displayOptions Section) (column float64, firstPage bool, err error) {
+func (dir *PdfDir) writeEntry(directoryEntry Person, imageName string, placeholder bool, lastColumn float64, highlightTop bool, highlightBottom bool, indentPage bool, displayOptions Section) (column float64, firstPage bool, err error) {
 	displayOptions = dir.getSectionOverride(&directoryEntry, displayOptions)
 	if !displayOptions.Show {
 		return lastColumn, indentPage, nil
 	}
-	firstPage = indentPage
-
-	left, top, _, bottom := dir.pdf.GetMargins()
-
-	_, height := dir.pdf.GetPageSize()
-
-	startOffset := 0.0
-	endOffset := 0.0
-
-	if displayOptions.BaptismFootnote || displayOptions.NewMemberFootnote {
-		_, lineHeight := dir.pdf.GetFontSize()
-		endOffset = lineHeight
-	}
-
-	if firstPage {
-		startOffset = ((dir.fontSize + 2.0) / dir.pdf.GetConversionRatio()) * 2.0
-	}
-
-	if dir.pdf.GetY()+dir.columnHeight+(dir.padding) > height-bottom-endOffset {
-		lastColumn++
-
-		dir.pdf.SetY(top + startOffset)
-	}
-
-	if lastColumn >= dir.colNum {
-		lastColumn = 0
+	dir.currentName = strings.TrimSpace(directoryEntry.FirstName + " " + directoryEntry.LastName)
 
-		dir.pdf.SetLeftMargin(dir.leftMargin)
-		dir.pdf.SetX(dir.leftMargin)
-		dir.pdf.SetY(height - bottom)
+	dir.imageWidth = entryImageWidth
+	dir.textWidth = dir.colWd - (dir.imageWidth + (dir.imagePadding * 2))
 
-		dir.writeFooter(displayOptions)
+	lines := dir.entryLines(directoryEntry, displayOptions)
+	entryHeight := dir.entryHeight(lines, imageName != "" || placeholder)
 
-		dir.pdf.AddPage()
-		dir.pdf.SetY(top)
-		dir.pdf.SetX(left)
-		dir.pdf.SetLeftMargin(left)
-		firstPage = false
-	}
+	lastColumn, firstPage = dir.placeEntry(entryHeight, lastColumn, indentPage, displayOptions)
+	columnTop, columnBottom := dir.columnSpace(firstPage, displayOptions)
 
 	halfPadding := dir.padding / 2.0
 	dir.pdf.SetY(dir.pdf.GetY() + halfPadding)
 	startY := dir.pdf.GetY()
+	startPage := dir.pdf.PageNo()
 
-	x := dir.leftMargin + float64(lastColumn)*(dir.colWd+dir.gutter)
+	left, _ := dir.pageMargins()
+	x := left + float64(lastColumn)*(dir.colWd+dir.gutter)
 
 	dir.pdf.SetLeftMargin(x)
 	dir.pdf.SetX(x)
 
-	color := int(math.Ceil(255 - (dir.highlightOpacity * 255)))
-
 	if highlightTop {
-		dir.pdf.SetFillColor(color, color, color)
-		dir.pdf.SetDrawColor(color, color, color)
-		fillHeight := dir.columnHeight + halfPadding + (halfPadding / 2)
-		diff := (height - dir.bottomMargin) - (dir.pdf.GetY() + fillHeight)
-		if dir.pdf.GetY()+fillHeight > height-dir.bottomMargin {
-			fillHeight = fillHeight + diff
+		dir.setFillColor(dir.style.shading)
+		dir.setDrawColor(dir.style.shading)
+		fillHeight := entryHeight + halfPadding + (halfPadding / 2)
+		// Shading stops at the bottom of the column, above the footnotes,
+		// when the rest of the household continues in the next one.
+		if dir.pdf.GetY()-(halfPadding/2)+fillHeight > columnBottom {
+			fillHeight = columnBottom - (dir.pdf.GetY() - (halfPadding / 2))
 		}
 		dir.pdf.Rect(dir.pdf.GetX(), dir.pdf.GetY()-(halfPadding/2), dir.colWd, fillHeight, "FD")
 	}
 
 	if highlightBottom {
-		dir.pdf.SetFillColor(color, color, color)
-		dir.pdf.SetDrawColor(color, color, color)
+		dir.setFillColor(dir.style.shading)
+		dir.setDrawColor(dir.style.shading)
 		startY := dir.pdf.GetY() - halfPadding
-		fillHeight := dir.columnHeight + halfPadding + (halfPadding / 2)
-		if startY < dir.topMargin {
-			fillHeight = fillHeight - (dir.topMargin - startY)
-			startY = dir.topMargin
+		fillHeight := entryHeight + halfPadding + (halfPadding / 2)
+		if startY < columnTop {
+			fillHeight = fillHeight - (columnTop - startY)
+			startY = columnTop
 		}
 		dir.pdf.Rect(dir.pdf.GetX(), startY, dir.colWd, fillHeight, "FD")
 	}
 
-	dir.pdf.SetTextColor(0, 0, 0)
-	if directoryEntry.Thumbnail {
-		//dir.pdf.Image(directoryEntry.Id, dir.pdf.GetX()+dir.imagePadding, dir.pdf.GetY(), 0, dir.columnHeight, false, "", 0, "")
-		dir.pdf.Image(directoryEntry.Id, dir.pdf.GetX()+dir.imagePadding, dir.pdf.GetY(), 25, 0, false, "", 0, "")
-		if dir.pdf.GetImageInfo(directoryEntry.Id) != nil {
-			ratio := dir.pdf.GetImageInfo(directoryEntry.Id).Height() / dir.columnHeight
-			dir.imageWidth = dir.pdf.GetImageInfo(directoryEntry.Id).Width() / ratio
+	dir.setTextColor(dir.style.text)
+	if imageName != "" {
+		//dir.pdf.Image(imageName, dir.pdf.GetX()+dir.imagePadding, dir.pdf.GetY(), 0, dir.columnHeight, false, "", 0, "")
+		dir.pdf.Image(imageName, dir.pdf.GetX()+dir.imagePadding, dir.pdf.GetY(), entryImageWidth, 0, false, "", 0, "")
+		if info := dir.pdf.GetImageInfo(imageName); info != nil {
+			ratio := info.Height() / dir.columnHeight
+			dir.imageWidth = info.Width() / ratio
+			dir.writePhotoBorder(dir.pdf.GetX()+dir.imagePadding, dir.pdf.GetY(), entryImageWidth, entryImageWidth*info.Height()/info.Width())
+			dir.checkImageDPI(info, entryImageWidth)
 		}
+	} else if placeholder {
+		dir.writePlaceholder(directoryEntry, dir.pdf.GetX()+dir.imagePadding, dir.pdf.GetY(), entryImageWidth, dir.columnHeight)
 	}
 
-	dir.imageWidth = 25
+	dir.imageWidth = entryImageWidth
 	dir.pdf.SetLeftMargin(x + dir.imageWidth + (dir.imagePadding * 2))
 
-	prefix := ""
-	if directoryEntry.NewMember90 && displayOptions.NewMemberFootnote {
-		prefix = "*"
-	}
+	dir.writeEntryLines(lines, directoryEntry.EmailAddress)
 
-	if directoryEntry.PendingBaptism && displayOptions.BaptismFootnote {
-		prefix = "§"
-	}
+	dir.checkSplit(startPage)
+	dir.checkOverflow(startY, startPage, entryHeight)
+	dir.pdf.SetY(startY + entryHeight + halfPadding)
 
-	dir.textWidth = dir.colWd - (dir.imageWidth + (dir.imagePadding * 2))
+	column = lastColumn
 
-	text := fmt.Sprintf("%s, %s%s", strings.ToUpper(directoryEntry.LastName), strings.ToUpper(directoryEntry.FirstName), prefix)
-	dir.pdf.SetFont(dir.fontFamily, "B", dir.fontSize)
-	dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(text), "", "L", false)
+	return column, firstPage, nil
+}
+
+// entryLines returns the text of an entry, the name first and then one
+// string per line of details.
+func (dir *PdfDir) entryLines(directoryEntry Person, displayOptions Section) (lines []string) {
+	prefix := dir.markers(&directoryEntry, displayOptions)
 
-	dir.pdf.SetFont(dir.fontFamily, "", dir.fontSize)
+	lines = append(lines, fmt.Sprintf("%s, %s%s", strings.ToUpper(directoryEntry.LastName), strings.ToUpper(directoryEntry.FirstName), prefix))
 
 	if displayOptions.Occupation && directoryEntry.Occupation != "" {
-		dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(directoryEntry.Occupation), "", "L", false)
+		lines = append(lines, directoryEntry.Occupation)
 	}
 
 	if displayOptions.JobTitle && directoryEntry.Title != "" {
-		dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(directoryEntry.Title), "", "L", false)
+		lines = append(lines, directoryEntry.Title)
 	}
 
 	if displayOptions.Employer && directoryEntry.Employer != "" {
-		dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(directoryEntry.Employer), "", "L", false)
+		lines = append(lines, directoryEntry.Employer)
 	}
 
 	if displayOptions.School && directoryEntry.School != "" {
-		dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(directoryEntry.School), "", "L", false)
+		lines = append(lines, directoryEntry.School)
 	}
 
 	if displayOptions.Address && directoryEntry.Address1 != "" {
-		dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(directoryEntry.Address1), "", "L", false)
+		lines = append(lines, directoryEntry.Address1)
 	}
 
 	if displayOptions.Address && directoryEntry.Address2 != "" {
-		dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(directoryEntry.Address2), "", "L", false)
+		lines = append(lines, directoryEntry.Address2)
 	}
 
 	if directoryEntry.City != "" || directoryEntry.State != "" || directoryEntry.PostalCode != "" {
@@ -786,12 +1002,12 @@ func (dir *PdfDir) writeEntry(directoryEntry Person, lastColumn float64, highlig
 			}
 		}
 		if addressText != "" {
-			dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(addressText), "", "L", false)
+			lines = append(lines, addressText)
 		}
 	}
 
 	if displayOptions.Email && directoryEntry.EmailAddress != "" {
-		dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(directoryEntry.EmailAddress), "", "L", false)
+		lines = append(lines, directoryEntry.EmailAddress)
 	}
 
 	if displayOptions.Phones {
@@ -799,16 +1015,16 @@ func (dir *PdfDir) writeEntry(directoryEntry Person, lastColumn float64, highlig
 
 		if directoryEntry.CellPhone != 0 {
 			phones++
-			dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(phoneNumber(directoryEntry.CellPhone)), "", "L", false)
+			lines = append(lines, phoneNumber(directoryEntry.CellPhone))
 		}
 
 		if directoryEntry.HomePhone != 0 && phones < displayOptions.PhoneCount {
 			phones++
-			dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate("H: "+phoneNumber(directoryEntry.HomePhone)), "", "L", false)
+			lines = append(lines, dir.catalog.text("home_phone", phoneNumber(directoryEntry.HomePhone)))
 		}
 
 		if directoryEntry.WorkPhone != 0 && phones < displayOptions.PhoneCount {
-			dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate("W: "+phoneNumber(directoryEntry.WorkPhone)), "", "L", false)
+			lines = append(lines, dir.catalog.text("work_phone", phoneNumber(directoryEntry.WorkPhone)))
 		}
 	}
 
@@ -816,67 +1032,38 @@ func (dir *PdfDir) writeEntry(directoryEntry Person, lastColumn float64, highlig
 		dateText := ""
 
 		if displayOptions.DateJoined {
-			dateText = fmt.Sprintf("DJ: %s", directoryEntry.DateJoined.Format("01/2006"))
+			dateText = dir.catalog.text("date_joined", dir.catalog.date(directoryEntry.DateJoined, "date_joined"))
 		}
 
 		if displayOptions.Birthday {
-			dateText = dateText + fmt.Sprintf(" BD: %s", directoryEntry.Birthday.Format("01/02"))
+			dateText = strings.TrimSpace(dateText + " " + dir.catalog.text("birthday_short", dir.catalog.date(directoryEntry.Birthday, "birthday_short")))
 		}
 
-		dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(dateText), "", "L", false)
+		lines = append(lines, dateText)
 	}
 
 	if displayOptions.Children && directoryEntry.Children1 != "" {
-		dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(directoryEntry.Children1), "", "L", false)
+		lines = append(lines, directoryEntry.Children1)
 	}
 
 	if displayOptions.Children && directoryEntry.Children2 != "" {
-		dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(directoryEntry.Children2), "", "L", false)
+		lines = append(lines, directoryEntry.Children2)
 	}
 
-	dir.pdf.SetY(startY + dir.columnHeight + halfPadding)
-
-	column = lastColumn
-
-	return column, firstPage, nil
+	return lines
 }
 
-func (dir *PdfDir) writeFirstNames(entries map[string]Household, header string) (err error) {
-	dir.pdf.SetLeftMargin(dir.leftMargin)
-	dir.pdf.SetTopMargin(dir.topMargin)
-	dir.pdf.SetRightMargin(dir.rightMargin)
+func (dir *PdfDir) writeFirstNames(entries map[string]Household, header string, displayOptions Section) (err error) {
 	dir.pdf.SetAutoPageBreak(true, dir.bottomMargin)
+	dir.beginSection(displayOptions)
 
-	dir.pdf.AddPage()
-
-	dir.pdf.SetFont(dir.fontFamily, "", dir.fontSize+2.0)
-
-	dir.pdf.SetX(dir.leftMargin)
-	dir.pdf.SetLeftMargin(dir.leftMargin)
+	dir.writeHeader(header)
 
-	dir.pdf.SetFont(dir.fontFamily, "", dir.fontSize+2.0)
-
-	dir.pdf.SetX(dir.leftMargin)
-	dir.pdf.SetLeftMargin(dir.leftMargin)
-	_, boldLineHeight := dir.pdf.GetFontSize()
-	textWidth := dir.pdf.GetStringWidth(dir.translate(header))
-	dir.pdf.CellFormat(textWidth, boldLineHeight, dir.translate(header), "", 0, "LC", false, 0, "")
-	dir.pdf.SetFont(dir.fontFamily, "", dir.fontSize)
-
-	textWidth = dir.pdf.GetStringWidth(dir.translate(time.Now().Format("As of: 01/02/2006")))
-	leftMargin, _, _, _ := dir.pdf.GetMargins()
-	_, lineHeight := dir.pdf.GetFontSize()
-	width, _ := dir.pdf.GetPageSize()
-	dir.pdf.SetLeftMargin(width - textWidth - dir.rightMargin)
-	dir.pdf.CellFormat(textWidth, lineHeight, dir.translate(time.Now().Format("As of: 01/02/2006")), "", 0, "RC", false, 0, "")
-	dir.pdf.SetLeftMargin(leftMargin)
-	dir.pdf.SetY(dir.pdf.GetY() + boldLineHeight*2.0)
-
-	entriesKeyed := make(map[string]*Person)
-	keys := make([]string, 0)
+	people := make([]*Person, 0)
 
 householdLoop:
 	for _, h := range entries {
+		h = dir.resolveHousehold(h)
 		if h.Head != nil {
 			overrideOptions := dir.getSectionOverride(h.Head, Section{Show: true})
 			if !overrideOptions.ShowHousehold {
@@ -885,33 +1072,33 @@ householdLoop:
 		}
 
 		if h.Head != nil {
-			key := h.Head.FirstName + h.Head.LastName
-			entriesKeyed[key] = h.Head
-			keys = append(keys, key)
+			people = append(people, h.Head)
 		}
 
-		for _, m := range h.Members {
-			key := m.FirstName + m.LastName
-			entriesKeyed[key] = m
-			keys = append(keys, key)
-		}
+		people = append(people, h.Members...)
 	}
 
-	sort.Strings(keys)
+	dir.sortPeople(people)
 
 	i := 0
 	count := 6.0
 	lastColumn := 0.0
 	firstPage := true
-	left, top, _, bottom := dir.pdf.GetMargins()
+	_, top, _, bottom := dir.pdf.GetMargins()
+	left, right := dir.pageMargins()
 
 	width, height := dir.pdf.GetPageSize()
 
-	colWd := (width - dir.leftMargin - dir.rightMargin) / count
+	colWd := (width - left - right) / count
+
+	// Names fit the width of entry text, which is only set once an entry has
+	// been written, so it's worked out here when no section came before.
+	if dir.textWidth == 0 {
+		dir.textWidth = dir.colWd - (entryImageWidth + (dir.imagePadding * 2))
+	}
 
 memberLoop:
-	for _, k := range keys {
-		p := entriesKeyed[k]
+	for _, p := range people {
 		overrideOptions := dir.getSectionOverride(p, Section{Show: true})
 		if !overrideOptions.Show {
 			continue memberLoop
@@ -931,29 +1118,47 @@ memberLoop:
 		if lastColumn >= dir.firstNameColumns {
 			lastColumn = 0.0
 
-			dir.pdf.SetLeftMargin(dir.leftMargin)
-			dir.pdf.SetX(dir.leftMargin)
 			dir.pdf.SetY(height - bottom)
 
-			dir.pdf.AddPage()
+			dir.addPage()
 			dir.pdf.SetY(top)
-			dir.pdf.SetX(left)
-			dir.pdf.SetLeftMargin(left)
 			firstPage = false
 		}
 
-		x := dir.leftMargin + float64(lastColumn)*colWd
+		left, _ := dir.pageMargins()
+		x := left + float64(lastColumn)*colWd
 
 		dir.pdf.SetLeftMargin(x)
 		dir.pdf.SetX(x)
 
-		dir.shrinkedCell(dir.textWidth, dir.lineHeight, dir.translate(p.FirstName+" "+p.LastName), "", "L", false)
+		dir.currentName = p.FirstName + " " + p.LastName
+		dir.shrinkedCell(dir.textWidth, dir.lineHeight, p.FirstName+" "+p.LastName, "", "L", false)
 		i++
 	}
 
 	return nil
 }
 
+// householdName joins the household's adults as "Last, First and First",
+// spelling out any member's last name that differs from the head's.
+func householdName(h Household, showHead bool) (str string) {
+	if h.Head != nil && showHead {
+		str = fmt.Sprintf("%s, %s", h.Head.LastName, h.Head.FirstName)
+	}
+
+	for _, m := range h.Members {
+		if h.Head != nil && m.LastName != h.Head.LastName && showHead {
+			str = fmt.Sprintf("%s and %s %s", str, m.FirstName, m.LastName)
+		} else if str != "" {
+			str = fmt.Sprintf("%s and %s", str, m.FirstName)
+		} else {
+			str = fmt.Sprintf("%s, %s", m.LastName, m.FirstName)
+		}
+	}
+
+	return str
+}
+
 func (dir *PdfDir) writeChildrenHeader(leftSide, colWd, offset float64, displayOptions Section) {
 	dir.pdf.SetLeftMargin(leftSide)
 	dir.pdf.SetX(leftSide)
@@ -961,45 +1166,41 @@ func (dir *PdfDir) writeChildrenHeader(leftSide, colWd, offset float64, displayO
 	dir.pdf.Line(leftSide, dir.pdf.GetY(), leftSide+colWd-offset-2.0, dir.pdf.GetY())
 	dir.pdf.SetY(dir.pdf.GetY() + dir.pdf.GetLineWidth() + displayOptions.LineSpacing)
 
-	dir.pdf.SetFont(dir.fontFamily, "B", dir.fontSize)
+	dir.setFont(dir.headerFontFamily, "B", dir.fontSize)
 	_, boldLineHeight := dir.pdf.GetFontSize()
 	lineHeight := boldLineHeight
 
-	textWidth := dir.pdf.GetStringWidth(dir.translate("Parents/Children"))
-	dir.pdf.CellFormat(textWidth, lineHeight, dir.translate("Parents/Children"), "", 0, "LC", false, 0, "")
+	textWidth := dir.stringWidth(dir.catalog.text("parents_children"))
+	dir.cell(textWidth, lineHeight, dir.catalog.text("parents_children"), "", 0, "LC", false)
 
 	if displayOptions.Age && displayOptions.Birthday {
 		dir.pdf.SetLeftMargin(leftSide + 60.0)
 		dir.pdf.SetX(leftSide + 60.0)
-		textWidth := dir.pdf.GetStringWidth(dir.translate("Age"))
-		dir.pdf.CellFormat(textWidth, lineHeight, dir.translate("Age"), "", 0, "LC", false, 0, "")
+		textWidth := dir.stringWidth(dir.catalog.text("age"))
+		dir.cell(textWidth, lineHeight, dir.catalog.text("age"), "", 0, "LC", false)
 
 		dir.pdf.SetLeftMargin(leftSide)
 		dir.pdf.SetX(leftSide)
 
-		dir.pdf.CellFormat(colWd-offset-2.0, lineHeight, dir.translate("Birthday"), "", 0, "RC", false, 0, "")
+		dir.cell(colWd-offset-2.0, lineHeight, dir.catalog.text("birthday"), "", 0, "RC", false)
 	} else if !displayOptions.Age && displayOptions.Birthday {
 		dir.pdf.SetLeftMargin(leftSide)
 		dir.pdf.SetX(leftSide)
 
-		dir.pdf.CellFormat(colWd-offset-2.0, lineHeight, dir.translate("Birthday"), "", 0, "RC", false, 0, "")
+		dir.cell(colWd-offset-2.0, lineHeight, dir.catalog.text("birthday"), "", 0, "RC", false)
 	} else if displayOptions.Age && !displayOptions.Birthday {
 		dir.pdf.SetLeftMargin(leftSide)
 		dir.pdf.SetX(leftSide)
 
-		dir.pdf.CellFormat(colWd-offset-2.0, lineHeight, dir.translate("Age"), "", 0, "RC", false, 0, "")
+		dir.cell(colWd-offset-2.0, lineHeight, dir.catalog.text("age"), "", 0, "RC", false)
 	}
 
 	dir.pdf.SetY(dir.pdf.GetY() + lineHeight)
 }
 
 func (dir *PdfDir) writeChildren(entries map[string]Household, header string, displayOptions Section) (err error) {
-	dir.pdf.SetLeftMargin(dir.leftMargin)
-	dir.pdf.SetTopMargin(dir.topMargin)
-	dir.pdf.SetRightMargin(dir.rightMargin)
 	dir.pdf.SetAutoPageBreak(true, dir.bottomMargin)
-
-	dir.pdf.AddPage()
+	dir.beginSection(displayOptions)
 	column := 0.0
 	leftOffset := 5.0
 	offset := dir.fontSize
@@ -1010,55 +1211,25 @@ func (dir *PdfDir) writeChildren(entries map[string]Household, header string, di
 		maxColumns = 3.0
 	}
 
-	dir.pdf.SetFont(dir.fontFamily, "", dir.fontSize+2.0)
-
-	dir.pdf.SetX(dir.leftMargin)
-	dir.pdf.SetLeftMargin(dir.leftMargin)
-
-	dir.pdf.SetFont(dir.fontFamily, "", dir.fontSize+2.0)
-
-	dir.pdf.SetX(dir.leftMargin)
-	dir.pdf.SetLeftMargin(dir.leftMargin)
-	_, boldLineHeight := dir.pdf.GetFontSize()
-	textWidth := dir.pdf.GetStringWidth(dir.translate(header))
-	dir.pdf.CellFormat(textWidth, boldLineHeight, dir.translate(header), "", 0, "LC", false, 0, "")
-	dir.pdf.SetFont(dir.fontFamily, "", dir.fontSize)
-
-	textWidth = dir.pdf.GetStringWidth(dir.translate(time.Now().Format("As of: 01/02/2006")))
-	leftMargin, _, _, _ := dir.pdf.GetMargins()
-	_, lineHeight := dir.pdf.GetFontSize()
-	width, _ := dir.pdf.GetPageSize()
-	dir.pdf.SetLeftMargin(width - textWidth - dir.rightMargin)
-	dir.pdf.CellFormat(textWidth, lineHeight, dir.translate(time.Now().Format("As of: 01/02/2006")), "", 0, "RC", false, 0, "")
-	dir.pdf.SetLeftMargin(leftMargin)
+	dir.writeHeader(header)
 	dir.pdf.SetY(dir.topMargin + offset)
 
 	width, height := dir.pdf.GetPageSize()
+	left, right := dir.pageMargins()
 
-	dir.pdf.SetDrawColor(0, 0, 0)
+	dir.setDrawColor(dir.style.rule)
 
-	colWd := (width - dir.leftMargin - dir.rightMargin) / maxColumns
+	colWd := (width - left - right) / maxColumns
 
-	leftSide := dir.leftMargin + (colWd * column)
+	leftSide := left + (colWd * column)
 	dir.writeChildrenHeader(leftSide, colWd, leftOffset, displayOptions)
 
-	dir.pdf.SetLeftMargin(dir.leftMargin)
-	dir.pdf.SetX(dir.leftMargin)
-
-	keys := make([]string, len(entries))
-	keyToId := make(map[string]string)
-
-	i := 0
-	for k := range entries {
-		keys[i] = entries[k].SortKey
-		keyToId[entries[k].SortKey] = k
-		i++
-	}
-	sort.Strings(keys)
+	dir.pdf.SetLeftMargin(left)
+	dir.pdf.SetX(left)
 
 householdLoop:
-	for _, k := range keys {
-		h := entries[keyToId[k]]
+	for _, h := range dir.sortHouseholds(entries, displayOptions) {
+		h = dir.resolveHousehold(h)
 
 		if h.Head != nil {
 			overrideOptions := dir.getSectionOverride(h.Head, displayOptions)
@@ -1083,9 +1254,9 @@ householdLoop:
 		rightSide := 0.0
 
 		_, lineHeight := dir.pdf.GetFontSize()
-		dir.pdf.SetFont(dir.fontFamily, "B", dir.fontSize)
+		dir.setFont(dir.nameFontFamily, "B", dir.fontSize)
 		_, boldLineHeight := dir.pdf.GetFontSize()
-		dir.pdf.SetFont(dir.fontFamily, "", dir.fontSize)
+		dir.setFont(dir.bodyFontFamily, "", dir.fontSize)
 
 		entryHeight := displayOptions.LineSpacing + dir.pdf.GetLineWidth() + displayOptions.LineSpacing + boldLineHeight + displayOptions.LineSpacing + (float64(len(h.Children)) * (lineHeight + displayOptions.LineSpacing))
 		if dir.pdf.GetY()+entryHeight > height-dir.bottomMargin {
@@ -1093,11 +1264,12 @@ householdLoop:
 				column = 0
 				firstPage = false
 				offset = 0
-				dir.pdf.AddPage()
-				dir.pdf.Line(colWd, dir.pdf.GetY(), colWd, height-dir.bottomMargin)
+				dir.addPage()
+				left, _ = dir.pageMargins()
+				dir.pdf.Line(left+colWd-childrenRuleInset, dir.pdf.GetY(), left+colWd-childrenRuleInset, height-dir.bottomMargin)
 			} else {
 				column++
-				dir.pdf.Line(colWd*column, dir.topMargin+offset, colWd*column, height-dir.bottomMargin)
+				dir.pdf.Line(left+colWd*column-childrenRuleInset, dir.topMargin+offset, left+colWd*column-childrenRuleInset, height-dir.bottomMargin)
 			}
 
 			if column == maxColumns-1 {
@@ -1110,15 +1282,15 @@ householdLoop:
 
 			if column == 0 {
 				leftOffset = 5.0
-				leftSide = dir.leftMargin + (colWd * column)
+				leftSide = left + (colWd * column)
 				rightSide = leftSide + colWd - leftOffset - 2.0
 			} else if column != maxColumns-1 {
 				leftOffset = 4.0
-				leftSide = dir.leftMargin + (colWd * column) - 1.0
+				leftSide = left + (colWd * column) - 1.0
 				rightSide = leftSide + colWd - leftOffset - 1.0
 			} else {
 				leftOffset = 0.0
-				leftSide = dir.leftMargin + (colWd * column) - 1.0
+				leftSide = left + (colWd * column) - 1.0
 				rightSide = leftSide + colWd - leftOffset - 2.0
 			}
 
@@ -1129,15 +1301,15 @@ householdLoop:
 
 		if column == 0 {
 			leftOffset = 5.0
-			leftSide = dir.leftMargin + (colWd * column)
+			leftSide = left + (colWd * column)
 			rightSide = leftSide + colWd - leftOffset - 2.0
 		} else if column != maxColumns-1 {
 			leftOffset = 5.0
-			leftSide = dir.leftMargin + (colWd * column) - 1.0
+			leftSide = left + (colWd * column) - 1.0
 			rightSide = leftSide + colWd - leftOffset - 1.0
 		} else {
 			leftOffset = 0.0
-			leftSide = dir.leftMargin + (colWd * column) - 1.0
+			leftSide = left + (colWd * column) - 1.0
 			rightSide = leftSide + colWd - leftOffset - 2.0
 		}
 
@@ -1146,20 +1318,9 @@ householdLoop:
 			overrideOptions = dir.getSectionOverride(h.Head, displayOptions)
 		}
 
-		str := ""
-		if h.Head != nil && overrideOptions.Show {
-			str = fmt.Sprintf("%s, %s", h.Head.LastName, h.Head.FirstName)
-		}
-
-		for _, m := range h.Members {
-			if h.Head != nil && m.LastName != h.Head.LastName && overrideOptions.Show {
-				str = fmt.Sprintf("%s and %s %s", str, m.FirstName, m.LastName)
-			} else if str != "" {
-				str = fmt.Sprintf("%s and %s", str, m.FirstName)
-			} else {
-				str = fmt.Sprintf("%s, %s", m.LastName, m.FirstName)
-			}
-		}
+		str := householdName(h, overrideOptions.Show)
+		dir.currentName = str
+		startPage := dir.pdf.PageNo()
 
 		_, originalFontHeight := dir.pdf.GetFontSize()
 
@@ -1169,9 +1330,9 @@ householdLoop:
 		dir.pdf.Line(leftSide, dir.pdf.GetY(), rightSide, dir.pdf.GetY())
 		dir.pdf.SetY(dir.pdf.GetY() + displayOptions.LineSpacing)
 
-		dir.pdf.SetFont(dir.fontFamily, "B", dir.fontSize)
-		dir.pdf.Write(dir.lineHeight, dir.translate(str))
-		dir.pdf.SetFont(dir.fontFamily, "", dir.fontSize)
+		dir.setFont(dir.nameFontFamily, "B", dir.fontSize)
+		dir.write(dir.lineHeight, str)
+		dir.setFont(dir.bodyFontFamily, "", dir.fontSize)
 		dir.pdf.SetY(dir.pdf.GetY() + originalFontHeight + displayOptions.LineSpacing)
 
 		var cKeys sort.StringSlice
@@ -1194,30 +1355,30 @@ householdLoop:
 
 			dir.pdf.SetLeftMargin(leftSide + 4.0)
 			dir.pdf.SetX(leftSide + 4.0)
-			dir.pdf.Write(dir.lineHeight, dir.translate(c.FirstName))
+			dir.write(dir.lineHeight, c.FirstName)
 
 			years, months, days, _, _, _ := dateDiff(c.Birthday, time.Now())
 			text := ""
 			if months == 0 && years == 0 {
-				text = fmt.Sprintf("%d days", days)
+				text = dir.catalog.text("age_days", days)
 			} else if years == 0 {
-				text = fmt.Sprintf("%d mos.", months)
+				text = dir.catalog.text("age_months", months)
 			} else {
-				text = fmt.Sprintf("%d", years)
+				text = dir.catalog.text("age_years", years)
 			}
 
 			if displayOptions.Age && displayOptions.Birthday {
 				dir.pdf.SetLeftMargin(leftSide + 60.0)
 				dir.pdf.SetX(leftSide + 60.0)
-				dir.pdf.Write(dir.lineHeight, dir.translate(text))
+				dir.write(dir.lineHeight, text)
 
 				dir.pdf.SetLeftMargin(leftSide)
 				dir.pdf.SetX(leftSide)
 
-				lineWidth := dir.pdf.GetStringWidth(dir.translate(c.Birthday.Format("Jan 02, 2006")))
+				lineWidth := dir.stringWidth(dir.catalog.date(c.Birthday, "birthday_long"))
 				lMargin, _, rMargin, _ := dir.pdf.GetMargins()
 				dir.pdf.SetLeftMargin(lMargin + ((colWd - leftOffset) - lineWidth) - rMargin)
-				dir.pdf.Write(dir.lineHeight, dir.translate(c.Birthday.Format("Jan 02, 2006")))
+				dir.write(dir.lineHeight, dir.catalog.date(c.Birthday, "birthday_long"))
 				dir.pdf.SetLeftMargin(lMargin)
 
 				dir.pdf.SetY(dir.pdf.GetY() + originalFontHeight + displayOptions.LineSpacing)
@@ -1225,10 +1386,10 @@ householdLoop:
 				dir.pdf.SetLeftMargin(leftSide)
 				dir.pdf.SetX(leftSide)
 
-				lineWidth := dir.pdf.GetStringWidth(dir.translate(text))
+				lineWidth := dir.stringWidth(text)
 				lMargin, _, rMargin, _ := dir.pdf.GetMargins()
 				dir.pdf.SetLeftMargin(lMargin + ((colWd - leftOffset) - lineWidth) - rMargin)
-				dir.pdf.Write(dir.lineHeight, dir.translate(text))
+				dir.write(dir.lineHeight, text)
 				dir.pdf.SetLeftMargin(lMargin)
 
 				dir.pdf.SetY(dir.pdf.GetY() + originalFontHeight + displayOptions.LineSpacing)
@@ -1236,10 +1397,10 @@ householdLoop:
 				dir.pdf.SetLeftMargin(leftSide)
 				dir.pdf.SetX(leftSide)
 
-				lineWidth := dir.pdf.GetStringWidth(dir.translate(c.Birthday.Format("Jan 02, 2006")))
+				lineWidth := dir.stringWidth(dir.catalog.date(c.Birthday, "birthday_long"))
 				lMargin, _, rMargin, _ := dir.pdf.GetMargins()
 				dir.pdf.SetLeftMargin(lMargin + ((colWd - leftOffset) - lineWidth) - rMargin)
-				dir.pdf.Write(dir.lineHeight, dir.translate(c.Birthday.Format("Jan 02, 2006")))
+				dir.write(dir.lineHeight, dir.catalog.date(c.Birthday, "birthday_long"))
 				dir.pdf.SetLeftMargin(lMargin)
 
 				dir.pdf.SetY(dir.pdf.GetY() + originalFontHeight + displayOptions.LineSpacing)
@@ -1248,6 +1409,7 @@ householdLoop:
 			}
 		}
 		dir.pdf.SetY(dir.pdf.GetY() - displayOptions.LineSpacing)
+		dir.checkSplit(startPage)
 	}
 
 	return nil
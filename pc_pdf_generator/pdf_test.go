@@ -0,0 +1,78 @@
+package pc_pdf_generator
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"unicode"
+
+	"google.golang.org/appengine/aetest"
+)
+
+// TestLayoutMultilingualFixture prints the multilingual fixture the way
+// generatePDF does, checks every name found a font with its glyphs, and
+// checks the first page rasterizes to more than a blank page.
+func TestLayoutMultilingualFixture(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	// Fonts, locales, presets and fixtures are read from the app's root.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	preset, err := loadPreset("standard")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pcDl := &PCDownloader{ctx: ctx, domain: "test", fixture: "multilingual_households"}
+	pdfDir, report, err := layoutDirectory(&preset.Config, pcDl, "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Sections) == 0 {
+		t.Error("the report has no sections")
+	}
+
+	// No CJK font is bundled, so only the Korean names may go without
+	// glyphs.
+	for r := range pdfDir.missingGlyphs {
+		if !unicode.Is(unicode.Hangul, r) {
+			t.Errorf("no font has a glyph for %q (%U)", r, r)
+		}
+	}
+
+	var out bytes.Buffer
+	err = pdfDir.pdf.Output(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages, err := rasterizePDF(out.Bytes(), 1, 72)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 {
+		t.Fatalf("rasterized %d pages, want 1", len(pages))
+	}
+
+	inked := 0
+	img := pages[0]
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i] < 128 && img.Pix[i+1] < 128 && img.Pix[i+2] < 128 {
+			inked++
+		}
+	}
+	if inked < 100 {
+		t.Errorf("page 1 has %d dark pixels; want the entries printed", inked)
+	}
+}
@@ -0,0 +1,259 @@
+package pc_pdf_generator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	sectionTypePhotoGrid = "photo_grid"
+
+	captionAddress  = "address"
+	captionCity     = "city"
+	captionPhone    = "phone"
+	captionEmail    = "email"
+	captionChildren = "children"
+
+	defaultGridColumns = 4
+	defaultGridRows    = 5
+
+	// minGridPhotoHeight is the shortest photo, in mm, a grid cell prints.
+	minGridPhotoHeight = 5.0
+)
+
+// gridSize returns the section's columns and rows, with the defaults.
+func gridSize(displayOptions Section) (columns int, rows int) {
+	columns = displayOptions.GridColumns
+	if columns < 1 {
+		columns = defaultGridColumns
+	}
+
+	rows = displayOptions.GridRows
+	if rows < 1 {
+		rows = defaultGridRows
+	}
+
+	return columns, rows
+}
+
+// gridCaptionLines is how many lines a grid caption may take: the name and
+// one for each caption field.
+func gridCaptionLines(displayOptions Section) int {
+	lines := 1
+	for _, field := range strings.Split(displayOptions.CaptionFields, ",") {
+		if strings.TrimSpace(field) != "" {
+			lines++
+		}
+	}
+
+	return lines
+}
+
+// gridImage returns the image, registered at the spec's size, that stands
+// for the household in the grid: the family photo when the section asks for
+// it, otherwise the head's avatar or the first member's. It returns "" if
+// there is none.
+func (dir *PdfDir) gridImage(bucket *storage.BucketHandle, spec thumbnailSpec, h Household, displayOptions Section) string {
+	if displayOptions.HouseholdPhoto {
+		if image := dir.householdImage(bucket, spec, h); image != "" {
+			return image
+		}
+	}
+
+	if h.Head != nil {
+		if image := dir.personImage(bucket, spec, h.Head); image != "" {
+			return image
+		}
+	}
+
+	for _, m := range h.Members {
+		if image := dir.personImage(bucket, spec, m); image != "" {
+			return image
+		}
+	}
+
+	return dir.placeholderImage(bucket, spec)
+}
+
+// gridCaption returns the lines printed under a household's photo, the
+// household name first and then the configured caption fields in order.
+func (dir *PdfDir) gridCaption(h Household, displayOptions Section) (lines []string) {
+	lines = append(lines, householdName(h, displayOptions.Show))
+
+	contact := h.Head
+	if contact == nil && len(h.Members) > 0 {
+		contact = h.Members[0]
+	}
+	if contact == nil {
+		return lines
+	}
+
+	for _, field := range strings.Split(displayOptions.CaptionFields, ",") {
+		text := ""
+
+		switch strings.TrimSpace(field) {
+		case captionAddress:
+			if displayOptions.Address {
+				text = strings.TrimSpace(contact.Address1 + " " + contact.Address2)
+			}
+		case captionCity:
+			if displayOptions.City && contact.City != "" {
+				text = contact.City
+				if displayOptions.State && contact.State != "" {
+					text = text + ", " + contact.State
+				}
+			}
+		case captionPhone:
+			if displayOptions.Phones && contact.CellPhone != 0 {
+				text = phoneNumber(contact.CellPhone)
+			}
+		case captionEmail:
+			if displayOptions.Email {
+				text = contact.EmailAddress
+			}
+		case captionChildren:
+			names := []string{}
+			for _, c := range h.Children {
+				names = append(names, c.FirstName)
+			}
+			sort.Strings(names)
+			text = strings.Join(names, ", ")
+		}
+
+		if text != "" {
+			lines = append(lines, text)
+		}
+	}
+
+	return lines
+}
+
+// writePhotoGrid lays out a pictorial directory: one photo per household in
+// a GridColumns x GridRows grid, with the caption centered under each photo.
+func (dir *PdfDir) writePhotoGrid(entries map[string]Household, header string, displayOptions Section) (err error) {
+	dir.pdf.SetTopMargin(dir.topMargin)
+	dir.pdf.SetAutoPageBreak(false, dir.bottomMargin)
+
+	client, bucket, err := defaultBucket(dir.ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	columns, rows := gridSize(displayOptions)
+	captionLines := gridCaptionLines(displayOptions)
+
+	cell := 0
+	var gridTop, cellWd, cellHt, photoHt float64
+	spec := dir.thumbnail
+
+	for _, h := range dir.sortHouseholds(entries, displayOptions) {
+		h = dir.resolveHousehold(h)
+		overrideOptions := displayOptions
+		if h.Head != nil {
+			overrideOptions = dir.getSectionOverride(h.Head, displayOptions)
+			if !overrideOptions.ShowHousehold {
+				continue
+			}
+		}
+
+		if cell%(columns*rows) == 0 {
+			if cell == 0 {
+				dir.beginSection(displayOptions)
+			} else {
+				dir.addPage()
+			}
+			dir.writeHeader(header)
+
+			width, height := dir.pdf.GetPageSize()
+			left, right := dir.pageMargins()
+
+			gridTop = dir.pdf.GetY()
+			cellWd = (width - left - right - float64(columns-1)*dir.gutter) / float64(columns)
+			cellHt = (height - dir.bottomMargin - gridTop - float64(rows-1)*dir.padding) / float64(rows)
+			photoHt = cellHt - float64(captionLines)*dir.lineHeight - dir.imagePadding
+
+			// Validation leaves room for photos, but not for the header.
+			// Without it, the captions are printed alone.
+			if photoHt < minGridPhotoHeight {
+				if cell == 0 {
+					dir.layoutIssues = append(dir.layoutIssues, LayoutIssue{
+						Section: dir.currentSection,
+						Page:    dir.pdf.PageNo(),
+						Problem: fmt.Sprintf("grid cells leave %.1fmm for photos, so none are printed", photoHt),
+					})
+				}
+				photoHt = 0
+			}
+
+			// Photos are cropped to the cell, not to the entry photos.
+			spec = dir.thumbnail.sized(cellWd, photoHt)
+		}
+
+		left, _ := dir.pageMargins()
+		column := cell % columns
+		row := (cell / columns) % rows
+
+		x := left + float64(column)*(cellWd+dir.gutter)
+		y := gridTop + float64(row)*(cellHt+dir.padding)
+
+		dir.currentName = householdName(h, overrideOptions.Show)
+		if photoHt > 0 {
+			dir.writeGridPhoto(dir.gridImage(bucket, spec, h, overrideOptions), h, x, y, cellWd, photoHt)
+		}
+		dir.pdf.SetLeftMargin(x)
+		dir.pdf.SetXY(x, y+photoHt+dir.imagePadding)
+		for i, line := range dir.gridCaption(h, overrideOptions) {
+			if i == 0 {
+				dir.setFont(dir.nameFontFamily, "B", dir.fontSize)
+			} else {
+				dir.setFont(dir.bodyFontFamily, "", dir.fontSize)
+			}
+			dir.shrinkedCell(cellWd, dir.lineHeight, line, "", "C", false)
+		}
+
+		cell++
+	}
+
+	left, _ := dir.pageMargins()
+	dir.pdf.SetLeftMargin(left)
+	dir.pdf.SetAutoPageBreak(true, dir.bottomMargin)
+
+	return nil
+}
+
+// writeGridPhoto fits the household's photo inside the box, centered and
+// keeping its aspect ratio. Households without a photo get a placeholder,
+// or an empty frame if placeholders are off.
+func (dir *PdfDir) writeGridPhoto(image string, h Household, x, y, boxWd, boxHt float64) {
+	if image == "" && dir.placeholderStyle != "" {
+		contact := h.Head
+		if contact == nil && len(h.Members) > 0 {
+			contact = h.Members[0]
+		}
+		if contact != nil {
+			dir.writePlaceholder(*contact, x, y, boxWd, boxHt)
+			return
+		}
+	}
+
+	if image == "" {
+		dir.setDrawColor(dir.style.emptyPhoto)
+		dir.pdf.Rect(x, y, boxWd, boxHt, "D")
+		dir.setDrawColor(dir.style.rule)
+		return
+	}
+
+	info := dir.pdf.GetImageInfo(image)
+	imageWd, imageHt := boxWd, boxWd*info.Height()/info.Width()
+	if imageHt > boxHt {
+		imageWd, imageHt = boxHt*info.Width()/info.Height(), boxHt
+	}
+
+	dir.pdf.Image(image, x+(boxWd-imageWd)/2, y+(boxHt-imageHt)/2, imageWd, imageHt, false, "", 0, "")
+	dir.writePhotoBorder(x+(boxWd-imageWd)/2, y+(boxHt-imageHt)/2, imageWd, imageHt)
+	dir.checkImageDPI(info, imageWd)
+}
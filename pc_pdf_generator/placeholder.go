@@ -0,0 +1,126 @@
+package pc_pdf_generator
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	placeholderCircle     = "circle"
+	placeholderSquare     = "square"
+	placeholderSilhouette = "silhouette"
+	placeholderImageName  = "placeholder"
+
+	defaultPlaceholderTints = "#8E9AAF,#A3B18A,#CB997E,#6D9DC5,#B5838D,#E0A458"
+)
+
+type rgbColor struct {
+	r, g, b int
+}
+
+func placeholderObject(domain string) string {
+	return domain + "/jpgs/placeholder"
+}
+
+// parsePlaceholderTints reads a comma separated list of #RRGGBB colors,
+// falling back to the default palette when none are valid.
+func parsePlaceholderTints(list string) (colors []rgbColor) {
+	for _, hex := range strings.Split(list, ",") {
+		if color, ok := parseHexColor(hex); ok {
+			colors = append(colors, color)
+		}
+	}
+
+	if len(colors) == 0 && list != defaultPlaceholderTints {
+		return parsePlaceholderTints(defaultPlaceholderTints)
+	}
+
+	return colors
+}
+
+// parseHexColor reads a #RRGGBB color. The # may be left out.
+func parseHexColor(hex string) (color rgbColor, ok bool) {
+	hex = strings.TrimPrefix(strings.TrimSpace(hex), "#")
+	if len(hex) != 6 {
+		return color, false
+	}
+
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color, false
+	}
+
+	return rgbColor{int(value >> 16 & 0xFF), int(value >> 8 & 0xFF), int(value & 0xFF)}, true
+}
+
+func initials(person Person) (str string) {
+	for _, name := range []string{person.FirstName, person.LastName} {
+		for _, r := range strings.TrimSpace(name) {
+			str += string(unicode.ToUpper(r))
+			break
+		}
+	}
+
+	return str
+}
+
+// placeholderImage registers the organization's silhouette at the spec's
+// size, if the placeholder style asks for one and it has been uploaded, and
+// returns its image name or "".
+func (dir *PdfDir) placeholderImage(bucket *storage.BucketHandle, spec thumbnailSpec) string {
+	if dir.placeholderStyle != placeholderSilhouette || dir.noSilhouette {
+		return ""
+	}
+
+	image := dir.registerThumbnail(bucket, spec, placeholderImageName, placeholderObject(dir.domain))
+	dir.noSilhouette = image == ""
+
+	return image
+}
+
+// writePlaceholder fills a photo box for someone without a photo with their
+// initials on a tinted circle or square. The tint is picked from the palette
+// by person ID so it doesn't change between runs. A silhouette style without
+// an uploaded silhouette uses circles.
+func (dir *PdfDir) writePlaceholder(person Person, x, y, boxWd, boxHt float64) {
+	if dir.placeholderStyle == "" || len(dir.placeholderTints) == 0 {
+		return
+	}
+
+	hash := fnv.New32a()
+	fmt.Fprint(hash, person.Id)
+	tint := dir.placeholderTints[hash.Sum32()%uint32(len(dir.placeholderTints))]
+
+	dir.setFillColor(tint)
+	side := math.Min(boxWd, boxHt)
+	if dir.placeholderStyle == placeholderSquare {
+		dir.pdf.Rect(x, y, boxWd, boxHt, "F")
+	} else {
+		dir.pdf.Circle(x+boxWd/2, y+boxHt/2, side/2, "F")
+	}
+
+	// Dark initials on light tints, white on dark ones.
+	if tint.r*299+tint.g*587+tint.b*114 > 150000 {
+		dir.setTextColor(rgbColor{60, 60, 60})
+	} else {
+		dir.setTextColor(rgbColor{255, 255, 255})
+	}
+
+	family, style := dir.currentFamily, dir.currentStyle
+	size, _ := dir.pdf.GetFontSize()
+	lastX, lastY := dir.pdf.GetXY()
+
+	dir.setFont(dir.placeholderFont, "B", side*0.4*dir.pdf.GetConversionRatio())
+	dir.pdf.SetXY(x, y)
+	dir.cell(boxWd, boxHt, initials(person), "", 0, "CM", false)
+
+	dir.setFont(family, style, size)
+	dir.setTextColor(dir.style.text)
+	dir.pdf.SetXY(lastX, lastY)
+}
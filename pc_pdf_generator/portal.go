@@ -0,0 +1,182 @@
+package pc_pdf_generator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	memberPath = "/me"
+
+	// A login is for the staff app or the member portal. A member login
+	// only reaches the portal's endpoints.
+	loginStaff  = "staff"
+	loginMember = "member"
+)
+
+var errNoPersonId = errors.New("your Planning Center login has no person ID")
+
+// memberFields are the override fields members can hide for themselves.
+var memberFields = []string{"phones", "email", "address", "birthday", "photo"}
+
+// MemberChoice is one toggle in the portal. A locked field was hidden by
+// staff, and only staff can show it again.
+type MemberChoice struct {
+	Field  string `json:"field"`
+	Shown  bool   `json:"shown"`
+	Locked bool   `json:"locked"`
+}
+
+type MemberPreferences struct {
+	PersonId string         `json:"person_id"`
+	Name     string         `json:"name"`
+	Choices  []MemberChoice `json:"choices"`
+	Updated  time.Time      `json:"updated"`
+}
+
+func memberPreferences(personId string, name string, override Override) MemberPreferences {
+	prefs := MemberPreferences{PersonId: personId, Name: name, Updated: override.Updated}
+
+	for _, field := range memberFields {
+		current := override.Fields[field]
+		prefs.Choices = append(prefs.Choices, MemberChoice{
+			Field:  field,
+			Shown:  current.Mode != overrideHide,
+			Locked: current.Mode == overrideHide && current.Source != changeByMember,
+		})
+	}
+
+	return prefs
+}
+
+// applyMemberChoices returns the override with the member's fields hidden or
+// shown. Showing only undoes the member's own hiding, so fields staff hid
+// stay hidden, and nothing else in the override changes.
+func applyMemberChoices(override Override, shown map[string]bool) Override {
+	fields := make(map[string]FieldOverride, len(override.Fields))
+	for name, field := range override.Fields {
+		fields[name] = field
+	}
+
+	for _, name := range memberFields {
+		show, ok := shown[name]
+		if !ok {
+			continue
+		}
+
+		field := fields[name]
+		if !show && field.Mode != overrideHide {
+			field.Mode = overrideHide
+			field.Source = changeByMember
+		}
+		if show && field.Mode == overrideHide && field.Source == changeByMember {
+			field.Mode = ""
+			field.Source = ""
+		}
+
+		if field == (FieldOverride{}) {
+			delete(fields, name)
+		} else {
+			fields[name] = field
+		}
+	}
+
+	override.Fields = fields
+
+	return override
+}
+
+func loadMemberPreferences(ctx context.Context, personId string, name string) (prefs MemberPreferences, err error) {
+	overrides, err := loadOverrides(ctx)
+	if err != nil {
+		return prefs, err
+	}
+
+	return memberPreferences(personId, name, overrides.People[personId]), nil
+}
+
+// saveMemberChoices writes a member's choices into their override and adds
+// what changed to the audit trail.
+func saveMemberChoices(ctx context.Context, personId string, name string, shown map[string]bool) (prefs MemberPreferences, err error) {
+	if personId == "" {
+		return prefs, errNoPersonId
+	}
+
+	now := time.Now()
+	var saved Override
+
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) (err error) {
+		overrides, err := loadOverrides(tc)
+		if err != nil {
+			return err
+		}
+
+		before := overrides.People[personId]
+		saved = applyMemberChoices(before, shown)
+		saved.PersonId = personId
+		if saved.Name == "" {
+			saved.Name = name
+		}
+
+		changes := overrideChanges(before, saved, personId, changeByMember, now)
+		if len(changes) == 0 {
+			return nil
+		}
+
+		saved.Updated = now
+		saved.UpdatedBy = personId
+		overrides.People[personId] = saved
+
+		err = saveOverrides(tc, overrides, OverridesRevision{Author: personId, AuthorName: name, Source: changeByMember})
+		if err != nil {
+			return err
+		}
+
+		return saveOverrideChanges(tc, changes)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return prefs, err
+	}
+
+	return memberPreferences(personId, name, saved), nil
+}
+
+// writeMemberPreview lays out the logged in member's household, everyone in
+// it, the way the first section of the default config prints it, with their
+// choices applied.
+func writeMemberPreview(config *Config, pcDl *PCDownloader, w io.Writer) (err error) {
+	if len(config.Sections) == 0 {
+		return fmt.Errorf("no directory config has been saved yet")
+	}
+
+	personId, err := strconv.Atoi(pcDl.personId)
+	if err != nil {
+		return fmt.Errorf("can't read person ID %q", pcDl.personId)
+	}
+
+	pdfDir, err := newPdfDir(config, pcDl, "")
+	if err != nil {
+		return err
+	}
+	pcDl.thumbnail = pdfDir.thumbnail
+
+	households, err := pcDl.downloadHouseholdOf(personId)
+	if err != nil {
+		return err
+	}
+
+	section := config.Sections[0]
+	section.Show = true
+	err = pdfDir.writeSection(households, section.Header, section)
+	if err != nil {
+		return err
+	}
+
+	return pdfDir.pdf.Output(w)
+}
@@ -0,0 +1,74 @@
+package pc_pdf_generator
+
+import (
+	"fmt"
+)
+
+const defaultPreflightMinFontSize = 6.0
+
+// LayoutIssue is text that didn't fit where the layout put it, or a photo
+// too coarse for the output profile.
+type LayoutIssue struct {
+	Section string `json:"section"`
+	Name    string `json:"name"`
+	Page    int    `json:"page"`
+	Problem string `json:"problem"`
+}
+
+func preflightMinFontSize(config *Config) float64 {
+	if config.MinFontSize <= 0 {
+		return defaultPreflightMinFontSize
+	}
+
+	return config.MinFontSize
+}
+
+// checkShrink records text that shrinkedCell had to set smaller than the
+// preflight threshold to fit its width.
+func (dir *PdfDir) checkShrink(str string, fontSize float64) {
+	if fontSize >= dir.minFontSize {
+		return
+	}
+
+	dir.layoutIssues = append(dir.layoutIssues, LayoutIssue{
+		Section: dir.currentSection,
+		Name:    dir.currentName,
+		Page:    dir.pdf.PageNo(),
+		Problem: fmt.Sprintf("%q shrank to %.1fpt", str, fontSize),
+	})
+}
+
+// checkOverflow records an entry whose lines ran past its height. One that
+// ran onto another page is left to checkSplit.
+func (dir *PdfDir) checkOverflow(startY float64, startPage int, entryHeight float64) {
+	if dir.pdf.PageNo() != startPage {
+		return
+	}
+
+	used := dir.pdf.GetY() - startY
+	if used <= entryHeight+0.01 {
+		return
+	}
+
+	dir.layoutIssues = append(dir.layoutIssues, LayoutIssue{
+		Section: dir.currentSection,
+		Name:    dir.currentName,
+		Page:    dir.pdf.PageNo(),
+		Problem: fmt.Sprintf("needs %.1fmm but the row height is %.1fmm", used, entryHeight),
+	})
+}
+
+// checkSplit records an entry that gofpdf's automatic page break carried on
+// from startPage, leaving the rest of it at the top of the next page.
+func (dir *PdfDir) checkSplit(startPage int) {
+	if dir.pdf.PageNo() == startPage {
+		return
+	}
+
+	dir.layoutIssues = append(dir.layoutIssues, LayoutIssue{
+		Section: dir.currentSection,
+		Name:    dir.currentName,
+		Page:    startPage,
+		Problem: "split across pages by an automatic page break",
+	})
+}
@@ -0,0 +1,135 @@
+package pc_pdf_generator
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	previewDPI      = 96
+	maxPreviewPages = 2
+
+	// previewGap is the gray space between stacked preview pages, in pixels.
+	previewGap = 16
+)
+
+// writePreview lays out the start of one section of the config, with only
+// as many households as could fill the pages previewed, and returns the PDF
+// uncompressed for rasterizePDF. Nothing is uploaded or saved.
+func writePreview(config *Config, pcDl *PCDownloader, index int, pages int) (pdf []byte, err error) {
+	if index < 0 || index >= len(config.Sections) {
+		return pdf, fmt.Errorf("the config has no section %d", index)
+	}
+	if index > 8 && config.Sections[index].Type != sectionTypePhotoGrid {
+		return pdf, fmt.Errorf("section %d has a type that isn't printed", index)
+	}
+
+	section := config.Sections[index]
+	section.Show = true
+
+	// The children and first name sections list the members of the first.
+	listName := section.ListName
+	if listName == "" || index == 3 || index == 8 {
+		listName = config.Sections[0].ListName
+	}
+
+	pdfDir, err := newPdfDir(config, pcDl, "")
+	if err != nil {
+		return pdf, err
+	}
+	pdfDir.pdf.SetCompression(false)
+	pcDl.thumbnail = pdfDir.thumbnail
+
+	households, err := pcDl.downloadList(listName)
+	if err != nil {
+		return pdf, err
+	}
+	households = pdfDir.sampleHouseholds(households, section, pages)
+
+	switch {
+	case index == 3:
+		err = pdfDir.writeChildren(households, section.Header, section)
+	case index == 8:
+		err = pdfDir.writeFirstNames(households, section.Header, section)
+	case section.Type == sectionTypePhotoGrid:
+		err = pdfDir.writePhotoGrid(households, section.Header, section)
+	default:
+		err = pdfDir.writeSection(households, section.Header, section)
+	}
+	if err != nil {
+		return pdf, err
+	}
+
+	if pdfDir.outputProfile == outputProfileOffset {
+		pdfDir.writePrinterMarks()
+	}
+
+	var out bytes.Buffer
+	err = pdfDir.pdf.Output(&out)
+
+	return out.Bytes(), err
+}
+
+// sampleHouseholds returns the first households in the section's order: as
+// many as fit the pages if each took no more than a column height, or a
+// grid cell.
+func (dir *PdfDir) sampleHouseholds(entries map[string]Household, displayOptions Section, pages int) map[string]Household {
+	_, height := dir.sectionPageSize(displayOptions)
+
+	perPage := 0
+	if displayOptions.Type == sectionTypePhotoGrid {
+		columns, rows := displayOptions.GridColumns, displayOptions.GridRows
+		if columns < 1 {
+			columns = defaultGridColumns
+		}
+		if rows < 1 {
+			rows = defaultGridRows
+		}
+		perPage = columns * rows
+	} else if dir.columnHeight > 0 {
+		perPage = int(math.Ceil((height-dir.topMargin-dir.bottomMargin)/dir.columnHeight) * dir.colNum)
+	}
+	if perPage <= 0 {
+		return entries
+	}
+
+	sample := make(map[string]Household)
+	for _, h := range dir.sortHouseholds(entries, displayOptions) {
+		if len(sample) >= perPage*pages {
+			break
+		}
+		sample[h.Id] = h
+	}
+
+	return sample
+}
+
+// stackPages puts preview pages one above the other.
+func stackPages(pages []*image.RGBA) *image.RGBA {
+	width, height := 0, 0
+	for i, page := range pages {
+		if page.Bounds().Dx() > width {
+			width = page.Bounds().Dx()
+		}
+		if i > 0 {
+			height += previewGap
+		}
+		height += page.Bounds().Dy()
+	}
+
+	stacked := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(stacked, stacked.Bounds(), image.NewUniform(color.Gray{Y: 0xcc}), image.Point{}, draw.Src)
+
+	y := 0
+	for _, page := range pages {
+		draw.Draw(stacked, page.Bounds().Add(image.Pt(0, y)), page, page.Bounds().Min, draw.Src)
+		y += page.Bounds().Dy() + previewGap
+	}
+
+	return stacked
+}
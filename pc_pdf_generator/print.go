@@ -0,0 +1,190 @@
+package pc_pdf_generator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+const (
+	outputProfileOffset = "offset"
+
+	defaultOffsetBleed = 3.0
+	defaultMinImageDPI = 300.0
+
+	// markSlug is the room, in mm, left outside the bleed for printer's
+	// marks. It's trimmed off with the bleed.
+	markSlug           = 12.0
+	cropMarkLength     = 6.0
+	registrationRadius = 2.5
+	markLineWidth      = 0.25
+
+	// registrationColor is the spot color marks are drawn in, so they print
+	// on every plate.
+	registrationColor = "All"
+
+	// processBlack is the spot color everything else is drawn in. Named
+	// Black, it prints on the process black plate rather than a plate of
+	// its own, so text and rules never need four plates to line up.
+	processBlack = "Black"
+)
+
+var outputProfiles = []string{"", outputProfileOffset}
+
+// printGeometry returns the bleed around each page, and the slug outside
+// it for printer's marks, for the config's output profile. Offset printing
+// always has a bleed.
+func printGeometry(config *Config) (bleed float64, slug float64) {
+	if config.OutputProfile != outputProfileOffset {
+		return config.Bleed, 0
+	}
+
+	if config.Bleed <= 0 {
+		return defaultOffsetBleed, markSlug
+	}
+
+	return config.Bleed, markSlug
+}
+
+// minImageDPI is the resolution photos are checked against, or 0 when the
+// output profile doesn't check them.
+func minImageDPI(config *Config) float64 {
+	if config.OutputProfile != outputProfileOffset {
+		return 0
+	}
+
+	if config.MinImageDPI <= 0 {
+		return defaultMinImageDPI
+	}
+
+	return config.MinImageDPI
+}
+
+// blackTint is the percentage of black that prints c. Offset configs only
+// take grays; other colors print as the gray of their luminance.
+func blackTint(c rgbColor) byte {
+	luma := (c.r*299 + c.g*587 + c.b*114) / 1000
+	return byte((255 - luma) * 100 / 255)
+}
+
+// isGray reports whether c prints the same in black alone.
+func isGray(c rgbColor) bool {
+	return c.r == c.g && c.g == c.b
+}
+
+// checkImageDPI records a photo drawn width mm wide with fewer dots per
+// inch than the output profile needs.
+func (dir *PdfDir) checkImageDPI(info *gofpdf.ImageInfoType, width float64) {
+	if dir.minImageDPI <= 0 || info == nil || width <= 0 {
+		return
+	}
+
+	// gofpdf sizes JPEGs at 72 dpi, so Width in points is their pixels.
+	dpi := info.Width() * dir.pdf.GetConversionRatio() / (width / 25.4)
+	if dpi >= dir.minImageDPI-0.5 {
+		return
+	}
+
+	dir.lowResImages++
+	dir.layoutIssues = append(dir.layoutIssues, LayoutIssue{
+		Section: dir.currentSection,
+		Name:    dir.currentName,
+		Page:    dir.pdf.PageNo(),
+		Problem: fmt.Sprintf("photo prints at %.0f dpi, under %.0f", dpi, dir.minImageDPI),
+	})
+}
+
+// unembeddedFonts lists the families the directory prints with that are
+// core PDF fonts, which gofpdf leaves to the reader instead of embedding.
+func (dir *PdfDir) unembeddedFonts() (families []string) {
+	used := append([]string{dir.headerFontFamily, dir.nameFontFamily, dir.bodyFontFamily, dir.placeholderFont}, dir.fallbackFonts...)
+	for _, family := range used {
+		if hasFont(coreFonts, family) && !hasFont(families, family) {
+			families = append(families, family)
+		}
+	}
+
+	return families
+}
+
+// finishOffsetPDF readies a laid out directory for the print shop, or says
+// why it can't be: every font has to be embedded and every photo sharp
+// enough. This is PDF/X in spirit only: text, rules and theme colors are
+// in process black, but photos stay RGB for the shop's RIP to separate.
+func (dir *PdfDir) finishOffsetPDF() (err error) {
+	if families := dir.unembeddedFonts(); len(families) > 0 {
+		return fmt.Errorf("offset printing needs embedded fonts, and %s can't be embedded", strings.Join(families, ", "))
+	}
+
+	if dir.lowResImages > 0 {
+		return fmt.Errorf("%d photos print under %.0f dpi; see the data report", dir.lowResImages, dir.minImageDPI)
+	}
+
+	dir.writePrinterMarks()
+
+	return dir.pdf.Error()
+}
+
+// writePrinterMarks gives every page its trim and bleed boxes, and draws
+// crop marks at the trim corners and registration targets on each side, in
+// the slug outside the bleed.
+func (dir *PdfDir) writePrinterMarks() {
+	dir.pdf.AddSpotColor(registrationColor, 100, 100, 100, 100)
+
+	for page := 1; page <= dir.pdf.PageCount(); page++ {
+		dir.pdf.SetPage(page)
+		width, height, _ := dir.pdf.PageSize(page)
+		box := dir.trimBox(width, height)
+
+		dir.pdf.SetPageBox("trim", box.x, box.y, box.w, box.h)
+		dir.pdf.SetPageBox("bleed", box.x-dir.bleed, box.y-dir.bleed, box.w+dir.bleed*2, box.h+dir.bleed*2)
+
+		dir.pdf.SetAlpha(1, "Normal")
+		dir.pdf.SetLineWidth(markLineWidth)
+		dir.pdf.SetDrawSpotColor(registrationColor, 100)
+		dir.writeCropMarks(box)
+		dir.writeRegistrationMarks(box)
+	}
+
+	dir.setDrawColor(dir.style.rule)
+}
+
+// writeCropMarks draws a pair of lines off each corner of the trim box,
+// starting clear of the bleed so none of them print on the page.
+func (dir *PdfDir) writeCropMarks(box pageRect) {
+	start, end := dir.bleed, dir.bleed+cropMarkLength
+	for _, x := range []float64{box.x, box.x + box.w} {
+		for _, y := range []float64{box.y, box.y + box.h} {
+			dx, dy := 1.0, 1.0
+			if x == box.x {
+				dx = -1
+			}
+			if y == box.y {
+				dy = -1
+			}
+
+			dir.pdf.Line(x+dx*start, y, x+dx*end, y)
+			dir.pdf.Line(x, y+dy*start, x, y+dy*end)
+		}
+	}
+}
+
+// writeRegistrationMarks draws a target, a circle on a cross, centered in
+// the slug beside each edge of the trim box.
+func (dir *PdfDir) writeRegistrationMarks(box pageRect) {
+	distance := dir.bleed + dir.slug/2
+	centers := [][2]float64{
+		{box.x + box.w/2, box.y - distance},
+		{box.x + box.w/2, box.y + box.h + distance},
+		{box.x - distance, box.y + box.h/2},
+		{box.x + box.w + distance, box.y + box.h/2},
+	}
+
+	arm := registrationRadius * 1.6
+	for _, c := range centers {
+		dir.pdf.Circle(c[0], c[1], registrationRadius, "D")
+		dir.pdf.Line(c[0]-arm, c[1], c[0]+arm, c[1])
+		dir.pdf.Line(c[0], c[1]-arm, c[0], c[1]+arm)
+	}
+}
@@ -0,0 +1,1321 @@
+package pc_pdf_generator
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/f64"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// The rasterizer reads the PDFs gofpdf writes with compression off: paths,
+// text in the embedded TrueType fonts and JPEG images. It leaves out
+// clipping, dashes, shadings and other image formats, and draws the standard
+// PDF fonts, which aren't embedded, with the Go fonts.
+
+type pdfName string
+type pdfRef int
+type pdfDict map[string]interface{}
+type pdfOperator string
+
+type pdfStream struct {
+	dict pdfDict
+	data []byte
+}
+
+type pdfDocument struct {
+	objects map[int]interface{}
+	trailer pdfDict
+	fonts   map[pdfRef]*rasterFont
+}
+
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+func (l *pdfLexer) word() string {
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+
+	return string(l.data[start:l.pos])
+}
+
+// value reads the next value, or the next operator as a pdfOperator. Numbers
+// are float64, strings []byte, and "n 0 R" is read as a pdfRef.
+func (l *pdfLexer) value() (v interface{}, err error) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, io.EOF
+	}
+
+	c := l.data[l.pos]
+	switch {
+	case c == '/':
+		l.pos++
+		return pdfName(decodeName(l.word())), nil
+	case c == '(':
+		return l.literalString()
+	case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+		l.pos += 2
+		dict := pdfDict{}
+		for {
+			l.skipSpace()
+			if l.pos+1 < len(l.data) && l.data[l.pos] == '>' && l.data[l.pos+1] == '>' {
+				l.pos += 2
+				return dict, nil
+			}
+			key, err := l.value()
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(pdfName)
+			if !ok {
+				return nil, fmt.Errorf("dictionary key %v before offset %d isn't a name", key, l.pos)
+			}
+			dict[string(name)], err = l.value()
+			if err != nil {
+				return nil, err
+			}
+		}
+	case c == '<':
+		return l.hexString()
+	case c == '[':
+		l.pos++
+		array := []interface{}{}
+		for {
+			l.skipSpace()
+			if l.pos < len(l.data) && l.data[l.pos] == ']' {
+				l.pos++
+				return array, nil
+			}
+			v, err := l.value()
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, v)
+		}
+	case isPDFDelimiter(c):
+		l.pos++
+		return nil, fmt.Errorf("unexpected %q at offset %d", c, l.pos-1)
+	}
+
+	word := l.word()
+	if n, err := strconv.ParseFloat(word, 64); err == nil {
+		if ref, ok := l.reference(word); ok {
+			return ref, nil
+		}
+		return n, nil
+	}
+
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+
+	return pdfOperator(word), nil
+}
+
+// reference reads the rest of "n 0 R" after n, or leaves the lexer where it
+// was.
+func (l *pdfLexer) reference(number string) (ref pdfRef, ok bool) {
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		return ref, false
+	}
+
+	pos := l.pos
+	l.skipSpace()
+	if _, err := strconv.Atoi(l.word()); err == nil {
+		l.skipSpace()
+		if l.word() == "R" {
+			return pdfRef(n), true
+		}
+	}
+	l.pos = pos
+
+	return ref, false
+}
+
+func (l *pdfLexer) literalString() (s []byte, err error) {
+	l.pos++
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return s, nil
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				break
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if e < '0' || e > '7' {
+					c = e
+					break
+				}
+				octal := int(e - '0')
+				for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+					octal = octal*8 + int(l.data[l.pos]-'0')
+					l.pos++
+				}
+				c = byte(octal)
+			}
+		}
+		s = append(s, c)
+	}
+
+	return s, io.ErrUnexpectedEOF
+}
+
+func (l *pdfLexer) hexString() (s []byte, err error) {
+	l.pos++
+	digits := []byte{}
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		if !isPDFSpace(l.data[l.pos]) {
+			digits = append(digits, l.data[l.pos])
+		}
+		l.pos++
+	}
+	if l.pos >= len(l.data) {
+		return s, io.ErrUnexpectedEOF
+	}
+	l.pos++
+
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	for i := 0; i < len(digits); i += 2 {
+		b, err := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		if err != nil {
+			return s, fmt.Errorf("bad hex string at offset %d", l.pos)
+		}
+		s = append(s, byte(b))
+	}
+
+	return s, nil
+}
+
+func decodeName(name string) string {
+	if !strings.Contains(name, "#") {
+		return name
+	}
+
+	decoded := []byte{}
+	for i := 0; i < len(name); i++ {
+		if name[i] == '#' && i+2 < len(name) {
+			if b, err := strconv.ParseUint(name[i+1:i+3], 16, 8); err == nil {
+				decoded = append(decoded, byte(b))
+				i += 2
+				continue
+			}
+		}
+		decoded = append(decoded, name[i])
+	}
+
+	return string(decoded)
+}
+
+// object reads an object's value after "n 0 obj", with its stream if it has
+// one.
+func (l *pdfLexer) object() (obj interface{}, err error) {
+	obj, err = l.value()
+	if err != nil {
+		return obj, err
+	}
+
+	dict, ok := obj.(pdfDict)
+	mark := l.pos
+	l.skipSpace()
+	if !ok || !bytes.HasPrefix(l.data[l.pos:], []byte("stream")) {
+		l.pos = mark
+		return obj, nil
+	}
+
+	l.pos += len("stream")
+	if l.pos < len(l.data) && l.data[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+		l.pos++
+	}
+
+	start := l.pos
+	end := 0
+	if length, ok := dict["Length"].(float64); ok && start+int(length) <= len(l.data) {
+		end = start + int(length)
+	} else {
+		end = bytes.Index(l.data[start:], []byte("endstream"))
+		if end < 0 {
+			return obj, fmt.Errorf("stream at offset %d has no end", start)
+		}
+		end += start
+	}
+
+	l.pos = end
+	if i := bytes.Index(l.data[l.pos:], []byte("endstream")); i >= 0 {
+		l.pos += i + len("endstream")
+	}
+
+	return &pdfStream{dict: dict, data: l.data[start:end]}, nil
+}
+
+func parsePDF(data []byte) (doc *pdfDocument, err error) {
+	doc = &pdfDocument{objects: make(map[int]interface{}), fonts: make(map[pdfRef]*rasterFont)}
+	l := &pdfLexer{data: data}
+
+	var before [2]interface{}
+	for {
+		v, err := l.value()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return doc, err
+		}
+
+		switch v {
+		case pdfOperator("obj"):
+			number, ok := before[0].(float64)
+			if !ok {
+				return doc, fmt.Errorf("object without a number before offset %d", l.pos)
+			}
+			doc.objects[int(number)], err = l.object()
+			if err != nil {
+				return doc, err
+			}
+		case pdfOperator("trailer"):
+			trailer, err := l.value()
+			if err != nil {
+				return doc, err
+			}
+			doc.trailer, _ = trailer.(pdfDict)
+		}
+		before[0], before[1] = before[1], v
+	}
+
+	if doc.trailer == nil {
+		return doc, fmt.Errorf("PDF has no trailer")
+	}
+
+	return doc, nil
+}
+
+func (doc *pdfDocument) resolve(v interface{}) interface{} {
+	for i := 0; i < 32; i++ {
+		ref, ok := v.(pdfRef)
+		if !ok {
+			return v
+		}
+		v = doc.objects[int(ref)]
+	}
+
+	return nil
+}
+
+func (doc *pdfDocument) dict(v interface{}) pdfDict {
+	switch v := doc.resolve(v).(type) {
+	case pdfDict:
+		return v
+	case *pdfStream:
+		return v.dict
+	}
+
+	return nil
+}
+
+func (doc *pdfDocument) array(v interface{}) []interface{} {
+	array, _ := doc.resolve(v).([]interface{})
+	return array
+}
+
+func (doc *pdfDocument) stream(v interface{}) *pdfStream {
+	stream, _ := doc.resolve(v).(*pdfStream)
+	return stream
+}
+
+func (doc *pdfDocument) number(v interface{}) float64 {
+	n, _ := doc.resolve(v).(float64)
+	return n
+}
+
+func (doc *pdfDocument) name(v interface{}) string {
+	name, _ := doc.resolve(v).(pdfName)
+	return string(name)
+}
+
+// streamData returns a stream with its Flate compression undone. Image
+// compression is left for the image decoder.
+func (doc *pdfDocument) streamData(stream *pdfStream) (data []byte, err error) {
+	filters := doc.array(stream.dict["Filter"])
+	if name := doc.name(stream.dict["Filter"]); name != "" {
+		filters = []interface{}{pdfName(name)}
+	}
+
+	data = stream.data
+	for _, filter := range filters {
+		if doc.name(filter) != "FlateDecode" {
+			break
+		}
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return data, err
+		}
+		data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	return data, nil
+}
+
+// pages lists the page dictionaries in order, with the resources and media
+// box they inherit.
+func (doc *pdfDocument) pages(node pdfDict, inherited pdfDict, pages []pdfDict, depth int) []pdfDict {
+	if node == nil || depth > 32 {
+		return pages
+	}
+
+	attributes := pdfDict{}
+	for _, key := range []string{"Resources", "MediaBox"} {
+		if v, ok := node[key]; ok {
+			attributes[key] = v
+		} else if v, ok := inherited[key]; ok {
+			attributes[key] = v
+		}
+	}
+
+	if doc.name(node["Type"]) == "Pages" {
+		for _, kid := range doc.array(node["Kids"]) {
+			pages = doc.pages(doc.dict(kid), attributes, pages, depth+1)
+		}
+		return pages
+	}
+
+	page := pdfDict{}
+	for key, v := range node {
+		page[key] = v
+	}
+	for key, v := range attributes {
+		page[key] = v
+	}
+
+	return append(pages, page)
+}
+
+// rasterFont is a PDF font with the outlines to draw it. Widths are in
+// thousandths of the font size, by character code.
+type rasterFont struct {
+	font         *sfnt.Font
+	buffer       sfnt.Buffer
+	twoByte      bool
+	cidToGID     []byte
+	widths       map[int]float64
+	defaultWidth float64
+	unitsPerEm   float64
+	outlines     map[sfnt.GlyphIndex][]sfnt.Segment
+}
+
+func (doc *pdfDocument) font(v interface{}) (f *rasterFont) {
+	ref, isRef := v.(pdfRef)
+	if f, ok := doc.fonts[ref]; isRef && ok {
+		return f
+	}
+
+	f = doc.loadFont(doc.dict(v))
+	if isRef {
+		doc.fonts[ref] = f
+	}
+
+	return f
+}
+
+func (doc *pdfDocument) loadFont(dict pdfDict) (f *rasterFont) {
+	f = &rasterFont{widths: make(map[int]float64), outlines: make(map[sfnt.GlyphIndex][]sfnt.Segment)}
+	baseFont := doc.name(dict["BaseFont"])
+	descriptor := doc.dict(dict["FontDescriptor"])
+
+	if doc.name(dict["Subtype"]) == "Type0" {
+		f.twoByte = true
+		f.defaultWidth = 1000
+
+		descendants := doc.array(dict["DescendantFonts"])
+		if len(descendants) > 0 {
+			cidFont := doc.dict(descendants[0])
+			descriptor = doc.dict(cidFont["FontDescriptor"])
+			if dw, ok := doc.resolve(cidFont["DW"]).(float64); ok {
+				f.defaultWidth = dw
+			}
+			f.readCIDWidths(doc, doc.array(cidFont["W"]))
+			if m := doc.stream(cidFont["CIDToGIDMap"]); m != nil {
+				f.cidToGID, _ = doc.streamData(m)
+			}
+		}
+	} else {
+		first := int(doc.number(dict["FirstChar"]))
+		for i, width := range doc.array(dict["Widths"]) {
+			f.widths[first+i] = doc.number(width)
+		}
+	}
+
+	if file := doc.stream(descriptor["FontFile2"]); file != nil {
+		if data, err := doc.streamData(file); err == nil {
+			f.font, _ = sfnt.Parse(data)
+		}
+	}
+	if f.font == nil {
+		f.font = standardFont(baseFont)
+		f.cidToGID = nil
+		if len(f.widths) == 0 && !f.twoByte {
+			f.widths = standardWidths(baseFont)
+		}
+	}
+	f.unitsPerEm = float64(f.font.UnitsPerEm())
+
+	return f
+}
+
+// readCIDWidths reads a W array, whose entries are either "c [w1 w2 ...]"
+// or "first last w".
+func (f *rasterFont) readCIDWidths(doc *pdfDocument, w []interface{}) {
+	for i := 0; i+1 < len(w); {
+		first := int(doc.number(w[i]))
+		if list, ok := doc.resolve(w[i+1]).([]interface{}); ok {
+			for j, width := range list {
+				f.widths[first+j] = doc.number(width)
+			}
+			i += 2
+			continue
+		}
+		if i+2 >= len(w) {
+			return
+		}
+		last := int(doc.number(w[i+1]))
+		for c := first; c <= last && c-first < 1<<16; c++ {
+			f.widths[c] = doc.number(w[i+2])
+		}
+		i += 3
+	}
+}
+
+// standardFont returns the Go font closest to a standard PDF font.
+func standardFont(baseFont string) *sfnt.Font {
+	bold := strings.Contains(baseFont, "Bold")
+	italic := strings.Contains(baseFont, "Italic") || strings.Contains(baseFont, "Oblique")
+
+	ttf := goregular.TTF
+	switch {
+	case strings.HasPrefix(baseFont, "Courier") && bold:
+		ttf = gomonobold.TTF
+	case strings.HasPrefix(baseFont, "Courier"):
+		ttf = gomono.TTF
+	case bold && italic:
+		ttf = gobolditalic.TTF
+	case bold:
+		ttf = gobold.TTF
+	case italic:
+		ttf = goitalic.TTF
+	}
+
+	f, _ := sfnt.Parse(ttf)
+
+	return f
+}
+
+// standardWidths returns gofpdf's widths for a standard font, which PDFs
+// leave out, so text drawn in a Go font is still spaced as it was laid out.
+func standardWidths(baseFont string) (widths map[int]float64) {
+	widths = make(map[int]float64)
+
+	family := strings.SplitN(baseFont, "-", 2)[0]
+	style := ""
+	if strings.Contains(baseFont, "Bold") {
+		style += "B"
+	}
+	if strings.Contains(baseFont, "Italic") || strings.Contains(baseFont, "Oblique") {
+		style += "I"
+	}
+
+	pdf := gofpdf.New("P", "pt", "A4", "")
+	pdf.SetFont(family, style, 10)
+	if pdf.Err() {
+		return widths
+	}
+	for code := 32; code < 256; code++ {
+		widths[code] = float64(pdf.GetStringSymbolWidth(string([]byte{byte(code)})))
+	}
+
+	return widths
+}
+
+func (f *rasterFont) codes(s []byte) (codes []int) {
+	if !f.twoByte {
+		for _, b := range s {
+			codes = append(codes, int(b))
+		}
+		return codes
+	}
+
+	for i := 0; i+1 < len(s); i += 2 {
+		codes = append(codes, int(s[i])<<8|int(s[i+1]))
+	}
+
+	return codes
+}
+
+// glyph finds a character's glyph. Simple fonts are Latin-1 and gofpdf's
+// Type0 fonts use Unicode code points as CIDs, so the code point is tried
+// when the CID map has nothing.
+func (f *rasterFont) glyph(code int) sfnt.GlyphIndex {
+	if f.cidToGID != nil && 2*code+1 < len(f.cidToGID) {
+		if gid := sfnt.GlyphIndex(f.cidToGID[2*code])<<8 | sfnt.GlyphIndex(f.cidToGID[2*code+1]); gid != 0 {
+			return gid
+		}
+	}
+
+	gid, _ := f.font.GlyphIndex(&f.buffer, rune(code))
+
+	return gid
+}
+
+func (f *rasterFont) width(code int) float64 {
+	if width, ok := f.widths[code]; ok {
+		return width
+	}
+	if f.twoByte {
+		return f.defaultWidth
+	}
+
+	advance, err := f.font.GlyphAdvance(&f.buffer, f.glyph(code), fixed.Int26_6(f.unitsPerEm*64), font.HintingNone)
+	if err != nil {
+		return 0
+	}
+
+	return float64(advance) / 64 / f.unitsPerEm * 1000
+}
+
+// outline returns a glyph's outline in font units, with y down.
+func (f *rasterFont) outline(gid sfnt.GlyphIndex) []sfnt.Segment {
+	if segments, ok := f.outlines[gid]; ok {
+		return segments
+	}
+
+	segments, err := f.font.LoadGlyph(&f.buffer, gid, fixed.Int26_6(f.unitsPerEm*64), nil)
+	if err != nil {
+		segments = nil
+	}
+	f.outlines[gid] = append([]sfnt.Segment(nil), segments...)
+
+	return f.outlines[gid]
+}
+
+// pdfMatrix is a PDF transformation matrix [a b c d e f].
+type pdfMatrix [6]float64
+
+var identityMatrix = pdfMatrix{1, 0, 0, 1, 0, 0}
+
+// times returns m followed by n.
+func (m pdfMatrix) times(n pdfMatrix) pdfMatrix {
+	return pdfMatrix{
+		m[0]*n[0] + m[1]*n[2],
+		m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2],
+		m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4],
+		m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+func (m pdfMatrix) apply(x float64, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+type rasterState struct {
+	ctm         pdfMatrix
+	fill        color.NRGBA
+	stroke      color.NRGBA
+	fillAlpha   float64
+	strokeAlpha float64
+	lineWidth   float64
+
+	// fillSpot and strokeSpot are the full tint CMYK of a Separation color
+	// space in use, for sc and scn operands that are tints of it.
+	fillSpot   []float64
+	strokeSpot []float64
+
+	font        *rasterFont
+	fontSize    float64
+	charSpacing float64
+	wordSpacing float64
+	scale       float64
+	leading     float64
+	rise        float64
+}
+
+type rasterPoint struct {
+	x, y float64
+}
+
+// rasterSegment is one step of a path in device space: 'm' to move, 'l' for
+// a line, 'q' and 'c' for curves and 'h' to close the subpath.
+type rasterSegment struct {
+	op  byte
+	pts [3]rasterPoint
+}
+
+type pageRaster struct {
+	doc        *pdfDocument
+	dst        *image.RGBA
+	rasterizer *vector.Rasterizer
+	state      rasterState
+	saved      []rasterState
+	path       []rasterSegment
+	start      rasterPoint
+	current    rasterPoint
+	text       pdfMatrix
+	textLine   pdfMatrix
+}
+
+// rasterizePDF renders the first pages of a PDF at dpi pixels per inch.
+func rasterizePDF(data []byte, pages int, dpi float64) (images []*image.RGBA, err error) {
+	doc, err := parsePDF(data)
+	if err != nil {
+		return images, err
+	}
+
+	root := doc.dict(doc.trailer["Root"])
+	for _, page := range doc.pages(doc.dict(root["Pages"]), nil, nil, 0) {
+		if len(images) >= pages {
+			break
+		}
+
+		img, err := doc.rasterizePage(page, dpi)
+		if err != nil {
+			return images, err
+		}
+		images = append(images, img)
+	}
+
+	return images, nil
+}
+
+func (doc *pdfDocument) rasterizePage(page pdfDict, dpi float64) (img *image.RGBA, err error) {
+	box := doc.array(page["MediaBox"])
+	if len(box) != 4 {
+		return img, fmt.Errorf("page has no media box")
+	}
+	x0, y0, x1, y1 := doc.number(box[0]), doc.number(box[1]), doc.number(box[2]), doc.number(box[3])
+
+	scale := dpi / 72
+	img = image.NewRGBA(image.Rect(0, 0, int(math.Ceil((x1-x0)*scale)), int(math.Ceil((y1-y0)*scale))))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+	p := &pageRaster{
+		doc:        doc,
+		dst:        img,
+		rasterizer: vector.NewRasterizer(0, 0),
+		state: rasterState{
+			ctm:         pdfMatrix{scale, 0, 0, -scale, -x0 * scale, y1 * scale},
+			fill:        color.NRGBA{0, 0, 0, 255},
+			stroke:      color.NRGBA{0, 0, 0, 255},
+			fillAlpha:   1,
+			strokeAlpha: 1,
+			lineWidth:   1,
+			scale:       1,
+		},
+	}
+
+	var content []byte
+	contents := doc.array(page["Contents"])
+	if contents == nil {
+		contents = []interface{}{page["Contents"]}
+	}
+	for _, c := range contents {
+		stream := doc.stream(c)
+		if stream == nil {
+			continue
+		}
+		data, err := doc.streamData(stream)
+		if err != nil {
+			return img, err
+		}
+		content = append(append(content, data...), '\n')
+	}
+
+	return img, p.run(content, doc.dict(page["Resources"]))
+}
+
+func (p *pageRaster) run(content []byte, resources pdfDict) (err error) {
+	l := &pdfLexer{data: content}
+	operands := []interface{}{}
+	for {
+		v, err := l.value()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		op, ok := v.(pdfOperator)
+		if !ok {
+			operands = append(operands, v)
+			continue
+		}
+
+		err = p.operator(string(op), operands, resources)
+		if err != nil {
+			return err
+		}
+		operands = operands[:0]
+	}
+}
+
+// numbers returns the last n operands as numbers, or false if there aren't
+// that many.
+func numbers(operands []interface{}, n int) (values []float64, ok bool) {
+	if len(operands) < n {
+		return nil, false
+	}
+
+	for _, operand := range operands[len(operands)-n:] {
+		value, ok := operand.(float64)
+		if !ok {
+			return nil, false
+		}
+		values = append(values, value)
+	}
+
+	return values, true
+}
+
+func colorOperands(operands []interface{}) (c color.NRGBA, ok bool) {
+	values := []float64{}
+	for _, operand := range operands {
+		if value, ok := operand.(float64); ok {
+			values = append(values, value)
+		}
+	}
+
+	channel := func(v float64) uint8 {
+		return uint8(math.Round(math.Max(0, math.Min(1, v)) * 255))
+	}
+
+	switch len(values) {
+	case 1:
+		return color.NRGBA{channel(values[0]), channel(values[0]), channel(values[0]), 255}, true
+	case 3:
+		return color.NRGBA{channel(values[0]), channel(values[1]), channel(values[2]), 255}, true
+	case 4:
+		k := 1 - values[3]
+		return color.NRGBA{channel((1 - values[0]) * k), channel((1 - values[1]) * k), channel((1 - values[2]) * k), 255}, true
+	}
+
+	return c, false
+}
+
+// spotColor returns the full tint CMYK of the Separation color space the
+// cs or CS operands name, like gofpdf's spot colors, or nil for any other.
+func (p *pageRaster) spotColor(operands []interface{}, resources pdfDict) (cmyk []float64) {
+	if len(operands) == 0 {
+		return nil
+	}
+
+	name, _ := operands[len(operands)-1].(pdfName)
+	space := p.doc.array(p.doc.dict(resources["ColorSpace"])[string(name)])
+	if len(space) < 4 || p.doc.name(space[0]) != "Separation" || p.doc.name(space[2]) != "DeviceCMYK" {
+		return nil
+	}
+
+	for _, v := range p.doc.array(p.doc.dict(space[3])["C1"]) {
+		cmyk = append(cmyk, p.doc.number(v))
+	}
+	if len(cmyk) != 4 {
+		return nil
+	}
+
+	return cmyk
+}
+
+// spotTint turns the tint operand of a spot color into its CMYK operands.
+func spotTint(operands []interface{}, cmyk []float64) []interface{} {
+	tint, ok := numbers(operands, 1)
+	if cmyk == nil || !ok {
+		return operands
+	}
+
+	return []interface{}{cmyk[0] * tint[0], cmyk[1] * tint[0], cmyk[2] * tint[0], cmyk[3] * tint[0]}
+}
+
+func (p *pageRaster) operator(op string, operands []interface{}, resources pdfDict) (err error) {
+	s := &p.state
+	switch op {
+	case "q":
+		p.saved = append(p.saved, p.state)
+	case "Q":
+		if len(p.saved) > 0 {
+			p.state = p.saved[len(p.saved)-1]
+			p.saved = p.saved[:len(p.saved)-1]
+		}
+	case "cm":
+		if n, ok := numbers(operands, 6); ok {
+			s.ctm = pdfMatrix{n[0], n[1], n[2], n[3], n[4], n[5]}.times(s.ctm)
+		}
+	case "w":
+		if n, ok := numbers(operands, 1); ok {
+			s.lineWidth = n[0]
+		}
+	case "gs":
+		if len(operands) > 0 {
+			name, _ := operands[len(operands)-1].(pdfName)
+			gs := p.doc.dict(p.doc.dict(resources["ExtGState"])[string(name)])
+			if ca, ok := p.doc.resolve(gs["ca"]).(float64); ok {
+				s.fillAlpha = ca
+			}
+			if ca, ok := p.doc.resolve(gs["CA"]).(float64); ok {
+				s.strokeAlpha = ca
+			}
+		}
+	case "cs":
+		s.fillSpot = p.spotColor(operands, resources)
+	case "CS":
+		s.strokeSpot = p.spotColor(operands, resources)
+	case "g", "rg", "k", "sc", "scn":
+		if op == "sc" || op == "scn" {
+			operands = spotTint(operands, s.fillSpot)
+		} else {
+			s.fillSpot = nil
+		}
+		if c, ok := colorOperands(operands); ok {
+			s.fill = c
+		}
+	case "G", "RG", "K", "SC", "SCN":
+		if op == "SC" || op == "SCN" {
+			operands = spotTint(operands, s.strokeSpot)
+		} else {
+			s.strokeSpot = nil
+		}
+		if c, ok := colorOperands(operands); ok {
+			s.stroke = c
+		}
+
+	case "m":
+		if n, ok := numbers(operands, 2); ok {
+			p.moveTo(n[0], n[1])
+		}
+	case "l":
+		if n, ok := numbers(operands, 2); ok {
+			p.lineTo(n[0], n[1])
+		}
+	case "c", "v", "y":
+		n, ok := numbers(operands, 6)
+		if op != "c" {
+			n, ok = numbers(operands, 4)
+		}
+		if !ok {
+			break
+		}
+		x, y := s.ctm.apply(n[len(n)-2], n[len(n)-1])
+		segment := rasterSegment{op: 'c'}
+		switch op {
+		case "c":
+			segment.pts = [3]rasterPoint{p.point(n[0], n[1]), p.point(n[2], n[3]), {x, y}}
+		case "v":
+			segment.pts = [3]rasterPoint{p.current, p.point(n[0], n[1]), {x, y}}
+		case "y":
+			segment.pts = [3]rasterPoint{p.point(n[0], n[1]), {x, y}, {x, y}}
+		}
+		p.path = append(p.path, segment)
+		p.current = rasterPoint{x, y}
+	case "h":
+		p.closePath()
+	case "re":
+		if n, ok := numbers(operands, 4); ok {
+			p.moveTo(n[0], n[1])
+			p.lineTo(n[0]+n[2], n[1])
+			p.lineTo(n[0]+n[2], n[1]+n[3])
+			p.lineTo(n[0], n[1]+n[3])
+			p.closePath()
+		}
+	case "S", "s", "f", "F", "f*", "B", "B*", "b", "b*", "n":
+		if op == "s" || op == "b" || op == "b*" {
+			p.closePath()
+		}
+		if strings.ContainsAny(op, "fFBb") {
+			p.fillPath(p.path, alphaColor(s.fill, s.fillAlpha))
+		}
+		if strings.ContainsAny(op, "SsBb") {
+			p.strokePath()
+		}
+		p.path = p.path[:0]
+	case "Do":
+		if len(operands) > 0 {
+			name, _ := operands[len(operands)-1].(pdfName)
+			err = p.drawXObject(p.doc.stream(p.doc.dict(resources["XObject"])[string(name)]))
+		}
+
+	case "BT":
+		p.text, p.textLine = identityMatrix, identityMatrix
+	case "Tf":
+		if len(operands) >= 2 {
+			name, _ := operands[len(operands)-2].(pdfName)
+			s.font = p.doc.font(p.doc.dict(resources["Font"])[string(name)])
+			s.fontSize, _ = operands[len(operands)-1].(float64)
+		}
+	case "Tc":
+		if n, ok := numbers(operands, 1); ok {
+			s.charSpacing = n[0]
+		}
+	case "Tw":
+		if n, ok := numbers(operands, 1); ok {
+			s.wordSpacing = n[0]
+		}
+	case "Tz":
+		if n, ok := numbers(operands, 1); ok {
+			s.scale = n[0] / 100
+		}
+	case "TL":
+		if n, ok := numbers(operands, 1); ok {
+			s.leading = n[0]
+		}
+	case "Ts":
+		if n, ok := numbers(operands, 1); ok {
+			s.rise = n[0]
+		}
+	case "Td", "TD":
+		if n, ok := numbers(operands, 2); ok {
+			if op == "TD" {
+				s.leading = -n[1]
+			}
+			p.nextLine(n[0], n[1])
+		}
+	case "Tm":
+		if n, ok := numbers(operands, 6); ok {
+			p.text = pdfMatrix{n[0], n[1], n[2], n[3], n[4], n[5]}
+			p.textLine = p.text
+		}
+	case "T*":
+		p.nextLine(0, -s.leading)
+	case "Tj", "'", "\"":
+		if op != "Tj" {
+			p.nextLine(0, -s.leading)
+		}
+		if op == "\"" && len(operands) > 0 {
+			if n, ok := numbers(operands[:len(operands)-1], 2); ok {
+				s.wordSpacing, s.charSpacing = n[0], n[1]
+			}
+		}
+		if len(operands) > 0 {
+			str, _ := operands[len(operands)-1].([]byte)
+			p.showText(str)
+		}
+	case "TJ":
+		if len(operands) > 0 {
+			array, _ := operands[len(operands)-1].([]interface{})
+			p.showText(array...)
+		}
+	}
+
+	return err
+}
+
+func (p *pageRaster) point(x float64, y float64) rasterPoint {
+	x, y = p.state.ctm.apply(x, y)
+	return rasterPoint{x, y}
+}
+
+func (p *pageRaster) moveTo(x float64, y float64) {
+	p.current = p.point(x, y)
+	p.start = p.current
+	p.path = append(p.path, rasterSegment{op: 'm', pts: [3]rasterPoint{p.current}})
+}
+
+func (p *pageRaster) lineTo(x float64, y float64) {
+	p.current = p.point(x, y)
+	p.path = append(p.path, rasterSegment{op: 'l', pts: [3]rasterPoint{p.current}})
+}
+
+func (p *pageRaster) closePath() {
+	p.path = append(p.path, rasterSegment{op: 'h'})
+	p.current = p.start
+}
+
+func (p *pageRaster) nextLine(tx float64, ty float64) {
+	p.textLine = pdfMatrix{1, 0, 0, 1, tx, ty}.times(p.textLine)
+	p.text = p.textLine
+}
+
+func alphaColor(c color.NRGBA, alpha float64) color.NRGBA {
+	c.A = uint8(math.Round(math.Max(0, math.Min(1, alpha)) * 255))
+	return c
+}
+
+// fillPath fills the path with the nonzero rule, rasterizing only its
+// bounding box.
+func (p *pageRaster) fillPath(path []rasterSegment, c color.NRGBA) {
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, segment := range path {
+		n := map[byte]int{'m': 1, 'l': 1, 'q': 2, 'c': 3}[segment.op]
+		for _, pt := range segment.pts[:n] {
+			minX, minY = math.Min(minX, pt.x), math.Min(minY, pt.y)
+			maxX, maxY = math.Max(maxX, pt.x), math.Max(maxY, pt.y)
+		}
+	}
+	if c.A == 0 || minX > maxX {
+		return
+	}
+
+	bounds := image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX))+1, int(math.Ceil(maxY))+1)
+	bounds = bounds.Intersect(p.dst.Bounds())
+	if bounds.Empty() {
+		return
+	}
+
+	r := p.rasterizer
+	r.Reset(bounds.Dx(), bounds.Dy())
+	at := func(pt rasterPoint) (float32, float32) {
+		return float32(pt.x - float64(bounds.Min.X)), float32(pt.y - float64(bounds.Min.Y))
+	}
+
+	open := false
+	for _, segment := range path {
+		switch segment.op {
+		case 'm':
+			if open {
+				r.ClosePath()
+			}
+			r.MoveTo(at(segment.pts[0]))
+			open = true
+		case 'l':
+			r.LineTo(at(segment.pts[0]))
+		case 'q':
+			ax, ay := at(segment.pts[0])
+			bx, by := at(segment.pts[1])
+			r.QuadTo(ax, ay, bx, by)
+		case 'c':
+			ax, ay := at(segment.pts[0])
+			bx, by := at(segment.pts[1])
+			cx, cy := at(segment.pts[2])
+			r.CubeTo(ax, ay, bx, by, cx, cy)
+		case 'h':
+			if open {
+				r.ClosePath()
+			}
+			open = false
+		}
+	}
+	if open {
+		r.ClosePath()
+	}
+
+	r.Draw(p.dst, bounds, image.NewUniform(c), image.Point{})
+}
+
+// strokePath strokes the path as a quad per flattened line segment, each
+// lengthened by half the line width so corners meet.
+func (p *pageRaster) strokePath() {
+	s := p.state
+	half := s.lineWidth * math.Sqrt(math.Abs(s.ctm[0]*s.ctm[3]-s.ctm[1]*s.ctm[2])) / 2
+	if half < 0.5 {
+		half = 0.5
+	}
+
+	quads := []rasterSegment{}
+	var start, last rasterPoint
+	line := func(a rasterPoint, b rasterPoint) {
+		dx, dy := b.x-a.x, b.y-a.y
+		length := math.Hypot(dx, dy)
+		if length == 0 {
+			return
+		}
+		ux, uy := dx/length*half, dy/length*half
+		a = rasterPoint{a.x - ux, a.y - uy}
+		b = rasterPoint{b.x + ux, b.y + uy}
+		quads = append(quads,
+			rasterSegment{op: 'm', pts: [3]rasterPoint{{a.x - uy, a.y + ux}}},
+			rasterSegment{op: 'l', pts: [3]rasterPoint{{b.x - uy, b.y + ux}}},
+			rasterSegment{op: 'l', pts: [3]rasterPoint{{b.x + uy, b.y - ux}}},
+			rasterSegment{op: 'l', pts: [3]rasterPoint{{a.x + uy, a.y - ux}}},
+			rasterSegment{op: 'h'})
+	}
+
+	for _, segment := range p.path {
+		switch segment.op {
+		case 'm':
+			start, last = segment.pts[0], segment.pts[0]
+		case 'l':
+			line(last, segment.pts[0])
+			last = segment.pts[0]
+		case 'c':
+			a, b, c := segment.pts[0], segment.pts[1], segment.pts[2]
+			steps := int(math.Min(64, (math.Hypot(a.x-last.x, a.y-last.y)+math.Hypot(b.x-a.x, b.y-a.y)+math.Hypot(c.x-b.x, c.y-b.y))/4)) + 1
+			from := last
+			for i := 1; i <= steps; i++ {
+				t := float64(i) / float64(steps)
+				u := 1 - t
+				to := rasterPoint{
+					u*u*u*from.x + 3*u*u*t*a.x + 3*u*t*t*b.x + t*t*t*c.x,
+					u*u*u*from.y + 3*u*u*t*a.y + 3*u*t*t*b.y + t*t*t*c.y,
+				}
+				line(last, to)
+				last = to
+			}
+		case 'h':
+			line(last, start)
+			last = start
+		}
+	}
+
+	p.fillPath(quads, alphaColor(s.stroke, s.strokeAlpha))
+}
+
+// showText draws strings and TJ spacing adjustments with the current font.
+func (p *pageRaster) showText(parts ...interface{}) {
+	s := p.state
+	f := s.font
+	if f == nil {
+		return
+	}
+
+	path := []rasterSegment{}
+	for _, part := range parts {
+		if adjust, ok := part.(float64); ok {
+			p.text = pdfMatrix{1, 0, 0, 1, -adjust / 1000 * s.fontSize * s.scale, 0}.times(p.text)
+			continue
+		}
+		str, _ := part.([]byte)
+
+		for _, code := range f.codes(str) {
+			glyph := pdfMatrix{s.fontSize * s.scale / f.unitsPerEm, 0, 0, -s.fontSize / f.unitsPerEm, 0, s.rise}.times(p.text).times(s.ctm)
+			at := func(pt fixed.Point26_6) rasterPoint {
+				x, y := glyph.apply(float64(pt.X)/64, float64(pt.Y)/64)
+				return rasterPoint{x, y}
+			}
+
+			for _, segment := range f.outline(f.glyph(code)) {
+				switch segment.Op {
+				case sfnt.SegmentOpMoveTo:
+					path = append(path, rasterSegment{op: 'm', pts: [3]rasterPoint{at(segment.Args[0])}})
+				case sfnt.SegmentOpLineTo:
+					path = append(path, rasterSegment{op: 'l', pts: [3]rasterPoint{at(segment.Args[0])}})
+				case sfnt.SegmentOpQuadTo:
+					path = append(path, rasterSegment{op: 'q', pts: [3]rasterPoint{at(segment.Args[0]), at(segment.Args[1])}})
+				case sfnt.SegmentOpCubeTo:
+					path = append(path, rasterSegment{op: 'c', pts: [3]rasterPoint{at(segment.Args[0]), at(segment.Args[1]), at(segment.Args[2])}})
+				}
+			}
+
+			advance := f.width(code)/1000*s.fontSize + s.charSpacing
+			if code == ' ' && !f.twoByte {
+				advance += s.wordSpacing
+			}
+			p.text = pdfMatrix{1, 0, 0, 1, advance * s.scale, 0}.times(p.text)
+		}
+	}
+
+	p.fillPath(path, alphaColor(s.fill, s.fillAlpha))
+}
+
+// drawXObject draws a JPEG image XObject into the unit square of the
+// current transformation.
+func (p *pageRaster) drawXObject(stream *pdfStream) (err error) {
+	if stream == nil || p.doc.name(stream.dict["Subtype"]) != "Image" || p.doc.name(stream.dict["Filter"]) != "DCTDecode" {
+		return nil
+	}
+
+	src, err := jpeg.Decode(bytes.NewReader(stream.data))
+	if err != nil {
+		return err
+	}
+
+	// Image space runs up from the bottom left, and the image's first row is
+	// its top.
+	m := p.state.ctm
+	w, h := float64(src.Bounds().Dx()), float64(src.Bounds().Dy())
+	transform := f64.Aff3{m[0] / w, -m[2] / h, m[2] + m[4], m[1] / w, -m[3] / h, m[3] + m[5]}
+
+	var options *draw.Options
+	if p.state.fillAlpha < 1 {
+		options = &draw.Options{SrcMask: image.NewUniform(color.Alpha{alphaColor(color.NRGBA{}, p.state.fillAlpha).A})}
+	}
+	draw.ApproxBiLinear.Transform(p.dst, transform, src, src.Bounds(), draw.Over, options)
+
+	return nil
+}
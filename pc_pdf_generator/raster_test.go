@@ -0,0 +1,114 @@
+package pc_pdf_generator
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// testPDF returns an A6 page with a black square in its top left quarter,
+// with its content stream compressed or not.
+func testPDF(t *testing.T, compress bool) []byte {
+	pdf := gofpdf.New("P", "mm", "A6", "")
+	pdf.SetCompression(compress)
+	pdf.AddPage()
+	pdf.SetFillColor(0, 0, 0)
+	pdf.Rect(10, 10, 30, 30, "F")
+
+	var out bytes.Buffer
+	err := pdf.Output(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out.Bytes()
+}
+
+// checkSquare checks the square testPDF draws came out black on white.
+func checkSquare(t *testing.T, img *image.RGBA, dpi float64) {
+	px := func(mm float64) int { return int(mm / 25.4 * dpi) }
+
+	if c := img.RGBAAt(px(25), px(25)); c.R > 10 || c.G > 10 || c.B > 10 {
+		t.Errorf("inside the square is %v, want black", c)
+	}
+	if c := img.RGBAAt(px(60), px(100)); c.R < 245 || c.G < 245 || c.B < 245 {
+		t.Errorf("outside the square is %v, want white", c)
+	}
+}
+
+func TestRasterizeUncompressed(t *testing.T) {
+	data := testPDF(t, false)
+	if !bytes.Contains(data, []byte(" re f")) {
+		t.Fatal("the content stream isn't plain text")
+	}
+
+	pages, err := rasterizePDF(data, 1, 72)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 {
+		t.Fatalf("rasterized %d pages, want 1", len(pages))
+	}
+
+	// A6 is 105 by 148mm, 297.6 by 419.5pt.
+	if b := pages[0].Bounds(); b.Dx() < 297 || b.Dx() > 299 || b.Dy() < 419 || b.Dy() > 421 {
+		t.Errorf("page is %v, want about 298x420", b)
+	}
+	checkSquare(t, pages[0], 72)
+}
+
+func TestRasterizeCompressed(t *testing.T) {
+	data := testPDF(t, true)
+	if !bytes.Contains(data, []byte("/FlateDecode")) {
+		t.Fatal("the content stream isn't compressed")
+	}
+
+	pages, err := rasterizePDF(data, 1, 72)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 {
+		t.Fatalf("rasterized %d pages, want 1", len(pages))
+	}
+	checkSquare(t, pages[0], 72)
+}
+
+func TestRasterizeSpotColor(t *testing.T) {
+	pdf := gofpdf.New("P", "mm", "A6", "")
+	pdf.SetCompression(false)
+	pdf.AddSpotColor("All", 100, 100, 100, 100)
+	pdf.AddPage()
+	pdf.SetFillSpotColor("All", 100)
+	pdf.Rect(10, 10, 30, 30, "F")
+
+	var out bytes.Buffer
+	err := pdf.Output(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages, err := rasterizePDF(out.Bytes(), 1, 72)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSquare(t, pages[0], 72)
+}
+
+func TestRasterizeGarbage(t *testing.T) {
+	valid := testPDF(t, true)
+
+	for name, data := range map[string][]byte{
+		"empty":      nil,
+		"text":       []byte("this is not a PDF"),
+		"header":     []byte("%PDF-1.3\n"),
+		"truncated":  valid[:len(valid)/2],
+		"no trailer": bytes.Replace(valid, []byte("trailer"), []byte("xxxxxxx"), -1),
+	} {
+		pages, err := rasterizePDF(data, 1, 72)
+		if err == nil && len(pages) > 0 {
+			t.Errorf("%s: rasterized %d pages, want an error", name, len(pages))
+		}
+	}
+}
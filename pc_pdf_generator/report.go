@@ -0,0 +1,283 @@
+package pc_pdf_generator
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	reportFormatHTML = "html"
+	reportFormatCSV  = "csv"
+	reportFormatJSON = "json"
+)
+
+var reportFormats = map[string]string{
+	reportFormatHTML: "text/html; charset=utf-8",
+	reportFormatCSV:  "text/csv; charset=utf-8",
+	reportFormatJSON: "application/json",
+}
+
+// DataIssue is a missing or suspicious field on a Planning Center record.
+type DataIssue struct {
+	Field   string `json:"field"`
+	Problem string `json:"problem"`
+}
+
+type ReportEntry struct {
+	PersonId    string      `json:"person_id,omitempty"`
+	HouseholdId string      `json:"household_id"`
+	Name        string      `json:"name"`
+	Issues      []DataIssue `json:"issues"`
+}
+
+type ReportSection struct {
+	Header   string        `json:"header"`
+	ListName string        `json:"list_name"`
+	Entries  []ReportEntry `json:"entries"`
+}
+
+// QualityReport lists, section by section, the people whose records should
+// be fixed in Planning Center before a directory is printed, then the
+// entries whose text didn't fit the layout.
+type QualityReport struct {
+	FileId    string          `json:"file_id"`
+	Generated time.Time       `json:"generated"`
+	Sections  []ReportSection `json:"sections"`
+	Layout    []LayoutIssue   `json:"layout"`
+}
+
+func reportFileName(domain string, fileId string, format string) string {
+	return fmt.Sprintf("%s/reports/directory-%s.%s", domain, fileId, format)
+}
+
+// addSection checks everyone the section prints.
+func (report *QualityReport) addSection(households []Household, displayOptions Section) {
+	section := ReportSection{
+		Header:   displayOptions.Header,
+		ListName: displayOptions.ListName,
+		Entries:  make([]ReportEntry, 0),
+	}
+
+	for _, h := range households {
+		if h.Head == nil {
+			name := ""
+			if len(h.Members) > 0 {
+				name = h.Members[0].LastName
+			}
+			section.Entries = append(section.Entries, ReportEntry{
+				HouseholdId: h.Id,
+				Name:        name,
+				Issues:      []DataIssue{{"household", "no head of household"}},
+			})
+		}
+
+		people := h.Members
+		if h.Head != nil {
+			people = append([]*Person{h.Head}, h.Members...)
+		}
+
+		for _, p := range people {
+			issues := personIssues(p)
+			if len(issues) == 0 {
+				continue
+			}
+
+			section.Entries = append(section.Entries, ReportEntry{
+				PersonId:    p.Id,
+				HouseholdId: h.Id,
+				Name:        strings.TrimSpace(p.FirstName + " " + p.LastName),
+				Issues:      issues,
+			})
+		}
+	}
+
+	report.Sections = append(report.Sections, section)
+}
+
+// personIssues adds what can be judged from the record as printed to the
+// issues noticed while it was downloaded.
+func personIssues(p *Person) (issues []DataIssue) {
+	issues = append(issues, p.DataIssues...)
+
+	if !p.Thumbnail && !hasIssue(issues, "photo") {
+		issues = append(issues, DataIssue{"photo", "no photo"})
+	}
+
+	if p.Address1 == "" || p.City == "" {
+		issues = append(issues, DataIssue{"address", "missing"})
+	}
+
+	if p.EmailAddress == "" {
+		issues = append(issues, DataIssue{"email", "missing"})
+	} else if !validEmail(p.EmailAddress) {
+		issues = append(issues, DataIssue{"email", fmt.Sprintf("invalid address %q", p.EmailAddress)})
+	}
+
+	phone := p.CellPhone
+	if phone == 0 {
+		phone = p.HomePhone
+	}
+	if phone == 0 {
+		issues = append(issues, DataIssue{"phone", "missing"})
+	} else if phone < 1e9 || phone >= 1e10 {
+		issues = append(issues, DataIssue{"phone", fmt.Sprintf("%d is not a 10 digit number", phone)})
+	}
+
+	if p.Birthday.IsZero() && !hasIssue(issues, "birthdate") {
+		issues = append(issues, DataIssue{"birthdate", "missing"})
+	}
+
+	if p.DateJoined.IsZero() && !hasIssue(issues, "date_joined") {
+		issues = append(issues, DataIssue{"date_joined", "missing"})
+	}
+
+	return issues
+}
+
+func hasIssue(issues []DataIssue, field string) bool {
+	for _, issue := range issues {
+		if issue.Field == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validEmail(address string) bool {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address {
+		return false
+	}
+
+	at := strings.LastIndex(address, "@")
+	return at > 0 && strings.Contains(address[at:], ".")
+}
+
+func (report *QualityReport) render(format string) (contents []byte, err error) {
+	buf := new(bytes.Buffer)
+
+	switch format {
+	case reportFormatJSON:
+		err = json.NewEncoder(buf).Encode(report)
+	case reportFormatCSV:
+		w := csv.NewWriter(buf)
+		w.Write([]string{"section", "household_id", "person_id", "name", "field", "problem", "page"})
+		for _, section := range report.Sections {
+			for _, entry := range section.Entries {
+				for _, issue := range entry.Issues {
+					w.Write([]string{section.Header, entry.HouseholdId, entry.PersonId, entry.Name, issue.Field, issue.Problem, ""})
+				}
+			}
+		}
+		for _, issue := range report.Layout {
+			w.Write([]string{issue.Section, "", "", issue.Name, "layout", issue.Problem, strconv.Itoa(issue.Page)})
+		}
+		w.Flush()
+		err = w.Error()
+	case reportFormatHTML:
+		err = reportTemplate.Execute(buf, report)
+	default:
+		err = fmt.Errorf("unknown report format %q", format)
+	}
+
+	return buf.Bytes(), err
+}
+
+// save writes the report in every format next to the job's PDF.
+func (report *QualityReport) save(ctx context.Context, domain string) (err error) {
+	client, bucket, err := defaultBucket(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	formats := make([]string, 0, len(reportFormats))
+	for format := range reportFormats {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+
+	for _, format := range formats {
+		contents, err := report.render(format)
+		if err != nil {
+			return err
+		}
+
+		wc := bucket.Object(reportFileName(domain, report.FileId, format)).NewWriter(ctx)
+		wc.ContentType = reportFormats[format]
+
+		_, err = wc.Write(contents)
+		if err != nil {
+			wc.Close()
+			return err
+		}
+
+		err = wc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Directory data report</title>
+  <style>
+    body { font-family: sans-serif; margin: 2em; }
+    table { border-collapse: collapse; margin-bottom: 2em; }
+    th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+  </style>
+</head>
+<body>
+  <h1>Directory data report</h1>
+  <p>Generated {{.Generated.Format "01/02/2006 3:04 PM"}}</p>
+  {{range .Sections}}
+  <h2>{{.Header}}{{if .ListName}} ({{.ListName}}){{end}}</h2>
+  {{if .Entries}}
+  <table>
+    <tr><th>Name</th><th>Household</th><th>Person</th><th>Problems</th></tr>
+    {{range .Entries}}
+    <tr>
+      <td>{{.Name}}</td>
+      <td>{{.HouseholdId}}</td>
+      <td>{{.PersonId}}</td>
+      <td>{{range .Issues}}{{.Field}}: {{.Problem}}<br>{{end}}</td>
+    </tr>
+    {{end}}
+  </table>
+  {{else}}
+  <p>No problems found.</p>
+  {{end}}
+  {{end}}
+  {{if .Layout}}
+  <h2>Layout</h2>
+  <table>
+    <tr><th>Page</th><th>Section</th><th>Name</th><th>Problem</th></tr>
+    {{range .Layout}}
+    <tr>
+      <td>{{.Page}}</td>
+      <td>{{.Section}}</td>
+      <td>{{.Name}}</td>
+      <td>{{.Problem}}</td>
+    </tr>
+    {{end}}
+  </table>
+  {{end}}
+</body>
+</html>
+`))
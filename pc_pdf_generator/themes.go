@@ -0,0 +1,418 @@
+package pc_pdf_generator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	themeDir = "themes"
+
+	headerStylePlain = "plain"
+	headerStyleBand  = "band"
+	headerStyleRule  = "rule"
+
+	photoBorderLine  = "line"
+	photoBorderFrame = "frame"
+
+	// Widths, in mm, of the photo borders and the header rule.
+	photoBorderLineWidth  = 0.2
+	photoBorderFrameWidth = 1.0
+	headerRuleWidth       = 0.4
+)
+
+var themeIdPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Theme is how a directory looks, apart from its layout: the fonts of each
+// role, its colors, and how headers and photos are drawn. Colors are
+// #RRGGBB. Anything left blank keeps the config's font or the classic look,
+// so the classic theme is blank throughout.
+//
+// Built-in themes are JSON files in themeDir, named by their ID; an
+// organization's own are saved in the datastore.
+type Theme struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Builtin bool   `json:"builtin"`
+
+	HeaderFontFamily string `json:"header_font_family"`
+	NameFontFamily   string `json:"name_font_family"`
+	BodyFontFamily   string `json:"body_font_family"`
+	PlaceholderFont  string `json:"placeholder_font_family"`
+
+	TextColor         string `json:"text_color"`
+	HeaderColor       string `json:"header_color"`
+	HeaderBandColor   string `json:"header_band_color"`
+	ShadingColor      string `json:"shading_color"`
+	RuleColor         string `json:"rule_color"`
+	LinkColor         string `json:"link_color"`
+	DividerColor      string `json:"divider_color"`
+	PlaceholderColors string `json:"placeholder_colors"`
+
+	HeaderStyle      string `json:"header_style"`
+	PhotoBorder      string `json:"photo_border"`
+	PhotoBorderColor string `json:"photo_border_color"`
+
+	Updated   time.Time `json:"updated,omitempty"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+}
+
+type ThemeRecord struct {
+	Theme     []byte `datastore:",noindex"`
+	Updated   time.Time
+	UpdatedBy string
+}
+
+// pdfStyle is a theme resolved into the colors and styles the drawing code
+// uses.
+type pdfStyle struct {
+	text        rgbColor
+	header      rgbColor
+	headerBand  rgbColor
+	headerStyle string
+	shading     rgbColor
+	rule        rgbColor
+	link        rgbColor
+	linkEmails  bool
+	divider     rgbColor
+	tab         rgbColor
+	emptyPhoto  rgbColor
+	photoBorder rgbColor
+	borderWidth float64
+}
+
+var themeRules = map[string]valueRule{
+	"header_style": {choices: []string{"", headerStylePlain, headerStyleBand, headerStyleRule}},
+	"photo_border": {choices: []string{"", photoBorderLine, photoBorderFrame}},
+}
+
+func themeKey(ctx context.Context, id string) *datastore.Key {
+	return datastore.NewKey(ctx, "Theme", id, 0, nil)
+}
+
+func loadBuiltinThemes() (themes []Theme, err error) {
+	files, err := filepath.Glob(filepath.Join(themeDir, "*.json"))
+	if err != nil {
+		return themes, err
+	}
+
+	for _, file := range files {
+		theme, err := readBuiltinTheme(file)
+		if err != nil {
+			return themes, err
+		}
+		themes = append(themes, theme)
+	}
+
+	return themes, nil
+}
+
+func readBuiltinTheme(file string) (theme Theme, err error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return theme, err
+	}
+
+	err = json.Unmarshal(contents, &theme)
+	if err != nil {
+		return theme, fmt.Errorf("theme %s: %s", filepath.Base(file), err)
+	}
+	theme.Id = strings.TrimSuffix(filepath.Base(file), ".json")
+	theme.Builtin = true
+
+	return theme, nil
+}
+
+// listThemes returns the built-in themes and then the organization's, each
+// in name order.
+func listThemes(ctx context.Context) (themes []Theme, err error) {
+	themes, err = loadBuiltinThemes()
+	if err != nil {
+		return themes, err
+	}
+	sort.SliceStable(themes, func(i, j int) bool { return themes[i].Name < themes[j].Name })
+
+	var records []ThemeRecord
+	keys, err := datastore.NewQuery("Theme").GetAll(ctx, &records)
+	if err != nil {
+		return themes, err
+	}
+
+	var orgThemes []Theme
+	for i, record := range records {
+		theme, err := record.theme(keys[i].StringID())
+		if err != nil {
+			return themes, err
+		}
+		orgThemes = append(orgThemes, theme)
+	}
+	sort.SliceStable(orgThemes, func(i, j int) bool { return orgThemes[i].Name < orgThemes[j].Name })
+
+	return append(themes, orgThemes...), nil
+}
+
+// loadTheme returns the built-in or organization theme with the ID. No ID
+// is the classic look.
+func loadTheme(ctx context.Context, id string) (theme Theme, err error) {
+	if id == "" {
+		return theme, nil
+	}
+	if !themeIdPattern.MatchString(id) {
+		return theme, fmt.Errorf("no theme %q", id)
+	}
+
+	theme, err = readBuiltinTheme(filepath.Join(themeDir, id+".json"))
+	if err == nil {
+		return theme, nil
+	}
+
+	record := ThemeRecord{}
+	err = datastore.Get(ctx, themeKey(ctx, id), &record)
+	if err == datastore.ErrNoSuchEntity {
+		return theme, fmt.Errorf("no theme %q", id)
+	}
+	if err != nil {
+		return theme, err
+	}
+
+	return record.theme(id)
+}
+
+func (record ThemeRecord) theme(id string) (theme Theme, err error) {
+	err = json.Unmarshal(record.Theme, &theme)
+	theme.Id = id
+	theme.Builtin = false
+	theme.Updated = record.Updated
+	theme.UpdatedBy = record.UpdatedBy
+
+	return theme, err
+}
+
+// saveTheme saves one of the organization's themes. Built-in themes can't
+// be replaced; clone them under a new ID instead.
+func saveTheme(ctx context.Context, theme *Theme, by string) (err error) {
+	if isBuiltinTheme(theme.Id) {
+		return fmt.Errorf("%q is a built-in theme; save it under another ID", theme.Id)
+	}
+
+	theme.Builtin = false
+	theme.Updated = time.Now()
+	theme.UpdatedBy = by
+
+	themeBytes, err := json.Marshal(theme)
+	if err != nil {
+		return err
+	}
+
+	_, err = datastore.Put(ctx, themeKey(ctx, theme.Id), &ThemeRecord{Theme: themeBytes, Updated: theme.Updated, UpdatedBy: by})
+
+	return err
+}
+
+func deleteTheme(ctx context.Context, id string) (err error) {
+	if isBuiltinTheme(id) {
+		return fmt.Errorf("%q is a built-in theme", id)
+	}
+
+	return datastore.Delete(ctx, themeKey(ctx, id))
+}
+
+func isBuiltinTheme(id string) bool {
+	if !themeIdPattern.MatchString(id) {
+		return false
+	}
+
+	_, err := readBuiltinTheme(filepath.Join(themeDir, id+".json"))
+	return err == nil
+}
+
+// validateTheme returns everything wrong with a theme being saved, with
+// fonts the families it may use.
+func validateTheme(theme *Theme, fonts []string) (errs []ConfigError) {
+	if !themeIdPattern.MatchString(theme.Id) {
+		errs = append(errs, ConfigError{Field: "id", Message: "use lowercase letters, digits and dashes"})
+	}
+	if strings.TrimSpace(theme.Name) == "" {
+		errs = append(errs, ConfigError{Field: "name", Message: "needs a name"})
+	}
+
+	errs = checkRules("", reflect.ValueOf(*theme), themeRules, errs)
+
+	for _, c := range theme.colorSettings() {
+		if _, ok := parseHexColor(c.hex); strings.TrimSpace(c.hex) != "" && !ok {
+			errs = append(errs, ConfigError{Field: c.field, Message: fmt.Sprintf("%q isn't a color like #1F3A5F", c.hex)})
+		}
+	}
+	for _, hex := range strings.Split(theme.PlaceholderColors, ",") {
+		if _, ok := parseHexColor(hex); strings.TrimSpace(hex) != "" && !ok {
+			errs = append(errs, ConfigError{Field: "placeholder_colors", Message: fmt.Sprintf("%q isn't a color like #1F3A5F", strings.TrimSpace(hex))})
+		}
+	}
+
+	if fonts == nil {
+		return errs
+	}
+
+	families := []fontSetting{
+		{"header_font_family", theme.HeaderFontFamily},
+		{"name_font_family", theme.NameFontFamily},
+		{"body_font_family", theme.BodyFontFamily},
+		{"placeholder_font_family", theme.PlaceholderFont},
+	}
+	for _, f := range families {
+		family := strings.TrimSpace(f.family)
+		if family != "" && !hasFont(fonts, family) {
+			errs = append(errs, ConfigError{Field: f.field, Message: fmt.Sprintf("no font %q; upload it or use one of %s", family, strings.Join(fonts, ", "))})
+		}
+	}
+
+	return errs
+}
+
+// applyTo returns a copy of the config with the theme's fonts and
+// placeholder colors in place of its own.
+func (theme Theme) applyTo(config *Config) *Config {
+	themed := *config
+
+	for _, f := range []struct {
+		setting *string
+		value   string
+	}{
+		{&themed.HeaderFontFamily, theme.HeaderFontFamily},
+		{&themed.NameFontFamily, theme.NameFontFamily},
+		{&themed.BodyFontFamily, theme.BodyFontFamily},
+		{&themed.PlaceholderFont, theme.PlaceholderFont},
+		{&themed.PlaceholderTints, theme.PlaceholderColors},
+	} {
+		if strings.TrimSpace(f.value) != "" {
+			*f.setting = strings.TrimSpace(f.value)
+		}
+	}
+
+	return &themed
+}
+
+// style resolves the theme's colors, with the classic look, shaded by the
+// config's highlight opacity, for those it leaves blank.
+func (theme Theme) style(highlightOpacity float64) (style pdfStyle) {
+	style.text = colorOr(theme.TextColor, rgbColor{0, 0, 0})
+	style.header = colorOr(theme.HeaderColor, style.text)
+	style.shading = colorOr(theme.ShadingColor, grayShade(highlightOpacity))
+	style.rule = colorOr(theme.RuleColor, rgbColor{0, 0, 0})
+	style.link = colorOr(theme.LinkColor, style.text)
+	style.linkEmails = strings.TrimSpace(theme.LinkColor) != ""
+
+	style.divider = colorOr(theme.DividerColor, grayShade(dividerShade))
+	style.tab = colorOr(theme.DividerColor, grayShade(dividerShade*3))
+	style.headerBand = colorOr(theme.HeaderBandColor, style.divider)
+
+	style.headerStyle = theme.HeaderStyle
+	if style.headerStyle == "" {
+		style.headerStyle = headerStylePlain
+	}
+
+	style.emptyPhoto = colorOr(theme.PhotoBorderColor, rgbColor{200, 200, 200})
+	style.photoBorder = colorOr(theme.PhotoBorderColor, style.rule)
+	switch theme.PhotoBorder {
+	case photoBorderLine:
+		style.borderWidth = photoBorderLineWidth
+	case photoBorderFrame:
+		style.borderWidth = photoBorderFrameWidth
+	}
+
+	return style
+}
+
+func colorOr(hex string, fallback rgbColor) rgbColor {
+	if color, ok := parseHexColor(hex); ok {
+		return color
+	}
+
+	return fallback
+}
+
+// grayShade is the gray that black at opacity would print as on white.
+func grayShade(opacity float64) rgbColor {
+	shade := int(math.Ceil(255 - (opacity * 255)))
+	return rgbColor{shade, shade, shade}
+}
+
+// setTextColor, setFillColor and setDrawColor set a color the way the
+// output profile prints it: RGB, or for offset printing a tint of process
+// black.
+func (dir *PdfDir) setTextColor(c rgbColor) {
+	if dir.outputProfile == outputProfileOffset {
+		dir.pdf.SetTextSpotColor(processBlack, blackTint(c))
+		return
+	}
+
+	dir.pdf.SetTextColor(c.r, c.g, c.b)
+}
+
+func (dir *PdfDir) setFillColor(c rgbColor) {
+	if dir.outputProfile == outputProfileOffset {
+		dir.pdf.SetFillSpotColor(processBlack, blackTint(c))
+		return
+	}
+
+	dir.pdf.SetFillColor(c.r, c.g, c.b)
+}
+
+func (dir *PdfDir) setDrawColor(c rgbColor) {
+	if dir.outputProfile == outputProfileOffset {
+		dir.pdf.SetDrawSpotColor(processBlack, blackTint(c))
+		return
+	}
+
+	dir.pdf.SetDrawColor(c.r, c.g, c.b)
+}
+
+// colorSettings are the theme's colors with the fields they're set by.
+func (theme Theme) colorSettings() []colorSetting {
+	return []colorSetting{
+		{"text_color", theme.TextColor},
+		{"header_color", theme.HeaderColor},
+		{"header_band_color", theme.HeaderBandColor},
+		{"shading_color", theme.ShadingColor},
+		{"rule_color", theme.RuleColor},
+		{"link_color", theme.LinkColor},
+		{"divider_color", theme.DividerColor},
+		{"photo_border_color", theme.PhotoBorderColor},
+	}
+}
+
+type colorSetting struct {
+	field string
+	hex   string
+}
+
+// writePhotoBorder outlines a photo drawn at x, y, w by h in the theme's
+// border. A frame is drawn outside the photo so it covers none of it.
+func (dir *PdfDir) writePhotoBorder(x, y, w, h float64) {
+	width := dir.style.borderWidth
+	if width == 0 {
+		return
+	}
+
+	lineWidth := dir.pdf.GetLineWidth()
+	dir.pdf.SetLineWidth(width)
+	dir.setDrawColor(dir.style.photoBorder)
+	if width > photoBorderLineWidth {
+		dir.pdf.Rect(x-width/2, y-width/2, w+width, h+width, "D")
+	} else {
+		dir.pdf.Rect(x, y, w, h, "D")
+	}
+	dir.pdf.SetLineWidth(lineWidth)
+	dir.setDrawColor(dir.style.rule)
+}
@@ -0,0 +1,364 @@
+package pc_pdf_generator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io/ioutil"
+	"math"
+	"strings"
+
+	"cloud.google.com/go/storage"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	entryImageWidth  = 25.0
+	defaultPhotoDPI  = 300.0
+	photoCropCenter  = "center"
+	photoCropFace    = "face"
+	thumbnailQuality = 85
+)
+
+// thumbnailSpec is the print size of photos: those beside directory entries,
+// or in the cells of a photo grid. Photos are cropped to its aspect ratio
+// and scaled to its resolution once, then stored under a key naming the
+// spec so later runs reuse them.
+type thumbnailSpec struct {
+	width  float64
+	height float64
+	dpi    float64
+	crop   string
+}
+
+func thumbnailSpecFor(config *Config) (spec thumbnailSpec) {
+	spec = thumbnailSpec{
+		width:  entryImageWidth,
+		height: config.ColumnHeight,
+		dpi:    config.PhotoDPI,
+		crop:   config.PhotoCrop,
+	}
+
+	if spec.height <= 0 {
+		spec.height = spec.width
+	}
+	if spec.dpi <= 0 {
+		spec.dpi = defaultPhotoDPI
+	}
+	if spec.crop != photoCropFace {
+		spec.crop = photoCropCenter
+	}
+
+	return spec
+}
+
+// sized returns the spec for photos printed width by height mm, rounded to
+// a tenth of a mm so the same layout keeps finding its thumbnails.
+func (spec thumbnailSpec) sized(width float64, height float64) thumbnailSpec {
+	spec.width = math.Round(width*10) / 10
+	spec.height = math.Round(height*10) / 10
+
+	return spec
+}
+
+// thumbnailPrefix is the folder holding every spec's thumbnail of the
+// cached photo source.
+func thumbnailPrefix(domain string, source string) string {
+	return fmt.Sprintf("%s/thumbs/%s/", domain, strings.TrimPrefix(source, domain+"/jpgs/"))
+}
+
+// deleteThumbnails removes every spec's thumbnail of the cached photo
+// source, for when the photo is replaced or removed.
+func deleteThumbnails(ctx context.Context, bucket *storage.BucketHandle, domain string, source string) (err error) {
+	it := bucket.Objects(ctx, &storage.Query{Prefix: thumbnailPrefix(domain, source)})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = bucket.Object(attrs.Name).Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+}
+
+func (spec thumbnailSpec) key() string {
+	return fmt.Sprintf("%gx%gmm-%gdpi-%s", spec.width, spec.height, spec.dpi, spec.crop)
+}
+
+func (spec thumbnailSpec) objectName(domain string, source string) string {
+	return thumbnailPrefix(domain, source) + spec.key() + ".jpg"
+}
+
+// load returns the thumbnail of the cached photo source, deriving it first
+// if this spec hasn't been used for the photo before.
+func (spec thumbnailSpec) load(ctx context.Context, bucket *storage.BucketHandle, domain string, source string) (contents []byte, err error) {
+	rc, err := bucket.Object(spec.objectName(domain, source)).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return spec.create(ctx, bucket, domain, source)
+	}
+	if err != nil {
+		return contents, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// create derives the thumbnail of the cached photo source and stores it.
+func (spec thumbnailSpec) create(ctx context.Context, bucket *storage.BucketHandle, domain string, source string) (contents []byte, err error) {
+	rc, err := bucket.Object(source).NewReader(ctx)
+	if err != nil {
+		return contents, err
+	}
+	defer rc.Close()
+
+	input, _, err := image.Decode(rc)
+	if err != nil {
+		return contents, err
+	}
+
+	buf := new(bytes.Buffer)
+	err = jpeg.Encode(buf, spec.apply(input), &jpeg.Options{Quality: thumbnailQuality})
+	if err != nil {
+		return contents, err
+	}
+
+	wc := bucket.Object(spec.objectName(domain, source)).NewWriter(ctx)
+	wc.ContentType = "image/jpeg"
+
+	_, err = wc.Write(buf.Bytes())
+	if err != nil {
+		wc.Close()
+		return contents, err
+	}
+
+	return buf.Bytes(), wc.Close()
+}
+
+// apply crops input to the spec's aspect ratio and scales it down to the
+// spec's resolution. Small photos are cropped but never enlarged.
+func (spec thumbnailSpec) apply(input image.Image) image.Image {
+	crop := cropRect(input, spec.width/spec.height, spec.crop)
+
+	width := int(math.Round(spec.width / 25.4 * spec.dpi))
+	height := int(math.Round(spec.height / 25.4 * spec.dpi))
+	if crop.Dx() < width {
+		width, height = crop.Dx(), crop.Dy()
+	}
+
+	return resize.Resize(uint(width), uint(height), subImage(input, crop), resize.Lanczos3)
+}
+
+// cropRect returns the largest rectangle of the given aspect ratio inside
+// the image. It's centered, or for face crops placed so the skin-toned
+// area sits a little above the middle, where a portrait's face belongs.
+func cropRect(input image.Image, aspect float64, crop string) image.Rectangle {
+	b := input.Bounds()
+
+	cropWd, cropHt := b.Dx(), int(float64(b.Dx())/aspect)
+	if cropHt > b.Dy() {
+		cropWd, cropHt = int(float64(b.Dy())*aspect), b.Dy()
+	}
+
+	x := b.Min.X + (b.Dx()-cropWd)/2
+	y := b.Min.Y + (b.Dy()-cropHt)/2
+
+	if crop == photoCropFace {
+		if faceX, faceY, ok := skinCentroid(input); ok {
+			x = faceX - cropWd/2
+			y = faceY - cropHt*2/5
+		}
+	}
+
+	x = clampInt(x, b.Min.X, b.Max.X-cropWd)
+	y = clampInt(y, b.Min.Y, b.Max.Y-cropHt)
+
+	return image.Rect(x, y, x+cropWd, y+cropHt)
+}
+
+// skinCentroid estimates where the faces are from the centroid of
+// skin-toned pixels, weighting the top of the photo over the bottom so
+// hands and arms pull less. ok is false when too little skin is found.
+func skinCentroid(input image.Image) (x int, y int, ok bool) {
+	b := input.Bounds()
+
+	step := b.Dx() / 100
+	if b.Dy()/100 < step {
+		step = b.Dy() / 100
+	}
+	if step < 1 {
+		step = 1
+	}
+
+	var sumX, sumY, sumWeight float64
+	samples, skin := 0, 0
+
+	for py := b.Min.Y; py < b.Max.Y; py += step {
+		weight := 2.0 - float64(py-b.Min.Y)/float64(b.Dy())
+		for px := b.Min.X; px < b.Max.X; px += step {
+			samples++
+
+			r, g, bl, _ := input.At(px, py).RGBA()
+			luma, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+			if luma < 40 || cb < 77 || cb > 127 || cr < 133 || cr > 173 {
+				continue
+			}
+
+			skin++
+			sumX += float64(px) * weight
+			sumY += float64(py) * weight
+			sumWeight += weight
+		}
+	}
+
+	if skin*100 < samples {
+		return x, y, false
+	}
+
+	return int(sumX / sumWeight), int(sumY / sumWeight), true
+}
+
+func clampInt(v int, min int, max int) int {
+	if v > max {
+		v = max
+	}
+	if v < min {
+		v = min
+	}
+	return v
+}
+
+func subImage(input image.Image, r image.Rectangle) image.Image {
+	if sub, ok := input.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+
+	output := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(output, output.Bounds(), input, r.Min, draw.Src)
+	return output
+}
+
+// exifOrientation reads the orientation tag of a JPEG's EXIF block. It
+// returns 1, upright, for other formats and photos without one.
+func exifOrientation(contents []byte) int {
+	if len(contents) < 4 || contents[0] != 0xFF || contents[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(contents); {
+		marker := contents[i+1]
+		if contents[i] != 0xFF || marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+
+		size := int(binary.BigEndian.Uint16(contents[i+2:]))
+		if size < 2 || i+2+size > len(contents) {
+			return 1
+		}
+
+		segment := contents[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+
+		i += 2 + size
+	}
+
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int64(order.Uint32(tiff[4:]))
+	if ifd+2 > int64(len(tiff)) {
+		return 1
+	}
+
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := int(ifd) + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+
+	return 1
+}
+
+// applyOrientation turns a photo upright according to its EXIF orientation.
+// The tag is lost when photos are re-encoded, so this has to happen before
+// they're cached.
+func applyOrientation(input image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return input
+	}
+
+	b := input.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	output := image.NewRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		output = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			output.Set(dx, dy, input.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+
+	return output
+}
@@ -0,0 +1,496 @@
+package pc_pdf_generator
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+	"golang.org/x/text/language"
+)
+
+// minColumnWidth is the narrowest column, in mm, a config may lay out.
+const minColumnWidth = 10.0
+
+// ConfigError is one problem with a config. Field is the setting's JSON
+// path, like sections[2].phone_count.
+type ConfigError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ConfigErrors is the body of a 422 answer to a config that didn't pass.
+type ConfigErrors struct {
+	Errors []ConfigError `json:"errors"`
+}
+
+// valueRule is what a setting may be: a number from min to max, whole
+// numbers only when whole is set, or one of choices, in any case when
+// anyCase is set. The same rules check configs and describe them in the
+// schema.
+type valueRule struct {
+	min     float64
+	max     float64
+	whole   bool
+	choices []string
+	anyCase bool
+}
+
+var (
+	pageSizes    = []string{"", "A1", "A2", "A3", "A4", "A5", "A6", "Letter", "Legal", "Tabloid", "HalfLetter", "6x9"}
+	orientations = []string{"", orientationPortrait, orientationLandscape}
+)
+
+var configRules = map[string]valueRule{
+	"top_margin":              {min: 0, max: 100},
+	"left_margin":             {min: 0, max: 100},
+	"bottom_margin":           {min: 0, max: 100},
+	"right_margin":            {min: 0, max: 100},
+	"inside_margin":           {min: 0, max: 100},
+	"outside_margin":          {min: 0, max: 100},
+	"binding_gutter":          {min: 0, max: 50},
+	"page_size":               {choices: pageSizes, anyCase: true},
+	"page_width":              {min: 0, max: 1200},
+	"page_height":             {min: 0, max: 1200},
+	"orientation":             {choices: orientations},
+	"bleed":                   {min: 0, max: 20},
+	"output_profile":          {choices: outputProfiles},
+	"min_image_dpi":           {min: 0, max: 1200},
+	"number_of_columns":       {min: 1, max: 12, whole: true},
+	"padding":                 {min: 0, max: 50},
+	"gutter":                  {min: 0, max: 50},
+	"image_padding":           {min: 0, max: 50},
+	"column_height":           {min: 1, max: 300},
+	"photo_dpi":               {min: 0, max: 1200},
+	"photo_crop":              {choices: []string{"", photoCropCenter, photoCropFace}},
+	"placeholder_style":       {choices: []string{"", placeholderCircle, placeholderSquare, placeholderSilhouette}},
+	"preflight_min_font_size": {min: 0, max: 72},
+	"layout_mode":             {choices: []string{"", layoutFixed, layoutFlow}},
+	"font_size":               {min: 4, max: 72},
+	"line_height":             {min: 0.5, max: 50},
+	"highlight_opacity":       {min: 0, max: 1},
+}
+
+var sectionRules = map[string]valueRule{
+	"phone_count":     {min: 0, max: 3, whole: true},
+	"line_spacing":    {min: 0, max: 20},
+	"columns":         {min: 0, max: 12, whole: true},
+	"type":            {choices: []string{"", sectionTypePhotoGrid}},
+	"grid_columns":    {min: 0, max: 12, whole: true},
+	"grid_rows":       {min: 0, max: 20, whole: true},
+	"letter_dividers": {choices: []string{"", dividerBand, dividerTab}},
+	"sort_by":         {choices: []string{"", sortBySurname, sortByHeadFirstName, sortByFamilyName, sortBySortAs}},
+	"orientation":     {choices: orientations},
+}
+
+var markerRuleRules = map[string]valueRule{
+	"condition": {choices: []string{conditionEmpty, conditionNotEmpty, conditionEquals, conditionContains, conditionWithinDays, conditionOlderThan, conditionTag}},
+}
+
+// validateConfig returns everything wrong with the config that would stop
+// it printing, with fonts the families and themes the themes it may use.
+// Without themes listed, the theme isn't checked.
+func validateConfig(config *Config, fonts []string, themes []Theme) (errs []ConfigError) {
+	errs = checkRules("", reflect.ValueOf(*config), configRules, errs)
+
+	if len(config.Sections) == 0 {
+		errs = append(errs, ConfigError{Field: "sections", Message: "needs at least one section"})
+	}
+	for i, section := range config.Sections {
+		errs = checkRules(fmt.Sprintf("sections[%d].", i), reflect.ValueOf(section), sectionRules, errs)
+	}
+	for i, rule := range config.MarkerRules {
+		errs = checkMarkerRule(fmt.Sprintf("marker_rules[%d].", i), rule, errs)
+	}
+
+	if config.Locale != "" {
+		if _, err := language.Parse(config.Locale); err != nil {
+			errs = append(errs, ConfigError{Field: "locale", Message: fmt.Sprintf("%q isn't a language tag like en or es-MX", config.Locale)})
+		}
+	}
+
+	errs = checkFonts(config, fonts, errs)
+	errs = checkTheme(config, themes, errs)
+	errs = checkPrint(config, themes, errs)
+
+	return checkGeometry(config, errs)
+}
+
+// checkRules checks the fields of a struct that have rules, by JSON name.
+func checkRules(path string, value reflect.Value, rules map[string]valueRule, errs []ConfigError) []ConfigError {
+	for i := 0; i < value.NumField(); i++ {
+		name, _ := jsonName(value.Type().Field(i))
+		rule, ok := rules[name]
+		if !ok {
+			continue
+		}
+
+		field := value.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			if !hasChoice(rule.choices, field.String(), rule.anyCase) {
+				errs = append(errs, ConfigError{Field: path + name, Message: fmt.Sprintf("%q isn't one of %s", field.String(), choiceList(rule.choices))})
+			}
+		case reflect.Float64, reflect.Int, reflect.Int64:
+			n := field.Convert(reflect.TypeOf(0.0)).Float()
+			if n < rule.min || n > rule.max {
+				errs = append(errs, ConfigError{Field: path + name, Message: fmt.Sprintf("must be from %g to %g", rule.min, rule.max)})
+			} else if rule.whole && n != float64(int64(n)) {
+				errs = append(errs, ConfigError{Field: path + name, Message: "must be a whole number"})
+			}
+		}
+	}
+
+	return errs
+}
+
+func checkMarkerRule(path string, rule MarkerRule, errs []ConfigError) []ConfigError {
+	errs = checkRules(path, reflect.ValueOf(rule), markerRuleRules, errs)
+
+	if strings.TrimSpace(rule.Symbol) == "" {
+		errs = append(errs, ConfigError{Field: path + "symbol", Message: "needs a symbol to print"})
+	}
+
+	if rule.Condition != conditionTag && strings.TrimSpace(rule.Field) == "" {
+		errs = append(errs, ConfigError{Field: path + "field", Message: "needs a field to check"})
+	}
+
+	switch rule.Condition {
+	case conditionTag:
+		if strings.TrimSpace(rule.Value) == "" {
+			errs = append(errs, ConfigError{Field: path + "value", Message: "needs the tag to match"})
+		}
+	case conditionWithinDays, conditionOlderThan:
+		days, err := strconv.ParseFloat(strings.TrimSpace(rule.Value), 64)
+		if err != nil || days < 0 {
+			errs = append(errs, ConfigError{Field: path + "value", Message: "must be a number of days"})
+		}
+	}
+
+	return errs
+}
+
+type fontSetting struct {
+	field  string
+	family string
+}
+
+// fontSettings lists the families the config names, fallbacks one by one.
+func fontSettings(config *Config) (families []fontSetting) {
+	families = []fontSetting{
+		{"font_family", config.FontFamily},
+		{"header_font_family", config.HeaderFontFamily},
+		{"name_font_family", config.NameFontFamily},
+		{"body_font_family", config.BodyFontFamily},
+		{"placeholder_font_family", config.PlaceholderFont},
+	}
+	for _, family := range strings.Split(config.FallbackFonts, ",") {
+		families = append(families, fontSetting{"fallback_fonts", family})
+	}
+
+	return families
+}
+
+// checkFonts makes sure every family the config names can be printed. With
+// no fonts listed, only a font being chosen is checked.
+func checkFonts(config *Config, fonts []string, errs []ConfigError) []ConfigError {
+	if strings.TrimSpace(config.FontFamily) == "" {
+		errs = append(errs, ConfigError{Field: "font_family", Message: "choose a font"})
+	}
+	if fonts == nil {
+		return errs
+	}
+
+	for _, f := range fontSettings(config) {
+		family := strings.TrimSpace(f.family)
+		if family != "" && !hasFont(fonts, family) {
+			errs = append(errs, ConfigError{Field: f.field, Message: fmt.Sprintf("no font %q; upload it or use one of %s", family, strings.Join(fonts, ", "))})
+		}
+	}
+
+	return errs
+}
+
+func checkTheme(config *Config, themes []Theme, errs []ConfigError) []ConfigError {
+	if config.Theme == "" || themes == nil {
+		return errs
+	}
+
+	var ids []string
+	for _, theme := range themes {
+		if theme.Id == config.Theme {
+			return errs
+		}
+		ids = append(ids, theme.Id)
+	}
+
+	return append(errs, ConfigError{Field: "theme", Message: fmt.Sprintf("no theme %q; use one of %s", config.Theme, strings.Join(ids, ", "))})
+}
+
+// checkPrint makes sure an offset print config, with its theme applied,
+// only prints in fonts that get embedded and in grays, which print on the
+// black plate, and doesn't scale photos below the resolution it checks for.
+func checkPrint(config *Config, themes []Theme, errs []ConfigError) []ConfigError {
+	if config.OutputProfile != outputProfileOffset {
+		return errs
+	}
+
+	themed := config
+	for _, theme := range themes {
+		if theme.Id != config.Theme {
+			continue
+		}
+		themed = theme.applyTo(config)
+
+		for _, c := range theme.colorSettings() {
+			if color, ok := parseHexColor(c.hex); ok && !isGray(color) {
+				errs = append(errs, ConfigError{Field: "theme", Message: fmt.Sprintf("the theme's %s %s isn't a gray; offset printing only prints in black and grays", c.field, strings.TrimSpace(c.hex))})
+			}
+		}
+	}
+
+	if themed.PlaceholderStyle != "" {
+		for _, color := range parsePlaceholderTints(themed.PlaceholderTints) {
+			if !isGray(color) {
+				errs = append(errs, ConfigError{Field: "placeholder_colors", Message: "offset printing only prints in black and grays; use gray placeholder colors like #808080"})
+				break
+			}
+		}
+	}
+
+	for _, f := range fontSettings(themed) {
+		family := strings.TrimSpace(f.family)
+		if hasFont(coreFonts, family) {
+			errs = append(errs, ConfigError{Field: f.field, Message: fmt.Sprintf("%s is a core PDF font, which isn't embedded; offset printing needs an uploaded or built-in font", family)})
+		}
+	}
+
+	if config.PhotoDPI > 0 && config.PhotoDPI < minImageDPI(config) {
+		errs = append(errs, ConfigError{Field: "photo_dpi", Message: fmt.Sprintf("photos are scaled to %g dpi, under the %g offset printing needs", config.PhotoDPI, minImageDPI(config))})
+	}
+
+	return errs
+}
+
+// checkGeometry makes sure the margins leave room on the page for the
+// columns and an entry, in every orientation the sections use.
+func checkGeometry(config *Config, errs []ConfigError) []ConfigError {
+	if (config.PageWidth > 0) != (config.PageHeight > 0) {
+		return append(errs, ConfigError{Field: "page_width", Message: "set both page_width and page_height for a custom size, or neither"})
+	}
+	if !hasChoice(pageSizes, config.PageSize, true) || !hasChoice(orientations, config.Orientation, false) || config.NumberOfColumns < 1 {
+		return errs
+	}
+
+	trim, err := trimSize(config)
+	if err != nil {
+		return append(errs, ConfigError{Field: "page_size", Message: err.Error()})
+	}
+
+	errs = checkPageGeometry(config, orientedSize(trim, config.Orientation), "", pageSizeName(config), errs)
+	errs = checkGridGeometry(config, trim, errs)
+
+	for i, section := range config.Sections {
+		if section.Orientation == "" || section.Orientation == config.Orientation || !hasChoice(orientations, section.Orientation, false) {
+			continue
+		}
+
+		oriented := *config
+		oriented.Orientation = section.Orientation
+		errs = checkPageGeometry(config, orientedSize(trim, section.Orientation), fmt.Sprintf("sections[%d].orientation", i), pageSizeName(&oriented), errs)
+	}
+
+	return errs
+}
+
+// checkPageGeometry checks the columns and margins fit a page of the size.
+// field names the setting to blame, when it isn't the one that's too big.
+func checkPageGeometry(config *Config, size gofpdf.SizeType, field string, name string, errs []ConfigError) []ConfigError {
+	left, right := config.LeftMargin+config.BindingGutter, config.RightMargin
+	if config.MirrorMargins {
+		left, right = config.InsideMargin+config.BindingGutter, config.OutsideMargin
+	}
+
+	width := (size.Wd - left - right - (config.NumberOfColumns-1)*config.Gutter) / config.NumberOfColumns
+	if width < minColumnWidth {
+		errs = append(errs, ConfigError{Field: fieldOr(field, "number_of_columns"), Message: fmt.Sprintf("columns would be %.1fmm wide on %s; use fewer columns, a smaller gutter or smaller margins", width, name)})
+	}
+
+	height := size.Ht - config.TopMargin - config.BottomMargin
+	if height <= 0 {
+		errs = append(errs, ConfigError{Field: fieldOr(field, "top_margin"), Message: fmt.Sprintf("top and bottom margins leave no room on %s", name)})
+	} else if config.ColumnHeight > height {
+		errs = append(errs, ConfigError{Field: fieldOr(field, "column_height"), Message: fmt.Sprintf("must fit in the %.1fmm between the margins on %s", height, name)})
+	}
+
+	return errs
+}
+
+// checkGridGeometry makes sure the cells of each photo grid leave room for
+// a photo above the caption.
+func checkGridGeometry(config *Config, trim gofpdf.SizeType, errs []ConfigError) []ConfigError {
+	for i, section := range config.Sections {
+		if section.Type != sectionTypePhotoGrid {
+			continue
+		}
+
+		orientation := section.Orientation
+		if orientation == "" {
+			orientation = config.Orientation
+		}
+		size := orientedSize(trim, orientation)
+
+		_, rows := gridSize(section)
+		cellHt := (size.Ht - config.TopMargin - config.BottomMargin - float64(rows-1)*config.Padding) / float64(rows)
+		photoHt := cellHt - float64(gridCaptionLines(section))*config.LineHeight - config.ImagePadding
+		if photoHt < minGridPhotoHeight {
+			errs = append(errs, ConfigError{Field: fmt.Sprintf("sections[%d].grid_rows", i), Message: fmt.Sprintf("leaves %.1fmm for each photo; use fewer rows or caption fields, or less padding", photoHt)})
+		}
+	}
+
+	return errs
+}
+
+func fieldOr(field string, fallback string) string {
+	if field != "" {
+		return field
+	}
+
+	return fallback
+}
+
+// hasChoice reports whether value is one of choices. Only page sizes are
+// matched in any case, since gofpdf lowercases them; everything else is
+// compared as it's printed.
+func hasChoice(choices []string, value string, anyCase bool) bool {
+	if choices == nil {
+		return true
+	}
+
+	for _, choice := range choices {
+		if choice == value || anyCase && strings.EqualFold(choice, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func choiceList(choices []string) string {
+	var list []string
+	for _, choice := range choices {
+		if choice == "" {
+			choice = "blank"
+		}
+		list = append(list, choice)
+	}
+
+	return strings.Join(list, ", ")
+}
+
+func hasFont(fonts []string, family string) bool {
+	for _, font := range fonts {
+		if strings.EqualFold(font, family) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// typeName says what a JSON value needs to be to decode into t.
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.String:
+		return "text"
+	case reflect.Float64, reflect.Int, reflect.Int64:
+		return "a number"
+	case reflect.Slice:
+		return "a list"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	}
+
+	return t.String()
+}
+
+// jsonName returns a field's JSON name and whether it's sent as a string.
+func jsonName(field reflect.StructField) (name string, quoted bool) {
+	parts := strings.Split(field.Tag.Get("json"), ",")
+	for _, option := range parts[1:] {
+		quoted = quoted || option == "string"
+	}
+
+	return parts[0], quoted
+}
+
+// configSchema is the JSON Schema of a config, built from the Config type
+// and the rules validateConfig checks.
+func configSchema() map[string]interface{} {
+	schema := objectSchema(reflect.TypeOf(Config{}), configRules)
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "Directory config"
+	schema["required"] = []string{"font_family", "sections"}
+
+	return schema
+}
+
+func objectSchema(t reflect.Type, rules map[string]valueRule) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		name, quoted := jsonName(t.Field(i))
+		if name == "" || name == "-" {
+			continue
+		}
+		properties[name] = valueSchema(t.Field(i).Type, quoted, rules[name])
+	}
+
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func valueSchema(t reflect.Type, quoted bool, rule valueRule) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		schema := map[string]interface{}{"type": "string"}
+		if rule.choices != nil {
+			schema["enum"] = rule.choices
+		}
+		return schema
+	case reflect.Float64, reflect.Int, reflect.Int64:
+		schema := map[string]interface{}{"type": "number"}
+		if rule.whole {
+			schema["type"] = "integer"
+		}
+		if rule.max != 0 {
+			schema["minimum"], schema["maximum"] = rule.min, rule.max
+		}
+		if quoted {
+			// Numbers are sent as strings, so the range can only be
+			// described.
+			description := "a number"
+			if rule.whole {
+				description = "a whole number"
+			}
+			if rule.max != 0 {
+				description = fmt.Sprintf("%s from %g to %g", description, rule.min, rule.max)
+			}
+			return map[string]interface{}{"type": "string", "pattern": `^-?[0-9]*\.?[0-9]+$`, "description": description + ", as a string"}
+		}
+		return schema
+	case reflect.Slice:
+		switch t.Elem() {
+		case reflect.TypeOf(Section{}):
+			return map[string]interface{}{"type": "array", "minItems": 1, "items": objectSchema(t.Elem(), sectionRules)}
+		case reflect.TypeOf(MarkerRule{}):
+			return map[string]interface{}{"type": "array", "items": objectSchema(t.Elem(), markerRuleRules)}
+		}
+		return map[string]interface{}{"type": "array", "items": valueSchema(t.Elem(), false, valueRule{})}
+	}
+
+	return map[string]interface{}{}
+}